@@ -0,0 +1,764 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/golang/glog"
+)
+
+// Severities of vulnerabilities, from the advisory or its CVSS v3 vector.
+const (
+	SeverityCritical = "CRITICAL"
+	SeverityHigh     = "HIGH"
+	SeverityMedium   = "MEDIUM"
+	SeverityLow      = "LOW"
+	SeverityUnknown  = "UNKNOWN"
+)
+
+var severityOrder = []string{SeverityCritical, SeverityHigh, SeverityMedium, SeverityLow, SeverityUnknown}
+
+// osvEntry is an advisory in the OSV format.
+// ref: https://ossf.github.io/osv-schema/
+type osvEntry struct {
+	ID       string   `json:"id"`
+	Aliases  []string `json:"aliases"`
+	Summary  string   `json:"summary"`
+	Severity []struct {
+		Type  string `json:"type"`
+		Score string `json:"score"`
+	} `json:"severity"`
+	Affected []struct {
+		Package struct {
+			Ecosystem string `json:"ecosystem"`
+			Name      string `json:"name"`
+		} `json:"package"`
+		Ranges []struct {
+			Type   string              `json:"type"`
+			Events []map[string]string `json:"events"`
+		} `json:"ranges"`
+		Versions         []string `json:"versions"`
+		DatabaseSpecific struct {
+			Severity string `json:"severity"`
+		} `json:"database_specific"`
+		EcosystemSpecific struct {
+			Severity string `json:"severity"`
+		} `json:"ecosystem_specific"`
+	} `json:"affected"`
+	DatabaseSpecific struct {
+		Severity string `json:"severity"`
+	} `json:"database_specific"`
+}
+
+// AdvisoryDB is a local copy of OSV advisories, indexed by ecosystem and package name.
+type AdvisoryDB struct {
+	entries map[string]map[string][]*osvEntry
+	count   int
+}
+
+// LoadAdvisoryDB reads OSV advisories from JSON files and zip archives, like the all.zip exports of
+// https://osv-vulnerabilities.storage.googleapis.com, found at path or below it. It never uses the network.
+func LoadAdvisoryDB(path string) (*AdvisoryDB, error) {
+	db := &AdvisoryDB{entries: map[string]map[string][]*osvEntry{}}
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			return nil
+		case strings.HasSuffix(p, ".zip"):
+			return db.loadZip(p)
+		case strings.HasSuffix(p, ".json"):
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			return db.add(p, data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if db.count == 0 {
+		return nil, fmt.Errorf("no advisories found in %s", path)
+	}
+	glog.V(2).Infof("Loaded %d advisories from %s", db.count, path)
+	return db, nil
+}
+
+func (db *AdvisoryDB) loadZip(name string) error {
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if !strings.HasSuffix(f.Name, ".json") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if err := db.add(name+":"+f.Name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add indexes an advisory, or a JSON array of advisories.
+func (db *AdvisoryDB) add(source string, data []byte) error {
+	var entries []*osvEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		var e osvEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return fmt.Errorf("%s: %v", source, err)
+		}
+		entries = []*osvEntry{&e}
+	}
+	for _, e := range entries {
+		seen := map[string]bool{}
+		for _, a := range e.Affected {
+			// OSV ecosystems may carry a release, e.g. Debian:11 or Alpine:v3.18
+			eco := strings.ToLower(a.Package.Ecosystem)
+			name := normalizePackageName(eco, a.Package.Name)
+			if seen[eco+"/"+name] {
+				continue
+			}
+			seen[eco+"/"+name] = true
+			if db.entries[eco] == nil {
+				db.entries[eco] = map[string][]*osvEntry{}
+			}
+			db.entries[eco][name] = append(db.entries[eco][name], e)
+		}
+		db.count++
+	}
+	return nil
+}
+
+func normalizePackageName(ecosystem, name string) string {
+	if strings.EqualFold(ecosystem, "PyPI") {
+		return strings.ToLower(strings.NewReplacer("_", "-", ".", "-").Replace(name))
+	}
+	return name
+}
+
+// osvEcosystem returns the OSV ecosystem of a package, and the package name advisories use:
+// Debian and Alpine advisories name source packages.
+func osvEcosystem(pkg Package, rel *OSRelease) (string, string) {
+	src := pkg.Name
+	if pkg.SourcePackage != "" {
+		src = pkg.SourcePackage
+	}
+	switch pkg.Type {
+	case PackageTypeDeb:
+		if rel == nil || rel.ID != "debian" || rel.VersionID == "" {
+			return "", ""
+		}
+		return "Debian:" + rel.VersionID, src
+	case PackageTypeAPK:
+		if rel == nil || rel.VersionID == "" {
+			return "", ""
+		}
+		// Alpine:v3.18 for VERSION_ID 3.18.4
+		parts := strings.SplitN(rel.VersionID, ".", 3)
+		if len(parts) < 2 {
+			return "", ""
+		}
+		return "Alpine:v" + parts[0] + "." + parts[1], src
+	case PackageTypeNPM:
+		return "npm", pkg.Name
+	case PackageTypePyPI:
+		return "PyPI", pkg.Name
+	case PackageTypeCargo:
+		return "crates.io", pkg.Name
+	case PackageTypeGem:
+		return "RubyGems", pkg.Name
+	case PackageTypeComposer:
+		return "Packagist", pkg.Name
+	}
+	return "", ""
+}
+
+// Vulnerability is an advisory affecting a package of an image.
+type Vulnerability struct {
+	ID           string   `json:"id"`
+	Aliases      []string `json:"aliases,omitempty"`
+	Package      string   `json:"package"`
+	Version      string   `json:"version"`
+	Type         string   `json:"type"`
+	FixedVersion string   `json:"fixedVersion,omitempty"`
+	Severity     string   `json:"severity"`
+	Summary      string   `json:"summary,omitempty"`
+}
+
+// Match returns the advisories affecting the packages of an inventory.
+func (db *AdvisoryDB) Match(inv *Inventory) []Vulnerability {
+	var vulns []Vulnerability
+	for _, pkg := range inv.Packages {
+		eco, name := osvEcosystem(pkg, inv.OS)
+		if eco == "" {
+			continue
+		}
+		compare := versionComparer(pkg.Type)
+		for _, e := range db.entries[strings.ToLower(eco)][normalizePackageName(eco, name)] {
+			for _, a := range e.Affected {
+				if !strings.EqualFold(a.Package.Ecosystem, eco) || normalizePackageName(eco, a.Package.Name) != normalizePackageName(eco, name) {
+					continue
+				}
+				affected, fixed := false, ""
+				for _, v := range a.Versions {
+					if v == pkg.Version {
+						affected = true
+					}
+				}
+				for _, r := range a.Ranges {
+					if r.Type == "GIT" {
+						continue
+					}
+					if ok, f := inRange(pkg.Version, r.Events, compare); ok {
+						affected, fixed = true, f
+					}
+				}
+				if !affected {
+					continue
+				}
+				severity := e.DatabaseSpecific.Severity
+				for _, s := range []string{a.EcosystemSpecific.Severity, a.DatabaseSpecific.Severity} {
+					if severity == "" {
+						severity = s
+					}
+				}
+				vulns = append(vulns, Vulnerability{
+					ID:           e.ID,
+					Aliases:      e.Aliases,
+					Package:      pkg.Name,
+					Version:      pkg.Version,
+					Type:         pkg.Type,
+					FixedVersion: fixed,
+					Severity:     normalizeSeverity(severity, e),
+					Summary:      e.Summary,
+				})
+				break
+			}
+		}
+	}
+	return vulns
+}
+
+// inRange evaluates the events of an OSV range, returning whether v is affected and the version fixing it.
+func inRange(v string, events []map[string]string, compare func(a, b string) int) (bool, string) {
+	affected := false
+	fixed := ""
+	for _, ev := range events {
+		if intro, ok := ev["introduced"]; ok && (intro == "0" || compare(v, intro) >= 0) {
+			affected, fixed = true, ""
+		}
+		if f, ok := ev["fixed"]; ok && affected {
+			if compare(v, f) >= 0 {
+				affected = false
+			} else if fixed == "" {
+				fixed = f
+			}
+		}
+		if last, ok := ev["last_affected"]; ok && affected && compare(v, last) > 0 {
+			affected = false
+		}
+	}
+	return affected, fixed
+}
+
+func normalizeSeverity(severity string, e *osvEntry) string {
+	switch strings.ToUpper(severity) {
+	case "CRITICAL":
+		return SeverityCritical
+	case "HIGH", "IMPORTANT":
+		return SeverityHigh
+	case "MEDIUM", "MODERATE":
+		return SeverityMedium
+	case "LOW", "NEGLIGIBLE", "UNIMPORTANT":
+		return SeverityLow
+	}
+	for _, s := range e.Severity {
+		if s.Type != "CVSS_V3" {
+			continue
+		}
+		if score, err := cvss3BaseScore(s.Score); err == nil {
+			switch {
+			case score >= 9:
+				return SeverityCritical
+			case score >= 7:
+				return SeverityHigh
+			case score >= 4:
+				return SeverityMedium
+			case score > 0:
+				return SeverityLow
+			}
+		}
+	}
+	return SeverityUnknown
+}
+
+// cvss3BaseScore computes the base score of a CVSS v3.x vector.
+// ref: https://www.first.org/cvss/v3.1/specification-document#7-4-Metric-Values
+func cvss3BaseScore(vector string) (float64, error) {
+	weights := map[string]map[string]float64{
+		"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+		"AC": {"L": 0.77, "H": 0.44},
+		"PR": {"N": 0.85, "L": 0.62, "H": 0.27},
+		"UI": {"N": 0.85, "R": 0.62},
+		"C":  {"H": 0.56, "L": 0.22, "N": 0},
+		"I":  {"H": 0.56, "L": 0.22, "N": 0},
+		"A":  {"H": 0.56, "L": 0.22, "N": 0},
+	}
+	metrics := map[string]string{}
+	for _, part := range strings.Split(vector, "/") {
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) == 2 {
+			metrics[kv[0]] = kv[1]
+		}
+	}
+	if !strings.HasPrefix(metrics["CVSS"], "3") {
+		return 0, fmt.Errorf("not a CVSS v3 vector: %s", vector)
+	}
+	changed := metrics["S"] == "C"
+	values := map[string]float64{}
+	for m, w := range weights {
+		v, ok := w[metrics[m]]
+		if !ok {
+			return 0, fmt.Errorf("invalid metric %s in %s", m, vector)
+		}
+		values[m] = v
+	}
+	if changed {
+		// privileges weigh more when the scope changes
+		switch metrics["PR"] {
+		case "L":
+			values["PR"] = 0.68
+		case "H":
+			values["PR"] = 0.5
+		}
+	}
+
+	iss := 1 - (1-values["C"])*(1-values["I"])*(1-values["A"])
+	impact := 6.42 * iss
+	if changed {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	if impact <= 0 {
+		return 0, nil
+	}
+	exploitability := 8.22 * values["AV"] * values["AC"] * values["PR"] * values["UI"]
+	score := impact + exploitability
+	if changed {
+		score *= 1.08
+	}
+	return roundUp(math.Min(score, 10)), nil
+}
+
+// roundUp rounds up to one decimal, as defined in appendix A of the CVSS v3.1 specification.
+func roundUp(x float64) float64 {
+	i := int64(math.Round(x * 100000))
+	if i%10000 == 0 {
+		return float64(i) / 100000
+	}
+	return float64(i/10000+1) / 10
+}
+
+// versionComparer returns the version ordering of a package type.
+func versionComparer(typ string) func(a, b string) int {
+	switch typ {
+	case PackageTypeDeb:
+		return compareDebianVersions
+	case PackageTypeAPK:
+		return compareAPKVersions
+	case PackageTypePyPI:
+		return comparePEP440
+	case PackageTypeNPM, PackageTypeCargo, PackageTypeComposer:
+		return compareSemver
+	}
+	return compareVersions
+}
+
+// compareDebianVersions orders [epoch:]upstream[-revision] versions like dpkg.
+// ref: https://www.debian.org/doc/debian-policy/ch-controlfields.html#version
+func compareDebianVersions(a, b string) int {
+	split := func(v string) (int, string, string) {
+		epoch := 0
+		if i := strings.Index(v, ":"); i >= 0 {
+			epoch, _ = strconv.Atoi(v[:i])
+			v = v[i+1:]
+		}
+		rev := ""
+		if i := strings.LastIndex(v, "-"); i >= 0 {
+			v, rev = v[:i], v[i+1:]
+		}
+		return epoch, v, rev
+	}
+	ea, ua, ra := split(a)
+	eb, ub, rb := split(b)
+	if ea != eb {
+		if ea < eb {
+			return -1
+		}
+		return 1
+	}
+	if c := dpkgCompare(ua, ub); c != 0 {
+		return c
+	}
+	return dpkgCompare(ra, rb)
+}
+
+func dpkgOrder(c byte) int {
+	switch {
+	case c == '~':
+		return -1
+	case c == 0, c >= '0' && c <= '9':
+		return 0
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return int(c)
+	}
+	return int(c) + 256
+}
+
+// dpkgCompare is verrevcmp of dpkg: non digit parts compare with ~ sorting first, digit parts numerically.
+func dpkgCompare(a, b string) int {
+	at := func(s string, i int) byte {
+		if i < len(s) {
+			return s[i]
+		}
+		return 0
+	}
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+			if ac, bc := dpkgOrder(at(a, i)), dpkgOrder(at(b, j)); ac != bc {
+				return ac - bc
+			}
+			i++
+			j++
+		}
+		for at(a, i) == '0' {
+			i++
+		}
+		for at(b, j) == '0' {
+			j++
+		}
+		diff := 0
+		for isDigit(at(a, i)) && isDigit(at(b, j)) {
+			if diff == 0 {
+				diff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if isDigit(at(a, i)) {
+			return 1
+		}
+		if isDigit(at(b, j)) {
+			return -1
+		}
+		if diff != 0 {
+			return diff
+		}
+	}
+	return 0
+}
+
+// compareSemver orders semantic versions: build metadata is ignored and pre-releases sort before releases.
+func compareSemver(a, b string) int {
+	strip := func(v string) (string, string) {
+		v = strings.TrimPrefix(strings.SplitN(v, "+", 2)[0], "v")
+		parts := strings.SplitN(v, "-", 2)
+		if len(parts) == 2 {
+			return parts[0], parts[1]
+		}
+		return parts[0], ""
+	}
+	va, pa := strip(a)
+	vb, pb := strip(b)
+	if c := compareVersions(va, vb); c != 0 {
+		return c
+	}
+	switch {
+	case pa == pb:
+		return 0
+	case pa == "":
+		return 1
+	case pb == "":
+		return -1
+	}
+	// dot separated identifiers, numeric ones sort first and more identifiers sort last
+	ia, ib := strings.Split(pa, "."), strings.Split(pb, ".")
+	for i := 0; i < len(ia) && i < len(ib); i++ {
+		na, errA := strconv.ParseUint(ia[i], 10, 64)
+		nb, errB := strconv.ParseUint(ib[i], 10, 64)
+		switch {
+		case errA == nil && errB == nil:
+			if c := compareInts(int64(na), int64(nb)); c != 0 {
+				return c
+			}
+		case errA == nil:
+			return -1
+		case errB == nil:
+			return 1
+		default:
+			if c := strings.Compare(ia[i], ib[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInts(int64(len(ia)), int64(len(ib)))
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// pep440RE matches the normalizable PyPI versions.
+// ref: https://peps.python.org/pep-0440/#appendix-b-parsing-version-strings-with-regular-expressions
+var pep440RE = regexp.MustCompile(`^v?(?:(\d+)!)?(\d+(?:\.\d+)*)` +
+	`(?:[-_.]?(a|b|c|rc|alpha|beta|pre|preview)[-_.]?(\d+)?)?` +
+	`(?:-(\d+)|[-_.]?(post|rev|r)[-_.]?(\d+)?)?` +
+	`(?:[-_.]?(dev)[-_.]?(\d+)?)?(?:\+[a-z0-9._-]+)?$`)
+
+// pep440Version is a parsed PyPI version. pre ranks dev releases without a pre or post-release
+// below a, b and rc pre-releases, which rank below the release.
+type pep440Version struct {
+	epoch          int64
+	release        []int64
+	pre, preNum    int64
+	post, dev      int64
+	hasPost, isDev bool
+}
+
+func parsePEP440(v string) (*pep440Version, bool) {
+	m := pep440RE.FindStringSubmatch(strings.ToLower(strings.TrimSpace(v)))
+	if m == nil {
+		return nil, false
+	}
+	num := func(s string) int64 {
+		n, _ := strconv.ParseInt(s, 10, 64)
+		return n
+	}
+	p := &pep440Version{epoch: num(m[1]), pre: 3, preNum: num(m[4]), post: num(m[5] + m[7]), dev: num(m[9])}
+	for _, r := range strings.Split(m[2], ".") {
+		p.release = append(p.release, num(r))
+	}
+	switch m[3] {
+	case "a", "alpha":
+		p.pre = 0
+	case "b", "beta":
+		p.pre = 1
+	case "c", "rc", "pre", "preview":
+		p.pre = 2
+	}
+	p.hasPost = m[5] != "" || m[6] != ""
+	p.isDev = m[8] != ""
+	if p.isDev && m[3] == "" && !p.hasPost {
+		p.pre = -1
+	}
+	return p, true
+}
+
+// comparePEP440 orders PyPI versions: dev releases sort before pre-releases, which sort before
+// the release and its post-releases. Versions that do not follow PEP 440 fall back to compareVersions.
+func comparePEP440(a, b string) int {
+	va, okA := parsePEP440(a)
+	vb, okB := parsePEP440(b)
+	if !okA || !okB {
+		return compareVersions(a, b)
+	}
+	if c := compareInts(va.epoch, vb.epoch); c != 0 {
+		return c
+	}
+	for i := 0; i < len(va.release) || i < len(vb.release); i++ {
+		var x, y int64
+		if i < len(va.release) {
+			x = va.release[i]
+		}
+		if i < len(vb.release) {
+			y = vb.release[i]
+		}
+		if c := compareInts(x, y); c != 0 {
+			return c
+		}
+	}
+	if c := compareInts(va.pre, vb.pre); c != 0 {
+		return c
+	}
+	if c := compareInts(va.preNum, vb.preNum); c != 0 {
+		return c
+	}
+	if va.hasPost != vb.hasPost {
+		if va.hasPost {
+			return 1
+		}
+		return -1
+	}
+	if c := compareInts(va.post, vb.post); c != 0 {
+		return c
+	}
+	if va.isDev != vb.isDev {
+		if va.isDev {
+			return -1
+		}
+		return 1
+	}
+	return compareInts(va.dev, vb.dev)
+}
+
+// apkVersionRE matches Alpine package versions: numbers, an optional letter, suffixes and a revision.
+// ref: https://wiki.alpinelinux.org/wiki/APKBUILD_Reference#pkgver
+var apkVersionRE = regexp.MustCompile(`^(\d+(?:\.\d+)*)([a-z]?)((?:_(?:alpha|beta|pre|rc|cvs|svn|git|hg|p)\d*)*)(?:-r(\d+))?$`)
+
+// apkSuffixes are the apk version suffixes in ascending order; a version without a suffix ranks
+// between rc and cvs.
+var apkSuffixes = []string{"alpha", "beta", "pre", "rc", "", "cvs", "svn", "git", "hg", "p"}
+
+type apkSuffix struct {
+	rank, num int64
+}
+
+func parseAPKSuffixes(s string) []apkSuffix {
+	var suffixes []apkSuffix
+	for _, part := range strings.Split(s, "_")[1:] {
+		name := strings.TrimRightFunc(part, unicode.IsDigit)
+		n, _ := strconv.ParseInt(part[len(name):], 10, 64)
+		for i, suffix := range apkSuffixes {
+			if suffix == name {
+				suffixes = append(suffixes, apkSuffix{int64(i), n})
+			}
+		}
+	}
+	return suffixes
+}
+
+// compareAPKVersions orders Alpine package versions like apk: the _alpha, _beta, _pre and _rc
+// pre-releases sort before the release and _cvs, _svn, _git, _hg and _p after it. Versions that
+// do not follow the apk format fall back to compareVersions.
+func compareAPKVersions(a, b string) int {
+	ma, mb := apkVersionRE.FindStringSubmatch(a), apkVersionRE.FindStringSubmatch(b)
+	if ma == nil || mb == nil {
+		return compareVersions(a, b)
+	}
+	ra, rb := strings.Split(ma[1], "."), strings.Split(mb[1], ".")
+	for i := 0; i < len(ra) && i < len(rb); i++ {
+		x, _ := strconv.ParseInt(ra[i], 10, 64)
+		y, _ := strconv.ParseInt(rb[i], 10, 64)
+		if c := compareInts(x, y); c != 0 {
+			return c
+		}
+	}
+	if c := compareInts(int64(len(ra)), int64(len(rb))); c != 0 {
+		return c
+	}
+	if c := strings.Compare(ma[2], mb[2]); c != 0 {
+		return c
+	}
+	sa, sb := parseAPKSuffixes(ma[3]), parseAPKSuffixes(mb[3])
+	release := apkSuffix{rank: 4}
+	for i := 0; i < len(sa) || i < len(sb); i++ {
+		x, y := release, release
+		if i < len(sa) {
+			x = sa[i]
+		}
+		if i < len(sb) {
+			y = sb[i]
+		}
+		if c := compareInts(x.rank, y.rank); c != 0 {
+			return c
+		}
+		if c := compareInts(x.num, y.num); c != 0 {
+			return c
+		}
+	}
+	x, _ := strconv.ParseInt(ma[4], 10, 64)
+	y, _ := strconv.ParseInt(mb[4], 10, 64)
+	return compareInts(x, y)
+}
+
+// compareVersions orders versions by their runs of digits, compared numerically, and letters, like
+// RubyGems: a run of letters marks a pre-release, so it sorts before any number and a missing run
+// counts as 0. It is the fallback for version schemes without a dedicated ordering.
+func compareVersions(a, b string) int {
+	ta, tb := versionTokens(a), versionTokens(b)
+	for i := 0; i < len(ta) || i < len(tb); i++ {
+		x, y := "0", "0"
+		if i < len(ta) {
+			x = ta[i]
+		}
+		if i < len(tb) {
+			y = tb[i]
+		}
+		na, errA := strconv.ParseUint(x, 10, 64)
+		nb, errB := strconv.ParseUint(y, 10, 64)
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				if na < nb {
+					return -1
+				}
+				return 1
+			}
+		case errA == nil:
+			return 1
+		case errB == nil:
+			return -1
+		default:
+			if c := strings.Compare(x, y); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
+
+func versionTokens(v string) []string {
+	var tokens []string
+	cur := ""
+	digit := false
+	for _, r := range v {
+		if !unicode.IsDigit(r) && !unicode.IsLetter(r) {
+			if cur != "" {
+				tokens = append(tokens, cur)
+			}
+			cur = ""
+			continue
+		}
+		if cur != "" && unicode.IsDigit(r) != digit {
+			tokens = append(tokens, cur)
+			cur = ""
+		}
+		digit = unicode.IsDigit(r)
+		cur += string(r)
+	}
+	if cur != "" {
+		tokens = append(tokens, cur)
+	}
+	return tokens
+}
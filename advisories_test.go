@@ -0,0 +1,186 @@
+package main
+
+import "testing"
+
+// checkOrder fails t unless compare orders versions ascending, and equal pairs as equal.
+func checkOrder(t *testing.T, name string, compare func(a, b string) int, versions []string, equal [][2]string) {
+	for i, a := range versions {
+		for j, b := range versions {
+			want := compareInts(int64(i), int64(j))
+			if got := compare(a, b); compareInts(int64(got), 0) != want {
+				t.Errorf("%s(%q, %q) = %d, want %d", name, a, b, got, want)
+			}
+		}
+	}
+	for _, e := range equal {
+		if got := compare(e[0], e[1]); got != 0 {
+			t.Errorf("%s(%q, %q) = %d, want 0", name, e[0], e[1], got)
+		}
+	}
+}
+
+func TestCompareDebianVersions(t *testing.T) {
+	// ref: https://www.debian.org/doc/debian-policy/ch-controlfields.html#version
+	checkOrder(t, "compareDebianVersions", compareDebianVersions, []string{
+		"0.9",
+		"1.0~~",
+		"1.0~~a",
+		"1.0~rc1",
+		"1.0",
+		"1.0-1",
+		"1.0-1ubuntu1",
+		"1.0-2",
+		"1.0a",
+		"1.0+dfsg",
+		"1.0.1",
+		"1.1",
+		"1.10",
+		"1:0.9",
+	}, [][2]string{
+		{"0:1.0", "1.0"},
+		{"1.0-0", "1.0"},
+		{"1.01", "1.1"},
+	})
+}
+
+func TestComparePEP440(t *testing.T) {
+	// ref: https://peps.python.org/pep-0440/#summary-of-permitted-suffixes-and-relative-ordering
+	checkOrder(t, "comparePEP440", comparePEP440, []string{
+		"1.0.dev456",
+		"1.0a1",
+		"1.0a2.dev456",
+		"1.0a12.dev456",
+		"1.0a12",
+		"1.0b1.dev456",
+		"1.0b2",
+		"1.0b2.post345.dev456",
+		"1.0b2.post345",
+		"1.0rc1.dev456",
+		"1.0rc1",
+		"1.0",
+		"1.0.post456.dev34",
+		"1.0.post456",
+		"1.1.dev1",
+		"1.1",
+		"1!0.5",
+	}, [][2]string{
+		{"1.0", "1.0.0"},
+		{"1.0", "v1.0"},
+		{"1.0rc1", "1.0c1"},
+		{"1.0rc1", "1.0-RC1"},
+		{"1.0a1", "1.0alpha1"},
+		{"1.0.post1", "1.0-1"},
+		{"1.0.post1", "1.0.rev1"},
+	})
+}
+
+func TestCompareAPKVersions(t *testing.T) {
+	// ref: https://gitlab.alpinelinux.org/alpine/apk-tools/-/blob/master/test/version.data
+	checkOrder(t, "compareAPKVersions", compareAPKVersions, []string{
+		"1.0_alpha1",
+		"1.0_alpha2",
+		"1.0_beta",
+		"1.0_pre1",
+		"1.0_rc1",
+		"1.0",
+		"1.0-r1",
+		"1.0-r2",
+		"1.0_cvs",
+		"1.0_git20200101",
+		"1.0_p1",
+		"1.0_p1-r1",
+		"1.0a",
+		"1.0.1_rc1",
+		"1.0.1",
+		"1.2",
+		"1.10",
+	}, [][2]string{
+		{"1.0", "1.0-r0"},
+	})
+}
+
+func TestCompareSemver(t *testing.T) {
+	// ref: https://semver.org/#spec-item-11
+	checkOrder(t, "compareSemver", compareSemver, []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.1",
+		"1.2.0",
+		"1.10.0",
+	}, [][2]string{
+		{"1.0.0", "v1.0.0"},
+		{"1.0.0+build.1", "1.0.0"},
+	})
+}
+
+func TestInRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   []map[string]string
+		version  string
+		affected bool
+		fixed    string
+	}{
+		{"before fix", []map[string]string{{"introduced": "0"}, {"fixed": "1.2"}}, "1.1", true, "1.2"},
+		{"fixed", []map[string]string{{"introduced": "0"}, {"fixed": "1.2"}}, "1.2", false, ""},
+		{"pre-release of fix", []map[string]string{{"introduced": "0"}, {"fixed": "1.2"}}, "1.2rc1", true, "1.2"},
+		{"before introduced", []map[string]string{{"introduced": "1.0"}, {"fixed": "1.2"}}, "0.9", false, ""},
+		{"first range", []map[string]string{{"introduced": "1.0"}, {"fixed": "1.1"}, {"introduced": "2.0"}, {"fixed": "2.3"}}, "1.0.5", true, "1.1"},
+		{"between ranges", []map[string]string{{"introduced": "1.0"}, {"fixed": "1.1"}, {"introduced": "2.0"}, {"fixed": "2.3"}}, "1.5", false, ""},
+		{"second range", []map[string]string{{"introduced": "1.0"}, {"fixed": "1.1"}, {"introduced": "2.0"}, {"fixed": "2.3"}}, "2.1", true, "2.3"},
+		{"last affected", []map[string]string{{"introduced": "1.0"}, {"last_affected": "1.4"}}, "1.4", true, ""},
+		{"after last affected", []map[string]string{{"introduced": "1.0"}, {"last_affected": "1.4"}}, "1.4.1", false, ""},
+		{"unfixed", []map[string]string{{"introduced": "0"}}, "9.9", true, ""},
+	}
+	for _, test := range tests {
+		affected, fixed := inRange(test.version, test.events, comparePEP440)
+		if affected != test.affected || fixed != test.fixed {
+			t.Errorf("%s: inRange(%s) = %t, %q, want %t, %q", test.name, test.version, affected, fixed, test.affected, test.fixed)
+		}
+	}
+}
+
+func TestCVSS3BaseScore(t *testing.T) {
+	// scores of the FIRST CVSS v3.1 calculator
+	tests := []struct {
+		vector string
+		score  float64
+	}{
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H", 9.8},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:C/C:H/I:H/A:H", 10.0},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:R/S:C/C:L/I:L/A:N", 6.1},
+		{"CVSS:3.1/AV:L/AC:L/PR:L/UI:N/S:U/C:H/I:H/A:H", 7.8},
+		{"CVSS:3.1/AV:N/AC:H/PR:N/UI:N/S:U/C:H/I:N/A:N", 5.9},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:H", 7.5},
+		{"CVSS:3.0/AV:N/AC:L/PR:L/UI:N/S:C/C:L/I:L/A:N", 6.4},
+		{"CVSS:3.1/AV:N/AC:L/PR:H/UI:N/S:C/C:H/I:H/A:H", 9.1},
+		{"CVSS:3.1/AV:P/AC:H/PR:H/UI:R/S:U/C:L/I:N/A:N", 1.6},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:N", 0},
+	}
+	for _, test := range tests {
+		score, err := cvss3BaseScore(test.vector)
+		if err != nil {
+			t.Errorf("%s: %v", test.vector, err)
+			continue
+		}
+		if score != test.score {
+			t.Errorf("%s: score = %.1f, want %.1f", test.vector, score, test.score)
+		}
+	}
+
+	for _, vector := range []string{
+		"AV:N/AC:L/Au:N/C:P/I:P/A:P",
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H",
+		"CVSS:3.1/AV:X/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H",
+	} {
+		if _, err := cvss3BaseScore(vector); err == nil {
+			t.Errorf("%s: no error for an invalid vector", vector)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Sources of a detected base image.
+const (
+	BaseSourceLayers  = "layers"
+	BaseSourceHistory = "history"
+)
+
+// debianEOL is the end of the long term support of Debian releases by VERSION_ID.
+// ref: https://wiki.debian.org/LTS
+var debianEOL = map[string]string{
+	"7":  "2018-05-31",
+	"8":  "2020-06-30",
+	"9":  "2022-06-30",
+	"10": "2024-06-30",
+	"11": "2026-08-31",
+	"12": "2028-06-30",
+	"13": "2030-06-30",
+}
+
+var debianCodenames = map[string]string{
+	"wheezy":   "7",
+	"jessie":   "8",
+	"stretch":  "9",
+	"buster":   "10",
+	"bullseye": "11",
+	"bookworm": "12",
+	"trixie":   "13",
+}
+
+// alpineEOL is the end of support of Alpine branches.
+// ref: https://alpinelinux.org/releases/
+var alpineEOL = map[string]string{
+	"3.5":  "2018-11-01",
+	"3.6":  "2019-05-01",
+	"3.7":  "2019-11-01",
+	"3.8":  "2020-05-01",
+	"3.9":  "2021-01-01",
+	"3.10": "2021-05-01",
+	"3.11": "2021-11-01",
+	"3.12": "2022-05-01",
+	"3.13": "2022-11-01",
+	"3.14": "2023-05-01",
+	"3.15": "2023-11-01",
+	"3.16": "2024-05-23",
+	"3.17": "2024-11-22",
+	"3.18": "2025-05-09",
+	"3.19": "2025-11-01",
+	"3.20": "2026-04-01",
+	"3.21": "2026-11-01",
+	"3.22": "2027-05-01",
+	"3.23": "2027-11-01",
+}
+
+var (
+	alpineRootfsRE = regexp.MustCompile(`alpine-minirootfs-(\d+\.\d+)(?:\.\d+)?`)
+	debianRootfsRE = regexp.MustCompile(`debian\.sh[^\n]*'(` + strings.Join(codenames(), "|") + `)'`)
+)
+
+func codenames() []string {
+	var names []string
+	for name := range debianCodenames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BaseImage is the image the layers of another image start with.
+type BaseImage struct {
+	Image  string `json:"image"`
+	Digest string `json:"digest,omitempty"`
+	// Layers is the number of layers shared with the base image.
+	Layers int    `json:"layers,omitempty"`
+	Source string `json:"source"`
+}
+
+// ImageOrigin is the OS distribution and base image of an image.
+type ImageOrigin struct {
+	Image     string     `json:"image"`
+	Digest    string     `json:"digest,omitempty"`
+	OS        *OSRelease `json:"os,omitempty"`
+	Release   string     `json:"release,omitempty"`
+	BaseImage *BaseImage `json:"baseImage,omitempty"`
+	EOL       bool       `json:"eol"`
+	EOLDate   string     `json:"eolDate,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// knownBase is a configured base image resolved to its layers.
+type knownBase struct {
+	image  string
+	digest string
+	layers []digest.Digest
+}
+
+// resolveBaseImages pulls the configured base images. Manifest lists and image indexes resolve
+// to -platform, so only images of that platform can be matched.
+func resolveBaseImages(images []string, pullSecrets []core.Secret) []knownBase {
+	var bases []knownBase
+	for _, img := range images {
+		result, err := PullImage(img, pullSecrets)
+		if err != nil {
+			glog.Warningf("Base image %s: %s", img, ClassifyError(err, result.MediaType).Error())
+			continue
+		}
+		bases = append(bases, knownBase{image: img, digest: result.Digest, layers: layerDigests(result.Manifest)})
+	}
+	return bases
+}
+
+// matchBaseImage returns the known base image sharing the most leading layers with layers.
+func matchBaseImage(layers []digest.Digest, bases []knownBase) *BaseImage {
+	var best *BaseImage
+	for _, b := range bases {
+		if len(b.layers) == 0 || len(b.layers) > len(layers) || best != nil && len(b.layers) <= best.Layers {
+			continue
+		}
+		match := true
+		for i, d := range b.layers {
+			if layers[i] != d {
+				match = false
+				break
+			}
+		}
+		if match {
+			best = &BaseImage{Image: b.image, Digest: b.digest, Layers: len(b.layers), Source: BaseSourceLayers}
+		}
+	}
+	return best
+}
+
+// historyRelease guesses the distribution an image was built from with the rootfs step of the
+// official Debian and Alpine images in its config history.
+func historyRelease(cfg *ImageConfig) *OSRelease {
+	for _, h := range cfg.History {
+		if m := alpineRootfsRE.FindStringSubmatch(h.CreatedBy); m != nil {
+			return &OSRelease{ID: "alpine", VersionID: m[1]}
+		}
+		if m := debianRootfsRE.FindStringSubmatch(h.CreatedBy); m != nil {
+			return &OSRelease{ID: "debian", VersionID: debianCodenames[m[1]], VersionCodename: m[1]}
+		}
+	}
+	return nil
+}
+
+// releaseEOL returns the end of support date of Debian and Alpine releases.
+func releaseEOL(rel *OSRelease) (time.Time, bool) {
+	var date string
+	switch rel.ID {
+	case "debian":
+		v := rel.VersionID
+		if v == "" {
+			v = debianCodenames[rel.VersionCodename]
+		}
+		if n, err := strconv.Atoi(v); err == nil && n < 7 {
+			return time.Time{}, true
+		}
+		date = debianEOL[v]
+	case "alpine":
+		parts := strings.SplitN(rel.VersionID, ".", 3)
+		if len(parts) < 2 {
+			return time.Time{}, false
+		}
+		minor, err := strconv.Atoi(parts[1])
+		if parts[0] == "3" && err == nil && minor < 5 {
+			return time.Time{}, true
+		}
+		date = alpineEOL[parts[0]+"."+parts[1]]
+	}
+	if date == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("2006-01-02", date)
+	return t, err == nil
+}
+
+// DetectOrigin detects the OS distribution of a pulled image from its os-release file, falling
+// back to its config history, and its base image among the known base images.
+func DetectOrigin(result *PullResult, bases []knownBase, now time.Time) (*ImageOrigin, error) {
+	o := &ImageOrigin{Image: result.Image, Digest: result.Digest}
+	files, _, err := collectFiles(result, isOSRelease, func(string) bool { return false })
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		if data, ok := files[p]; ok {
+			o.OS = parseOSRelease(data)
+			break
+		}
+	}
+
+	cfg, err := FetchConfig(result)
+	if err != nil {
+		return nil, err
+	}
+	fromHistory := historyRelease(cfg)
+	if o.OS == nil {
+		o.OS = fromHistory
+	}
+	if o.BaseImage = matchBaseImage(layerDigests(result.Manifest), bases); o.BaseImage == nil && fromHistory != nil {
+		tag := fromHistory.VersionID
+		if fromHistory.VersionCodename != "" {
+			tag = fromHistory.VersionCodename
+		}
+		o.BaseImage = &BaseImage{Image: fromHistory.ID + ":" + tag, Source: BaseSourceHistory}
+	}
+
+	if o.OS != nil {
+		o.Release = strings.TrimSpace(o.OS.ID + " " + o.OS.VersionID)
+		if eol, ok := releaseEOL(o.OS); ok {
+			o.EOL = !now.Before(eol)
+			if !eol.IsZero() {
+				o.EOLDate = eol.Format("2006-01-02")
+			}
+		}
+	}
+	return o, nil
+}
+
+// WorkloadOrigin is the origin of the image of a container of a workload.
+type WorkloadOrigin struct {
+	Namespace string `json:"namespace"`
+	Workload  string `json:"workload"`
+	Container string `json:"container"`
+	Image     string `json:"image"`
+	Release   string `json:"release,omitempty"`
+	EOL       bool   `json:"eol"`
+}
+
+// ReleaseUsage counts the images and workloads using an OS release.
+type ReleaseUsage struct {
+	Release   string `json:"release"`
+	EOL       bool   `json:"eol"`
+	EOLDate   string `json:"eolDate,omitempty"`
+	Images    int    `json:"images"`
+	Workloads int    `json:"workloads"`
+}
+
+// OriginReport is the outcome of the base command.
+type OriginReport struct {
+	Images    []*ImageOrigin   `json:"images"`
+	Workloads []WorkloadOrigin `json:"workloads,omitempty"`
+	Releases  []ReleaseUsage   `json:"releases"`
+}
+
+// podWorkload names the controller owning a Pod, or the Pod itself.
+func podWorkload(pod *core.Pod) string {
+	if ref := metav1.GetControllerOf(pod); ref != nil {
+		return ref.Kind + "/" + ref.Name
+	}
+	return "Pod/" + pod.Name
+}
+
+// runBase reports the OS release and base image of img, or of the images given with -images or
+// -images-file, or else of the images used by Pods, along with every workload on an EOL release.
+func runBase(img string, baseImages []string, opts *WatchOptions, kubeClient func() kubernetes.Interface, pullSecrets func() []core.Secret, namespace, output string) {
+	bases := resolveBaseImages(baseImages, pullSecrets())
+	now := time.Now()
+
+	report := &OriginReport{}
+	origins := map[string]*ImageOrigin{}
+	detect := func(img string, secrets []core.Secret, names []string) *ImageOrigin {
+		key := imageCheckKey(img, names)
+		if o, ok := origins[key]; ok {
+			return o
+		}
+		result, err := PullImage(img, secrets)
+		var o *ImageOrigin
+		if err == nil {
+			o, err = DetectOrigin(result, bases, now)
+		}
+		if err != nil {
+			o = &ImageOrigin{Image: img, Error: ClassifyError(err, result.MediaType).Error()}
+		}
+		origins[key] = o
+		report.Images = append(report.Images, o)
+		return o
+	}
+
+	workloads := map[string]map[string]bool{}
+	switch {
+	case img != "":
+		detect(img, pullSecrets(), nil)
+	case len(opts.Images) > 0 || opts.ImagesFile != "":
+		images, err := opts.images()
+		if err != nil {
+			glog.Fatalln(err)
+		}
+		secrets := pullSecrets()
+		for _, img := range images {
+			detect(img, secrets, nil)
+		}
+	default:
+		kc := kubeClient()
+		pods, err := kc.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+		if err != nil {
+			glog.Fatalln(err)
+		}
+		seen := map[string]bool{}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			secrets, names := podPullSecrets(kc, pod)
+			workload := podWorkload(pod)
+			containers := append(append([]core.Container(nil), pod.Spec.InitContainers...), pod.Spec.Containers...)
+			for _, c := range containers {
+				o := detect(c.Image, secrets, names)
+				key := pod.Namespace + "/" + workload + "/" + c.Name
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				report.Workloads = append(report.Workloads, WorkloadOrigin{
+					Namespace: pod.Namespace,
+					Workload:  workload,
+					Container: c.Name,
+					Image:     c.Image,
+					Release:   o.Release,
+					EOL:       o.EOL,
+				})
+				if o.Release != "" {
+					if workloads[o.Release] == nil {
+						workloads[o.Release] = map[string]bool{}
+					}
+					workloads[o.Release][pod.Namespace+"/"+workload] = true
+				}
+			}
+		}
+	}
+
+	usage := map[string]*ReleaseUsage{}
+	counted := map[string]bool{}
+	for _, o := range report.Images {
+		// an image checked with several sets of pull secrets is counted once
+		if o.Release == "" || counted[o.Image] {
+			continue
+		}
+		counted[o.Image] = true
+		u, ok := usage[o.Release]
+		if !ok {
+			u = &ReleaseUsage{Release: o.Release, EOL: o.EOL, EOLDate: o.EOLDate, Workloads: len(workloads[o.Release])}
+			usage[o.Release] = u
+		}
+		u.Images++
+	}
+	for _, u := range usage {
+		report.Releases = append(report.Releases, *u)
+	}
+	sort.Slice(report.Releases, func(i, j int) bool {
+		a, b := report.Releases[i], report.Releases[j]
+		if a.EOL != b.EOL {
+			return a.EOL
+		}
+		return a.Release < b.Release
+	})
+
+	if output == "json" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	eol := func(o bool, date string) string {
+		switch {
+		case o:
+			return "yes"
+		case date != "":
+			return "no (" + date + ")"
+		}
+		return "-"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tOS\tBASE IMAGE\tEOL\tERROR")
+	for _, o := range report.Images {
+		osName := "-"
+		if o.OS != nil {
+			osName = orDash(o.OS.PrettyName)
+			if osName == "-" {
+				osName = orDash(o.Release)
+			}
+		}
+		base := "-"
+		if o.BaseImage != nil {
+			base = o.BaseImage.Image + " (" + o.BaseImage.Source + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", o.Image, osName, base, eol(o.EOL, o.EOLDate), o.Error)
+	}
+	w.Flush()
+
+	if len(report.Releases) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "RELEASE\tEOL\tIMAGES\tWORKLOADS")
+		for _, u := range report.Releases {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", u.Release, eol(u.EOL, u.EOLDate), u.Images, u.Workloads)
+		}
+		w.Flush()
+	}
+
+	var onEOL []WorkloadOrigin
+	for _, wo := range report.Workloads {
+		if wo.EOL {
+			onEOL = append(onEOL, wo)
+		}
+	}
+	if len(onEOL) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAMESPACE\tWORKLOAD\tCONTAINER\tIMAGE\tEOL RELEASE")
+		for _, wo := range onEOL {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", wo.Namespace, wo.Workload, wo.Container, wo.Image, wo.Release)
+		}
+		w.Flush()
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	reg "github.com/appscode/docker-registry-client/registry"
+	manifestV1 "github.com/docker/distribution/manifest/schema1"
+	manifestV2 "github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxConfigSize bounds the image config blobs read into memory.
+const maxConfigSize = 8 << 20
+
+// ImageConfig is the image config blob referenced by a schema2 or OCI manifest. Schema1 manifests
+// carry the same fields in their v1 compatibility history.
+type ImageConfig struct {
+	ocispec.Image
+	Variant string `json:"variant,omitempty"`
+}
+
+// Platform returns the platform of the image in os/arch[/variant] form.
+func (c *ImageConfig) Platform() string {
+	p := c.OS + "/" + c.Architecture
+	if c.Variant != "" {
+		p += "/" + c.Variant
+	}
+	return p
+}
+
+// client returns a registry client authenticated with the credentials the manifest was pulled with.
+func (r *PullResult) client() (*reg.Registry, error) {
+	if r.auth == nil {
+		return nil, fmt.Errorf("image %q was not pulled", r.Image)
+	}
+	return NewRegistry(r.auth, &r.Trace, RepositoryScope(r.Repository, "pull"))
+}
+
+// FetchConfig returns the config of a pulled image. Schema1 images carry it in their v1 compatibility history.
+func FetchConfig(result *PullResult) (*ImageConfig, error) {
+	var cfg ImageConfig
+	switch mf := result.Manifest.(type) {
+	case *manifestV2.DeserializedManifest:
+		hub, err := result.client()
+		if err != nil {
+			return nil, err
+		}
+		data, err := fetchBlob(hub, result.Repository, mf.Config.Digest, maxConfigSize)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid image config %s: %v", mf.Config.Digest, err)
+		}
+	case *manifestV1.SignedManifest:
+		if len(mf.History) == 0 {
+			return nil, fmt.Errorf("schema1 manifest of %q has no history", result.Image)
+		}
+		if err := json.Unmarshal([]byte(mf.History[0].V1Compatibility), &cfg); err != nil {
+			return nil, fmt.Errorf("invalid v1 compatibility history of %q: %v", result.Image, err)
+		}
+		if cfg.Architecture == "" {
+			cfg.Architecture = mf.Architecture
+		}
+		history, err := v1History(mf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid v1 compatibility history of %q: %v", result.Image, err)
+		}
+		cfg.History = history
+	default:
+		return nil, fmt.Errorf("image %q has no manifest", result.Image)
+	}
+	return &cfg, nil
+}
+
+// v1Compatibility holds the fields of a schema1 history entry that make up the layer history.
+type v1Compatibility struct {
+	Created         *time.Time `json:"created,omitempty"`
+	Author          string     `json:"author,omitempty"`
+	Comment         string     `json:"comment,omitempty"`
+	ThrowAway       bool       `json:"throwaway,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd,omitempty"`
+	} `json:"container_config,omitempty"`
+}
+
+// v1History converts the history of a schema1 manifest, which lists the top most layer first, to the
+// config history format, oldest first.
+func v1History(mf *manifestV1.SignedManifest) ([]ocispec.History, error) {
+	history := make([]ocispec.History, 0, len(mf.History))
+	for i := len(mf.History) - 1; i >= 0; i-- {
+		var v1 v1Compatibility
+		if err := json.Unmarshal([]byte(mf.History[i].V1Compatibility), &v1); err != nil {
+			return nil, err
+		}
+		history = append(history, ocispec.History{
+			Created:    v1.Created,
+			CreatedBy:  strings.Join(v1.ContainerConfig.Cmd, " "),
+			Author:     v1.Author,
+			Comment:    v1.Comment,
+			EmptyLayer: v1.ThrowAway,
+		})
+	}
+	return history, nil
+}
+
+// ManifestSize returns the compressed size of the config and layers of a schema2 manifest.
+// Schema1 manifests do not record sizes, so 0 is returned for them.
+func ManifestSize(mf interface{}) int64 {
+	m, ok := mf.(*manifestV2.DeserializedManifest)
+	if !ok {
+		return 0
+	}
+	size := m.Config.Size
+	for _, l := range m.Layers {
+		size += l.Size
+	}
+	return size
+}
+
+// layerDigests returns the distinct layer digests of a manifest, base layer first.
+func layerDigests(mf interface{}) []digest.Digest {
+	var digests []digest.Digest
+	seen := map[digest.Digest]bool{}
+	add := func(d digest.Digest) {
+		if !seen[d] {
+			seen[d] = true
+			digests = append(digests, d)
+		}
+	}
+	switch m := mf.(type) {
+	case *manifestV2.DeserializedManifest:
+		for _, l := range m.Layers {
+			add(l.Digest)
+		}
+	case *manifestV1.SignedManifest:
+		// schema1 lists layers top most first
+		for i := len(m.FSLayers) - 1; i >= 0; i-- {
+			add(m.FSLayers[i].BlobSum)
+		}
+	}
+	return digests
+}
+
+// PullLayers downloads every layer of a pulled image, verifying their digests, and returns the number of bytes read.
+func PullLayers(result *PullResult) (int64, error) {
+	hub, err := result.client()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, d := range layerDigests(result.Manifest) {
+		n, err := verifyBlob(hub, result.Repository, d, ioutil.Discard)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// fetchBlob reads a blob of at most limit bytes into memory, verifying its digest.
+func fetchBlob(hub *reg.Registry, repo string, d digest.Digest, limit int64) ([]byte, error) {
+	w := &limitedBuffer{limit: limit}
+	if _, err := verifyBlob(hub, repo, d, w); err != nil {
+		return nil, err
+	}
+	return w.data, nil
+}
+
+// verifyBlob copies a blob to w and checks that its content matches digest d.
+func verifyBlob(hub *reg.Registry, repo string, d digest.Digest, w io.Writer) (int64, error) {
+	if err := d.Validate(); err != nil {
+		return 0, err
+	}
+	rc, err := hub.DownloadLayer(repo, d)
+	if err != nil {
+		return 0, ClassifyError(err, "")
+	}
+	defer rc.Close()
+
+	verifier := d.Verifier()
+	n, err := io.Copy(io.MultiWriter(w, verifier), rc)
+	if err != nil {
+		return n, fmt.Errorf("failed to download blob %s: %v", d, err)
+	}
+	if !verifier.Verified() {
+		return n, fmt.Errorf("blob %s does not match its digest", d)
+	}
+	return n, nil
+}
+
+type limitedBuffer struct {
+	data  []byte
+	limit int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if int64(len(b.data)+len(p)) > b.limit {
+		return 0, fmt.Errorf("blob exceeds %d bytes", b.limit)
+	}
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
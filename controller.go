@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	apps "k8s.io/api/apps/v1"
+	batch "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	core "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcore "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/kubernetes/pkg/credentialprovider"
+)
+
+const (
+	// AnnotationLastVerified holds a JSON map from image to the digest and time it was last pulled successfully.
+	AnnotationLastVerified = "docker-image-puller.appscode.com/last-verified"
+
+	EventReasonImageNoLongerPullable = "ImageNoLongerPullable"
+	EventReasonPullSecretInvalid     = "PullSecretInvalid"
+	EventReasonImageCheckFailed      = "ImageCheckFailed"
+	EventReasonImageTagDrifted       = "ImageTagDrifted"
+
+	controllerAgentName = "docker-image-puller"
+)
+
+// ControllerOptions configures the controller command.
+type ControllerOptions struct {
+	Namespace     string
+	CheckInterval time.Duration
+	ResyncPeriod  time.Duration
+	// ImagePullChecks enables the controller of ImagePullCheck objects.
+	ImagePullChecks bool
+	// Drift records Events for running Pods whose image tag moved to another digest.
+	Drift bool
+	// VerifiedRefresh is how old the verification time of an unchanged digest may get before
+	// AnnotationLastVerified is patched again.
+	VerifiedRefresh time.Duration
+}
+
+func NewControllerOptions() *ControllerOptions {
+	return &ControllerOptions{
+		CheckInterval:   30 * time.Minute,
+		ResyncPeriod:    10 * time.Minute,
+		ImagePullChecks: true,
+		VerifiedRefresh: 24 * time.Hour,
+	}
+}
+
+func (o *ControllerOptions) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Namespace, "namespace", o.Namespace, "Namespace watched by the controller, drift and size commands, all namespaces if empty")
+	fs.DurationVar(&o.CheckInterval, "check-interval", o.CheckInterval, "Interval between image checks of the controller command")
+	fs.DurationVar(&o.ResyncPeriod, "resync-period", o.ResyncPeriod, "Resync period of the controller informers")
+	fs.BoolVar(&o.ImagePullChecks, "image-pull-checks", o.ImagePullChecks, "Run ImagePullCheck objects in the controller command, requires the ImagePullCheck CRD")
+	fs.DurationVar(&o.VerifiedRefresh, "verified-refresh", o.VerifiedRefresh, "Refresh the verification time in the last-verified annotation of images whose digest did not change after this long")
+	fs.BoolVar(&o.Drift, "drift", o.Drift, "Record ImageTagDrifted Events in the controller command for running Pods whose image tag moved to another digest")
+}
+
+// VerifiedImage is the last successful check of an image, stored in AnnotationLastVerified.
+type VerifiedImage struct {
+	Digest     string      `json:"digest,omitempty"`
+	VerifiedAt metav1.Time `json:"verifiedAt"`
+}
+
+// ImageHealthController periodically checks that the images of Pods and workload controllers can
+// still be pulled. Failures are recorded as Warning Events on the owning object, successes in the
+// AnnotationLastVerified annotation.
+type ImageHealthController struct {
+	kc       kubernetes.Interface
+	options  *ControllerOptions
+	factory  informers.SharedInformerFactory
+	recorder record.EventRecorder
+
+	podLister            corelisters.PodLister
+	secretLister         corelisters.SecretLister
+	serviceAccountLister corelisters.ServiceAccountLister
+	informers            []cache.SharedIndexInformer
+	synced               []cache.InformerSynced
+}
+
+func NewImageHealthController(kc kubernetes.Interface, factory informers.SharedInformerFactory, recorder record.EventRecorder, options *ControllerOptions) *ImageHealthController {
+	c := &ImageHealthController{
+		kc:                   kc,
+		options:              options,
+		factory:              factory,
+		recorder:             recorder,
+		podLister:            factory.Core().V1().Pods().Lister(),
+		secretLister:         factory.Core().V1().Secrets().Lister(),
+		serviceAccountLister: factory.Core().V1().ServiceAccounts().Lister(),
+	}
+
+	// objects whose pod templates are checked
+	c.informers = []cache.SharedIndexInformer{
+		factory.Core().V1().Pods().Informer(),
+		factory.Apps().V1().Deployments().Informer(),
+		factory.Apps().V1().StatefulSets().Informer(),
+		factory.Apps().V1().DaemonSets().Informer(),
+		factory.Apps().V1().ReplicaSets().Informer(),
+		factory.Batch().V1().Jobs().Informer(),
+		factory.Batch().V1beta1().CronJobs().Informer(),
+	}
+	c.synced = []cache.InformerSynced{
+		factory.Core().V1().Secrets().Informer().HasSynced,
+		factory.Core().V1().ServiceAccounts().Informer().HasSynced,
+	}
+	for _, inf := range c.informers {
+		c.synced = append(c.synced, inf.HasSynced)
+	}
+	return c
+}
+
+// Run starts the informers and checks all images every CheckInterval until stopCh is closed.
+func (c *ImageHealthController) Run(stopCh <-chan struct{}) error {
+	c.factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.synced...) {
+		return fmt.Errorf("timed out waiting for caches to sync")
+	}
+	glog.Infof("Checking images every %s", c.options.CheckInterval)
+
+	ticker := time.NewTicker(c.options.CheckInterval)
+	defer ticker.Stop()
+	for {
+		c.checkAll()
+		select {
+		case <-stopCh:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll checks the pod templates of all top level objects. Pods and ReplicaSets created by a
+// controller are skipped, since the template of their owner is what the next reschedule uses.
+func (c *ImageHealthController) checkAll() {
+	retryOptions.ResetBudget()
+	results := imageChecks{}
+	for _, inf := range c.informers {
+		for _, item := range inf.GetStore().List() {
+			obj, ok := item.(runtime.Object)
+			if !ok {
+				continue
+			}
+			accessor, ok := item.(metav1.Object)
+			if !ok || metav1.GetControllerOf(accessor) != nil || accessor.GetDeletionTimestamp() != nil {
+				continue
+			}
+			if spec := podSpecOf(obj); spec != nil {
+				c.check(obj, accessor, spec, results)
+			}
+		}
+	}
+	if c.options.Drift {
+		c.checkDrift(results)
+	}
+}
+
+// checkDrift records an ImageTagDrifted Event on every running Pod whose image tag now resolves to a
+// different digest than the one its node pulled.
+func (c *ImageHealthController) checkDrift(results imageChecks) {
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		glog.Errorln(err)
+		return
+	}
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		pullSecrets, secretNames, _ := c.pullSecretsFor(pod.Namespace, &pod.Spec)
+		for _, d := range DetectDrift(pod, func(img string) imageCheck {
+			return results.pull(img, pullSecrets, secretNames)
+		}) {
+			if d.Drifted {
+				c.recorder.Eventf(pod, core.EventTypeWarning, EventReasonImageTagDrifted,
+					"Container %s runs %s as %s, but the tag now points to %s%s", d.Container, d.Image, d.RunningDigest, d.CurrentDigest, d.changedSuffix())
+			}
+		}
+	}
+}
+
+// imageCheck is the outcome of checking one image with one set of pull secrets.
+type imageCheck struct {
+	result *PullResult
+	err    error
+}
+
+// imageChecks caches image checks by image and pull secrets during one pass over the cluster.
+type imageChecks map[string]imageCheck
+
+// imageCheckKey identifies the check of an image with a set of pull secrets.
+func imageCheckKey(img string, secretNames []string) string {
+	return img + "|" + strings.Join(secretNames, ",")
+}
+
+func (checks imageChecks) pull(img string, pullSecrets []core.Secret, secretNames []string) imageCheck {
+	key := imageCheckKey(img, secretNames)
+	chk, ok := checks[key]
+	if !ok {
+		result, err := PullImage(img, pullSecrets)
+		recordCheck(result, err)
+		chk = imageCheck{result: result, err: err}
+		checks[key] = chk
+	}
+	return chk
+}
+
+func (c *ImageHealthController) check(obj runtime.Object, accessor metav1.Object, spec *core.PodSpec, results imageChecks) {
+	pullSecrets, secretNames, problems := c.pullSecretsFor(accessor.GetNamespace(), spec)
+	for _, msg := range problems {
+		c.recorder.Event(obj, core.EventTypeWarning, EventReasonPullSecretInvalid, msg)
+	}
+
+	verified := map[string]VerifiedImage{}
+	if v, ok := accessor.GetAnnotations()[AnnotationLastVerified]; ok {
+		if err := json.Unmarshal([]byte(v), &verified); err != nil {
+			glog.Warningf("Ignoring invalid %s annotation of %s/%s: %s", AnnotationLastVerified, accessor.GetNamespace(), accessor.GetName(), err)
+		}
+	}
+	updated := map[string]VerifiedImage{}
+
+	for _, img := range podImages(spec) {
+		chk := results.pull(img, pullSecrets, secretNames)
+
+		if chk.err == nil {
+			// keep the previous time of an unchanged digest, so that objects are not patched on every check
+			if v, ok := verified[img]; ok && v.Digest == chk.result.Digest && time.Since(v.VerifiedAt.Time) < c.options.VerifiedRefresh {
+				updated[img] = v
+			} else {
+				updated[img] = VerifiedImage{Digest: chk.result.Digest, VerifiedAt: metav1.Now()}
+			}
+			continue
+		}
+		if v, ok := verified[img]; ok {
+			updated[img] = v
+		}
+		regErr := ClassifyError(chk.err, chk.result.MediaType)
+		reason := EventReasonImageCheckFailed
+		switch {
+		case regErr.Category == CategoryNotFound:
+			reason = EventReasonImageNoLongerPullable
+		case (regErr.Category == CategoryUnauthorized || regErr.Category == CategoryDenied) && len(pullSecrets) > 0:
+			reason = EventReasonPullSecretInvalid
+		}
+		c.recorder.Eventf(obj, core.EventTypeWarning, reason, "Image %s: %s", img, regErr)
+	}
+
+	data, err := json.Marshal(updated)
+	if err != nil {
+		glog.Errorln(err)
+		return
+	}
+	if accessor.GetAnnotations()[AnnotationLastVerified] == string(data) {
+		return
+	}
+	if err := c.patchAnnotation(obj, accessor, string(data)); err != nil && !kerr.IsNotFound(err) {
+		glog.Errorf("Failed to annotate %s/%s: %s", accessor.GetNamespace(), accessor.GetName(), err)
+	}
+}
+
+// pullSecretsFor returns the pull secrets of spec and its service account, as the kubelet would use them,
+// along with messages for secrets that are missing or unusable.
+func (c *ImageHealthController) pullSecretsFor(namespace string, spec *core.PodSpec) ([]core.Secret, []string, []string) {
+	refs := append([]core.LocalObjectReference(nil), spec.ImagePullSecrets...)
+	saName := spec.ServiceAccountName
+	if saName == "" {
+		saName = "default"
+	}
+	if sa, err := c.serviceAccountLister.ServiceAccounts(namespace).Get(saName); err == nil {
+		refs = append(refs, sa.ImagePullSecrets...)
+	}
+	return resolvePullSecrets(c.secretLister, namespace, refs)
+}
+
+// resolvePullSecrets returns the usable pull secrets of refs and their namespace/names, along with
+// messages for secrets that are missing or unusable.
+func resolvePullSecrets(lister corelisters.SecretLister, namespace string, refs []core.LocalObjectReference) ([]core.Secret, []string, []string) {
+	var (
+		secrets  []core.Secret
+		names    []string
+		problems []string
+		seen     = map[string]bool{}
+	)
+	for _, ref := range refs {
+		if ref.Name == "" || seen[ref.Name] {
+			continue
+		}
+		seen[ref.Name] = true
+
+		sec, err := lister.Secrets(namespace).Get(ref.Name)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Pull secret %s/%s: %s", namespace, ref.Name, err))
+			continue
+		}
+		if sec.Type != core.SecretTypeDockerConfigJson && sec.Type != core.SecretTypeDockercfg {
+			problems = append(problems, fmt.Sprintf("Pull secret %s/%s has type %s", namespace, ref.Name, sec.Type))
+			continue
+		}
+		if _, err := credentialprovider.MakeDockerKeyring([]core.Secret{*sec}, &credentialprovider.BasicDockerKeyring{}); err != nil {
+			problems = append(problems, fmt.Sprintf("Pull secret %s/%s is malformed: %s", namespace, ref.Name, err))
+			continue
+		}
+		secrets = append(secrets, *sec)
+		names = append(names, namespace+"/"+ref.Name)
+	}
+	sort.Strings(names)
+	return secrets, names, problems
+}
+
+func (c *ImageHealthController) patchAnnotation(obj runtime.Object, accessor metav1.Object, value string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{AnnotationLastVerified: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	ns, name := accessor.GetNamespace(), accessor.GetName()
+	switch obj.(type) {
+	case *core.Pod:
+		_, err = c.kc.CoreV1().Pods(ns).Patch(name, types.MergePatchType, patch)
+	case *apps.Deployment:
+		_, err = c.kc.AppsV1().Deployments(ns).Patch(name, types.MergePatchType, patch)
+	case *apps.StatefulSet:
+		_, err = c.kc.AppsV1().StatefulSets(ns).Patch(name, types.MergePatchType, patch)
+	case *apps.DaemonSet:
+		_, err = c.kc.AppsV1().DaemonSets(ns).Patch(name, types.MergePatchType, patch)
+	case *apps.ReplicaSet:
+		_, err = c.kc.AppsV1().ReplicaSets(ns).Patch(name, types.MergePatchType, patch)
+	case *batch.Job:
+		_, err = c.kc.BatchV1().Jobs(ns).Patch(name, types.MergePatchType, patch)
+	case *batchv1beta1.CronJob:
+		_, err = c.kc.BatchV1beta1().CronJobs(ns).Patch(name, types.MergePatchType, patch)
+	default:
+		err = fmt.Errorf("unsupported object %T", obj)
+	}
+	return err
+}
+
+// podSpecOf returns the pod spec of a Pod or the pod template of a workload controller.
+func podSpecOf(obj runtime.Object) *core.PodSpec {
+	switch o := obj.(type) {
+	case *core.Pod:
+		return &o.Spec
+	case *apps.Deployment:
+		return &o.Spec.Template.Spec
+	case *apps.StatefulSet:
+		return &o.Spec.Template.Spec
+	case *apps.DaemonSet:
+		return &o.Spec.Template.Spec
+	case *apps.ReplicaSet:
+		return &o.Spec.Template.Spec
+	case *batch.Job:
+		return &o.Spec.Template.Spec
+	case *batchv1beta1.CronJob:
+		return &o.Spec.JobTemplate.Spec.Template.Spec
+	}
+	return nil
+}
+
+// podImages returns the distinct images of the init and regular containers of spec.
+func podImages(spec *core.PodSpec) []string {
+	var images []string
+	seen := map[string]bool{}
+	for _, containers := range [][]core.Container{spec.InitContainers, spec.Containers} {
+		for _, c := range containers {
+			if c.Image != "" && !seen[c.Image] && c.ImagePullPolicy != core.PullNever {
+				seen[c.Image] = true
+				images = append(images, c.Image)
+			}
+		}
+	}
+	return images
+}
+
+func newEventRecorder(kc kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(glog.V(4).Infof)
+	broadcaster.StartRecordingToSink(&typedcore.EventSinkImpl{Interface: kc.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, core.EventSource{Component: controllerAgentName})
+}
+
+func runController(opts *ControllerOptions, config *rest.Config) {
+	if opts.CheckInterval <= 0 {
+		glog.Fatalf("Invalid check interval %s", opts.CheckInterval)
+	}
+	kc := kubernetes.NewForConfigOrDie(config)
+	factory := informers.NewFilteredSharedInformerFactory(kc, opts.ResyncPeriod, opts.Namespace, nil)
+	recorder := newEventRecorder(kc)
+	stopCh := make(chan struct{})
+
+	health := NewImageHealthController(kc, factory, recorder, opts)
+	if opts.ImagePullChecks {
+		checks, err := NewImagePullCheckController(config, factory, recorder, opts)
+		if err != nil {
+			glog.Fatalln(err)
+		}
+		go func() {
+			if err := checks.Run(stopCh); err != nil {
+				glog.Fatalln(err)
+			}
+		}()
+	}
+	if err := health.Run(stopCh); err != nil {
+		glog.Fatalln(err)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// The CRI ImageService is served over gRPC. Neither gRPC nor the CRI API are vendored, so CRIClient
+// speaks the gRPC wire protocol over HTTP/2 itself and encodes the few protobuf messages it uses by
+// hand, with the field numbers of k8s.io/cri-api/pkg/apis/runtime/v1/api.proto. The v1alpha2 API
+// served by older runtimes uses the same messages.
+const (
+	criServiceV1       = "runtime.v1.ImageService"
+	criServiceV1alpha2 = "runtime.v1alpha2.ImageService"
+
+	grpcUnimplemented = 12
+	grpcInternal      = 13
+)
+
+// CRIImage is an image known to the container runtime.
+type CRIImage struct {
+	ID          string   `json:"id"`
+	RepoTags    []string `json:"repoTags,omitempty"`
+	RepoDigests []string `json:"repoDigests,omitempty"`
+	Size        uint64   `json:"size"`
+	Pinned      bool     `json:"pinned,omitempty"`
+}
+
+// GRPCError is a non OK status returned by a gRPC server.
+type GRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *GRPCError) Error() string {
+	return fmt.Sprintf("rpc error: code = %d desc = %s", e.Code, e.Message)
+}
+
+// CRIClient calls the ImageService of a container runtime on a unix socket.
+type CRIClient struct {
+	client  *http.Client
+	service string
+}
+
+// NewCRIClient returns a client of the runtime listening on endpoint, a unix:// URL or socket path.
+func NewCRIClient(endpoint string, timeout time.Duration) (*CRIClient, error) {
+	socket := endpoint
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "unix" {
+			return nil, fmt.Errorf("unsupported CRI endpoint %q, only unix sockets are supported", endpoint)
+		}
+		socket = u.Path
+	}
+	transport := &http2.Transport{
+		// gRPC over a unix socket is plain text HTTP/2
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.DialTimeout("unix", socket, 10*time.Second)
+		},
+	}
+	return &CRIClient{client: &http.Client{Transport: transport, Timeout: timeout}}, nil
+}
+
+// call invokes a method of the ImageService, falling back to the v1alpha2 API for runtimes that do not serve v1.
+func (c *CRIClient) call(method string, req []byte) ([]byte, error) {
+	if c.service != "" {
+		return c.invoke(c.service, method, req)
+	}
+	resp, err := c.invoke(criServiceV1, method, req)
+	if e, ok := err.(*GRPCError); ok && e.Code == grpcUnimplemented {
+		if resp, err = c.invoke(criServiceV1alpha2, method, req); err == nil {
+			c.service = criServiceV1alpha2
+		}
+		return resp, err
+	}
+	if err == nil {
+		c.service = criServiceV1
+	}
+	return resp, err
+}
+
+func (c *CRIClient) invoke(service, method string, msg []byte) ([]byte, error) {
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+
+	req, err := http.NewRequest(http.MethodPost, "http://localhost/"+service+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s/%s: unexpected HTTP status %s", service, method, resp.Status)
+	}
+
+	// servers send the status in the headers of responses without a body
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	// gRPC clients treat a response without status as an internal error
+	if status == "" {
+		return nil, &GRPCError{Code: grpcInternal, Message: fmt.Sprintf("%s/%s: response has no grpc-status", service, method)}
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return nil, &GRPCError{Code: grpcInternal, Message: fmt.Sprintf("%s/%s: invalid grpc-status %q", service, method, status)}
+	}
+	if code != 0 {
+		if m, err := url.PathUnescape(message); err == nil {
+			message = m
+		}
+		return nil, &GRPCError{Code: code, Message: message}
+	}
+
+	if len(data) < 5 {
+		return nil, fmt.Errorf("%s/%s: short gRPC response", service, method)
+	}
+	if data[0] != 0 {
+		return nil, fmt.Errorf("%s/%s: compressed gRPC responses are not supported", service, method)
+	}
+	n := binary.BigEndian.Uint32(data[1:5])
+	if int(n) > len(data)-5 {
+		return nil, fmt.Errorf("%s/%s: truncated gRPC response", service, method)
+	}
+	return data[5 : 5+n], nil
+}
+
+// ListImages returns the images present on the node.
+func (c *CRIClient) ListImages() ([]CRIImage, error) {
+	data, err := c.call("ListImages", nil)
+	if err != nil {
+		return nil, err
+	}
+	var images []CRIImage
+	err = decodeProto(data, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		img, err := decodeCRIImage(f.bytes)
+		if err == nil {
+			images = append(images, *img)
+		}
+		return err
+	})
+	return images, err
+}
+
+// ImageStatus returns the image img resolves to on the node, or nil if it is not present.
+func (c *CRIClient) ImageStatus(img string) (*CRIImage, error) {
+	var req protoMessage
+	req.message(1, imageSpec(img))
+	data, err := c.call("ImageStatus", req)
+	if err != nil {
+		return nil, err
+	}
+	var image *CRIImage
+	err = decodeProto(data, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		var err error
+		image, err = decodeCRIImage(f.bytes)
+		return err
+	})
+	return image, err
+}
+
+// PullImage pulls img on the node with auth, which may be nil, and returns the reference of the pulled image.
+func (c *CRIClient) PullImage(img string, auth *AuthConfig) (string, error) {
+	var req protoMessage
+	req.message(1, imageSpec(img))
+	if auth != nil {
+		var a protoMessage
+		a.string(1, auth.Username)
+		a.string(2, auth.Password)
+		a.string(3, auth.Auth)
+		a.string(4, strings.TrimPrefix(strings.TrimPrefix(auth.ServerAddress, "https://"), "http://"))
+		a.string(5, auth.IdentityToken)
+		a.string(6, auth.RegistryToken)
+		req.message(2, a)
+	}
+	data, err := c.call("PullImage", req)
+	if err != nil {
+		return "", err
+	}
+	var ref string
+	err = decodeProto(data, func(f protoField) error {
+		if f.num == 1 {
+			ref = string(f.bytes)
+		}
+		return nil
+	})
+	return ref, err
+}
+
+func imageSpec(img string) protoMessage {
+	var spec protoMessage
+	spec.string(1, img)
+	return spec
+}
+
+func decodeCRIImage(data []byte) (*CRIImage, error) {
+	img := &CRIImage{}
+	err := decodeProto(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			img.ID = string(f.bytes)
+		case 2:
+			img.RepoTags = append(img.RepoTags, string(f.bytes))
+		case 3:
+			img.RepoDigests = append(img.RepoDigests, string(f.bytes))
+		case 4:
+			img.Size = f.varint
+		case 8:
+			img.Pinned = f.varint != 0
+		}
+		return nil
+	})
+	return img, err
+}
+
+// protoMessage is an encoded protobuf message.
+type protoMessage []byte
+
+func (m *protoMessage) key(num, wire int) {
+	*m = appendUvarint(*m, uint64(num<<3|wire))
+}
+
+func (m *protoMessage) string(num int, s string) {
+	if s == "" {
+		return
+	}
+	m.key(num, 2)
+	*m = appendUvarint(*m, uint64(len(s)))
+	*m = append(*m, s...)
+}
+
+func (m *protoMessage) message(num int, msg protoMessage) {
+	m.key(num, 2)
+	*m = appendUvarint(*m, uint64(len(msg)))
+	*m = append(*m, msg...)
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], x)]...)
+}
+
+// protoField is a decoded protobuf field. Length delimited fields are returned in bytes, varints
+// in varint; fixed size fields are skipped.
+type protoField struct {
+	num    int
+	varint uint64
+	bytes  []byte
+}
+
+func decodeProto(data []byte, fn func(f protoField) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("invalid protobuf field key")
+		}
+		data = data[n:]
+		f := protoField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			if f.varint, n = binary.Uvarint(data); n <= 0 {
+				return fmt.Errorf("invalid protobuf varint of field %d", f.num)
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return fmt.Errorf("truncated protobuf field %d", f.num)
+			}
+			data = data[8:]
+			continue
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return fmt.Errorf("truncated protobuf field %d", f.num)
+			}
+			f.bytes = data[n : n+int(l)]
+			data = data[n+int(l):]
+		case 5:
+			if len(data) < 4 {
+				return fmt.Errorf("truncated protobuf field %d", f.num)
+			}
+			data = data[4:]
+			continue
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d of field %d", key&7, f.num)
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Golden messages, marshaled from the runtime.v1 types of k8s.io/cri-api v0.31.2. The images carry
+// fields the client does not decode (uid, username and spec) to check that they are skipped.
+const (
+	goldenListImagesResponse = "0a6d0a0a7368613235363a616161121c646f636b65722e696f2f6c6962726172792f6e67696e783a312e31331a22646f636b65722e696f2f6c6962726172792f6e67696e78407368613235363a62626220808080162a0208653a140a0a7368613235363a61616112060a01611201620a4b0a0a7368613235363a636363121972656769737472792e6b38732e696f2f70617573653a332e3912146b38732e6763722e696f2f70617573653a332e392080e01232066e6f626f64794001"
+	// ImageStatusRequest for nginx:1.13
+	goldenImageStatusRequest = "0a0c0a0a6e67696e783a312e3133"
+	// ImageStatusResponse with the nginx image of goldenListImagesResponse and verbose info
+	goldenImageStatusResponse = "0a6d0a0a7368613235363a616161121c646f636b65722e696f2f6c6962726172792f6e67696e783a312e31331a22646f636b65722e696f2f6c6962726172792f6e67696e78407368613235363a62626220808080162a0208653a140a0a7368613235363a61616112060a0161120162120a0a04696e666f12027b7d"
+	// PullImageRequest for registry.internal/team/app:1.0 with every AuthConfig field set
+	goldenPullImageRequest = "0a200a1e72656769737472792e696e7465726e616c2f7465616d2f6170703a312e3012440a047573657212067365637265741a1064584e6c636a707a5a574e795a58513d221172656769737472792e696e7465726e616c2a07726566726573683206626561726572"
+	// PullImageRequest for registry.internal/team/app:1.0 without auth
+	goldenAnonymousPullImageRequest = "0a200a1e72656769737472792e696e7465726e616c2f7465616d2f6170703a312e30"
+	// PullImageResponse with the image ref sha256:ddd
+	goldenPullImageResponse = "0a0a7368613235363a646464"
+)
+
+func golden(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// fakeImageService serves the CRI ImageService over gRPC on a unix socket. handle returns the
+// response message of a call, or a non zero gRPC status.
+type fakeImageService struct {
+	handle func(service, method string, req []byte) ([]byte, int, string)
+	// trailersOnly sends error statuses in the headers, as servers do for responses without a body.
+	trailersOnly bool
+	// noStatus sends responses without grpc-status.
+	noStatus bool
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeImageService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("Content-Type") != "application/grpc" || len(body) < 5 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	f.mu.Lock()
+	f.calls = append(f.calls, r.URL.Path)
+	f.mu.Unlock()
+
+	resp, code, msg := f.handle(parts[0], parts[1], body[5:])
+	w.Header().Set("Content-Type", "application/grpc")
+	if code != 0 && f.trailersOnly {
+		w.Header().Set("Grpc-Status", strconv.Itoa(code))
+		w.Header().Set("Grpc-Message", url.PathEscape(msg))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !f.noStatus {
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	}
+	w.WriteHeader(http.StatusOK)
+	if code == 0 {
+		frame := make([]byte, 5, 5+len(resp))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(resp)))
+		w.Write(append(frame, resp...))
+	}
+	if !f.noStatus {
+		w.Header().Set("Grpc-Status", strconv.Itoa(code))
+		w.Header().Set("Grpc-Message", url.PathEscape(msg))
+	}
+}
+
+func (f *fakeImageService) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// startFakeCRI serves f on a temporary unix socket and returns a client of it and a func stopping the server.
+func startFakeCRI(t *testing.T, f *fakeImageService) (*CRIClient, func()) {
+	dir, err := ioutil.TempDir("", "cri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "cri.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	stop := func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+	srv := &http2.Server{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.ServeConn(conn, &http2.ServeConnOpts{Handler: f})
+		}
+	}()
+
+	c, err := NewCRIClient("unix://"+socket, 5*time.Second)
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	return c, stop
+}
+
+// expectRequest fails t if req is not the golden message want.
+func expectRequest(t *testing.T, method string, req []byte, want string) {
+	if !bytes.Equal(req, golden(want)) {
+		t.Errorf("%s request = %x, want %s", method, req, want)
+	}
+}
+
+func TestCRIListImages(t *testing.T) {
+	f := &fakeImageService{handle: func(service, method string, req []byte) ([]byte, int, string) {
+		if method != "ListImages" {
+			return nil, grpcUnimplemented, "unknown method " + method
+		}
+		// ListImagesRequest without filter is empty
+		expectRequest(t, method, req, "")
+		return golden(goldenListImagesResponse), 0, ""
+	}}
+	c, stop := startFakeCRI(t, f)
+	defer stop()
+
+	got, err := c.ListImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CRIImage{
+		{ID: "sha256:aaa", RepoTags: []string{"docker.io/library/nginx:1.13"}, RepoDigests: []string{"docker.io/library/nginx@sha256:bbb"}, Size: 44 << 20},
+		{ID: "sha256:ccc", RepoTags: []string{"registry.k8s.io/pause:3.9", "k8s.gcr.io/pause:3.9"}, Size: 300 << 10, Pinned: true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d images, want %d", len(got), len(want))
+	}
+	for i, img := range want {
+		g := got[i]
+		if g.ID != img.ID || g.Size != img.Size || g.Pinned != img.Pinned ||
+			strings.Join(g.RepoTags, ",") != strings.Join(img.RepoTags, ",") ||
+			strings.Join(g.RepoDigests, ",") != strings.Join(img.RepoDigests, ",") {
+			t.Errorf("image %d = %+v, want %+v", i, g, img)
+		}
+	}
+	if calls := f.Calls(); len(calls) != 1 || calls[0] != "/"+criServiceV1+"/ListImages" {
+		t.Errorf("calls = %v", calls)
+	}
+}
+
+func TestCRIImageStatus(t *testing.T) {
+	f := &fakeImageService{handle: func(service, method string, req []byte) ([]byte, int, string) {
+		if bytes.Equal(req, golden(goldenImageStatusRequest)) {
+			return golden(goldenImageStatusResponse), 0, ""
+		}
+		// ImageStatusResponse of a missing image is empty
+		return nil, 0, ""
+	}}
+	c, stop := startFakeCRI(t, f)
+	defer stop()
+
+	img, err := c.ImageStatus("nginx:1.13")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img == nil || img.ID != "sha256:aaa" || img.Size != 44<<20 || strings.Join(img.RepoDigests, ",") != "docker.io/library/nginx@sha256:bbb" {
+		t.Errorf("ImageStatus(nginx:1.13) = %+v, want image sha256:aaa", img)
+	}
+
+	img, err = c.ImageStatus("redis:4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img != nil {
+		t.Errorf("ImageStatus(redis:4) = %+v, want nil for a missing image", img)
+	}
+}
+
+func TestCRIPullImage(t *testing.T) {
+	var want string
+	f := &fakeImageService{handle: func(service, method string, req []byte) ([]byte, int, string) {
+		expectRequest(t, method, req, want)
+		return golden(goldenPullImageResponse), 0, ""
+	}}
+	c, stop := startFakeCRI(t, f)
+	defer stop()
+
+	want = goldenPullImageRequest
+	ref, err := c.PullImage("registry.internal/team/app:1.0", &AuthConfig{
+		Username:      "user",
+		Password:      "secret",
+		Auth:          "dXNlcjpzZWNyZXQ=",
+		ServerAddress: "https://registry.internal",
+		IdentityToken: "refresh",
+		RegistryToken: "bearer",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != "sha256:ddd" {
+		t.Errorf("ref = %q, want sha256:ddd", ref)
+	}
+
+	want = goldenAnonymousPullImageRequest
+	if _, err := c.PullImage("registry.internal/team/app:1.0", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCRIFallbackToV1alpha2(t *testing.T) {
+	f := &fakeImageService{handle: func(service, method string, req []byte) ([]byte, int, string) {
+		if service == criServiceV1 {
+			return nil, grpcUnimplemented, "unknown service " + service
+		}
+		return nil, 0, ""
+	}}
+	c, stop := startFakeCRI(t, f)
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.ListImages(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		"/" + criServiceV1 + "/ListImages",
+		"/" + criServiceV1alpha2 + "/ListImages",
+		"/" + criServiceV1alpha2 + "/ListImages",
+	}
+	if calls := f.Calls(); strings.Join(calls, " ") != strings.Join(want, " ") {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestCRIErrors(t *testing.T) {
+	for _, trailersOnly := range []bool{false, true} {
+		f := &fakeImageService{
+			trailersOnly: trailersOnly,
+			handle: func(service, method string, req []byte) ([]byte, int, string) {
+				return nil, 5, "image \"redis:4\" not found"
+			},
+		}
+		c, stop := startFakeCRI(t, f)
+		defer stop()
+
+		_, err := c.PullImage("redis:4", nil)
+		e, ok := err.(*GRPCError)
+		if !ok {
+			t.Fatalf("trailersOnly=%t: err = %v, want a *GRPCError", trailersOnly, err)
+		}
+		if e.Code != 5 || e.Message != "image \"redis:4\" not found" {
+			t.Errorf("trailersOnly=%t: err = %+v", trailersOnly, e)
+		}
+		// only Unimplemented falls back to v1alpha2
+		if calls := f.Calls(); len(calls) != 1 {
+			t.Errorf("trailersOnly=%t: calls = %v", trailersOnly, calls)
+		}
+	}
+}
+
+func TestCRIMissingStatus(t *testing.T) {
+	f := &fakeImageService{
+		noStatus: true,
+		handle: func(service, method string, req []byte) ([]byte, int, string) {
+			return golden(goldenPullImageResponse), 0, ""
+		},
+	}
+	c, stop := startFakeCRI(t, f)
+	defer stop()
+
+	_, err := c.PullImage("registry.internal/team/app:1.0", nil)
+	if e, ok := err.(*GRPCError); !ok || e.Code != grpcInternal {
+		t.Errorf("err = %v, want an Internal *GRPCError for a response without grpc-status", err)
+	}
+}
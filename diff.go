@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	units "github.com/docker/go-units"
+	core "k8s.io/api/core/v1"
+)
+
+// FieldChange is a changed scalar field of two images.
+type FieldChange struct {
+	Field string `json:"field"`
+	A     string `json:"a"`
+	B     string `json:"b"`
+}
+
+// ListChange holds the items only one of two images has, e.g. env variables or labels as key=value.
+type ListChange struct {
+	Field   string   `json:"field"`
+	Removed []string `json:"removed,omitempty"`
+	Added   []string `json:"added,omitempty"`
+}
+
+// FileChanges are the differences of the filesystems of two images.
+type FileChanges struct {
+	Removed  []string `json:"removed,omitempty"`
+	Added    []string `json:"added,omitempty"`
+	Modified []string `json:"modified,omitempty"`
+}
+
+// ImageDiff compares image A with image B.
+type ImageDiff struct {
+	A      string        `json:"a"`
+	B      string        `json:"b"`
+	Fields []FieldChange `json:"fields,omitempty"`
+	Lists  []ListChange  `json:"lists,omitempty"`
+	// Platforms are the platforms of both image indexes whose manifest digest changed.
+	Platforms    []FieldChange `json:"platforms,omitempty"`
+	SharedLayers []Layer       `json:"sharedLayers,omitempty"`
+	// RemovedLayers are only in A, AddedLayers only in B.
+	RemovedLayers []Layer      `json:"removedLayers,omitempty"`
+	AddedLayers   []Layer      `json:"addedLayers,omitempty"`
+	Files         *FileChanges `json:"files,omitempty"`
+}
+
+// DiffImages compares two inspected images. If files are given for both, their filesystems are compared too.
+func DiffImages(a, b *ImageInspect, filesA, filesB map[string]*FileEntry) *ImageDiff {
+	d := &ImageDiff{A: a.Image, B: b.Image}
+
+	field := func(name, va, vb string) {
+		if va != vb {
+			d.Fields = append(d.Fields, FieldChange{Field: name, A: va, B: vb})
+		}
+	}
+	field("Digest", a.Digest, b.Digest)
+	field("MediaType", a.MediaType, b.MediaType)
+	field("IndexDigest", a.IndexDigest, b.IndexDigest)
+	field("IndexMediaType", a.IndexMediaType, b.IndexMediaType)
+	field("Platform", inspectPlatform(a), inspectPlatform(b))
+	field("Created", formatTime(a.Created), formatTime(b.Created))
+	field("Author", a.Author, b.Author)
+	field("User", a.User, b.User)
+	field("WorkingDir", a.WorkingDir, b.WorkingDir)
+	field("Entrypoint", quoteArgs(a.Entrypoint), quoteArgs(b.Entrypoint))
+	field("Cmd", quoteArgs(a.Cmd), quoteArgs(b.Cmd))
+	field("StopSignal", a.StopSignal, b.StopSignal)
+
+	list := func(name string, la, lb []string) {
+		removed, added := diffLists(la, lb)
+		if len(removed) > 0 || len(added) > 0 {
+			d.Lists = append(d.Lists, ListChange{Field: name, Removed: removed, Added: added})
+		}
+	}
+	list("Env", a.Env, b.Env)
+	list("Labels", labelList(a.Labels), labelList(b.Labels))
+	list("ExposedPorts", a.ExposedPorts, b.ExposedPorts)
+	list("Volumes", a.Volumes, b.Volumes)
+	list("Platforms", mapKeys(a.Platforms), mapKeys(b.Platforms))
+	for _, p := range mapKeys(a.Platforms) {
+		if db, ok := b.Platforms[p]; ok && a.Platforms[p] != db {
+			d.Platforms = append(d.Platforms, FieldChange{Field: p, A: a.Platforms[p], B: db})
+		}
+	}
+
+	inA := map[string]bool{}
+	for _, l := range a.Layers {
+		inA[l.Digest] = true
+	}
+	inB := map[string]bool{}
+	for _, l := range b.Layers {
+		inB[l.Digest] = true
+		if inA[l.Digest] {
+			d.SharedLayers = append(d.SharedLayers, l)
+		} else {
+			d.AddedLayers = append(d.AddedLayers, l)
+		}
+	}
+	for _, l := range a.Layers {
+		if !inB[l.Digest] {
+			d.RemovedLayers = append(d.RemovedLayers, l)
+		}
+	}
+
+	if filesA != nil && filesB != nil {
+		d.Files = diffFiles(filesA, filesB)
+	}
+	return d
+}
+
+func inspectPlatform(ins *ImageInspect) string {
+	cfg := ImageConfig{Variant: ins.Variant}
+	cfg.OS, cfg.Architecture = ins.OS, ins.Architecture
+	return cfg.Platform()
+}
+
+// diffLists returns the items only in a and those only in b, sorted.
+func diffLists(a, b []string) ([]string, []string) {
+	inA := map[string]bool{}
+	for _, s := range a {
+		inA[s] = true
+	}
+	inB := map[string]bool{}
+	for _, s := range b {
+		inB[s] = true
+	}
+	var removed, added []string
+	for s := range inA {
+		if !inB[s] {
+			removed = append(removed, s)
+		}
+	}
+	for s := range inB {
+		if !inA[s] {
+			added = append(added, s)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(added)
+	return removed, added
+}
+
+// mapKeys returns the keys of m, sorted.
+func mapKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func labelList(labels map[string]string) []string {
+	var list []string
+	for k, v := range labels {
+		list = append(list, k+"="+v)
+	}
+	return list
+}
+
+// diffFiles compares two filesystems. Files count as modified if their type, mode, size, content or link target changed.
+func diffFiles(a, b map[string]*FileEntry) *FileChanges {
+	fc := &FileChanges{}
+	for p, fa := range a {
+		fb, ok := b[p]
+		switch {
+		case !ok:
+			fc.Removed = append(fc.Removed, p)
+		case fa.Mode != fb.Mode || fa.Size != fb.Size || fa.Digest != fb.Digest || fa.Linkname != fb.Linkname:
+			fc.Modified = append(fc.Modified, p)
+		}
+	}
+	for p := range b {
+		if _, ok := a[p]; !ok {
+			fc.Added = append(fc.Added, p)
+		}
+	}
+	sort.Strings(fc.Removed)
+	sort.Strings(fc.Added)
+	sort.Strings(fc.Modified)
+	return fc
+}
+
+func runDiff(imgA, imgB string, pullSecrets []core.Secret, withFiles bool, output string) {
+	inspect := func(img string) (*ImageInspect, map[string]*FileEntry) {
+		ins, result, err := InspectImage(img, pullSecrets)
+		if err != nil {
+			regErr := ClassifyError(err, result.MediaType)
+			fmt.Fprintf(os.Stderr, "%s: %s\n", img, regErr)
+			os.Exit(regErr.ExitCode())
+		}
+		if !withFiles {
+			return ins, nil
+		}
+		files, err := ImageFiles(result)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", img, err)
+			os.Exit(1)
+		}
+		return ins, files
+	}
+	a, filesA := inspect(imgA)
+	b, filesB := inspect(imgB)
+	d := DiffImages(a, b, filesA, filesB)
+
+	if output == "json" {
+		data, _ := json.MarshalIndent(d, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	fmt.Println("---", d.A)
+	fmt.Println("+++", d.B)
+	for _, f := range d.Fields {
+		fmt.Printf("%s:\n  - %s\n  + %s\n", f.Field, orDash(f.A), orDash(f.B))
+	}
+	for _, l := range d.Lists {
+		fmt.Printf("%s:\n", l.Field)
+		for _, s := range l.Removed {
+			fmt.Println("  -", s)
+		}
+		for _, s := range l.Added {
+			fmt.Println("  +", s)
+		}
+	}
+	if len(d.Platforms) > 0 {
+		fmt.Println("Platform manifests:")
+		for _, p := range d.Platforms {
+			fmt.Printf("  %s:\n    - %s\n    + %s\n", p.Field, p.A, p.B)
+		}
+	}
+	fmt.Printf("Layers: %d shared, %d removed, %d added\n", len(d.SharedLayers), len(d.RemovedLayers), len(d.AddedLayers))
+	for _, l := range d.RemovedLayers {
+		fmt.Printf("  - %s %s\n", l.Digest, layerSize(l))
+	}
+	for _, l := range d.AddedLayers {
+		fmt.Printf("  + %s %s\n", l.Digest, layerSize(l))
+	}
+	if d.Files != nil {
+		fmt.Printf("Files: %d removed, %d added, %d modified\n", len(d.Files.Removed), len(d.Files.Added), len(d.Files.Modified))
+		for _, p := range d.Files.Removed {
+			fmt.Println("  -", p)
+		}
+		for _, p := range d.Files.Added {
+			fmt.Println("  +", p)
+		}
+		for _, p := range d.Files.Modified {
+			fmt.Println("  M", p)
+		}
+	}
+}
+
+func layerSize(l Layer) string {
+	if l.Size == 0 {
+		return ""
+	}
+	return units.HumanSize(float64(l.Size))
+}
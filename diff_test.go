@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffFiles(t *testing.T) {
+	a := map[string]*FileEntry{
+		"/etc/os-release": {Mode: 0644, Size: 10, Digest: "sha256:aaa"},
+		"/etc/version":    {Mode: 0644, Size: 6, Digest: "sha256:bbb"},
+		"/bin/sh":         {Mode: 0777, Linkname: "/bin/busybox"},
+		"/usr/bin/old":    {Mode: 0755, Size: 1, Digest: "sha256:ccc"},
+		"/etc/passwd":     {Mode: 0644, Size: 5, Digest: "sha256:ddd"},
+	}
+	b := map[string]*FileEntry{
+		"/etc/os-release": {Mode: 0644, Size: 10, Digest: "sha256:aaa"},
+		// rewritten with the same size
+		"/etc/version": {Mode: 0644, Size: 6, Digest: "sha256:eee"},
+		"/bin/sh":      {Mode: 0777, Linkname: "/bin/bash"},
+		"/usr/bin/new": {Mode: 0755, Size: 1, Digest: "sha256:ccc"},
+		"/etc/passwd":  {Mode: 0600, Size: 5, Digest: "sha256:ddd"},
+	}
+	fc := diffFiles(a, b)
+	for _, c := range []struct {
+		name      string
+		got, want []string
+	}{
+		{"removed", fc.Removed, []string{"/usr/bin/old"}},
+		{"added", fc.Added, []string{"/usr/bin/new"}},
+		{"modified", fc.Modified, []string{"/bin/sh", "/etc/passwd", "/etc/version"}},
+	} {
+		if strings.Join(c.got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	manifestV2 "github.com/docker/distribution/manifest/schema2"
+	units "github.com/docker/go-units"
+	"github.com/golang/glog"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Drift compares the digest a running container was started from with the digest its image resolves to now.
+type Drift struct {
+	Namespace     string `json:"namespace"`
+	Pod           string `json:"pod"`
+	Container     string `json:"container"`
+	Image         string `json:"image"`
+	RunningDigest string `json:"runningDigest,omitempty"`
+	CurrentDigest string `json:"currentDigest,omitempty"`
+	Drifted       bool   `json:"drifted"`
+	// Changed is when the image the tag points to now was created, the latest the tag can have moved.
+	Changed *time.Time `json:"changed,omitempty"`
+	// StartedAt is when the container started running the old digest.
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+func (d *Drift) changedSuffix() string {
+	if d.Changed == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (created %s ago)", units.HumanDuration(time.Since(*d.Changed)))
+}
+
+// runningDigest parses the imageID the kubelet reports for a container. Docker reports either a
+// repo digest, "docker-pullable://repo@sha256:...", or only the image ID, "docker://sha256:...",
+// which is the digest of the image config rather than of the manifest.
+func runningDigest(imageID string) (string, bool) {
+	id := imageID
+	if i := strings.Index(id, "://"); i >= 0 {
+		id = id[i+3:]
+	}
+	if i := strings.LastIndex(id, "@"); i >= 0 {
+		return id[i+1:], false
+	}
+	if strings.HasPrefix(id, "sha256:") {
+		return id, true
+	}
+	return "", false
+}
+
+// DetectDrift compares the running containers of pod with what their images resolve to now.
+// Containers started from an image pinned by digest cannot drift and are skipped.
+func DetectDrift(pod *core.Pod, check func(img string) imageCheck) []Drift {
+	statuses := map[string]core.ContainerStatus{}
+	for _, s := range pod.Status.ContainerStatuses {
+		statuses[s.Name] = s
+	}
+
+	var drifts []Drift
+	for _, c := range pod.Spec.Containers {
+		status, ok := statuses[c.Name]
+		if !ok || status.ImageID == "" || strings.Contains(c.Image, "@") {
+			continue
+		}
+		d := Drift{
+			Namespace: pod.Namespace,
+			Pod:       pod.Name,
+			Container: c.Name,
+			Image:     c.Image,
+		}
+		if status.State.Running != nil {
+			started := status.State.Running.StartedAt.Time
+			d.StartedAt = &started
+		}
+		running, isConfig := runningDigest(status.ImageID)
+		if running == "" {
+			d.Error = fmt.Sprintf("unrecognized image ID %q", status.ImageID)
+			drifts = append(drifts, d)
+			continue
+		}
+		d.RunningDigest = running
+
+		chk := check(c.Image)
+		if chk.err != nil {
+			d.Error = ClassifyError(chk.err, chk.result.MediaType).Error()
+			drifts = append(drifts, d)
+			continue
+		}
+		// nodes report the digest of the image index of multi-platform images, unless they were pulled by
+		// the digest of a platform manifest
+		d.CurrentDigest = chk.result.Digest
+		if chk.result.IndexDigest != "" && running != chk.result.Digest {
+			d.CurrentDigest = chk.result.IndexDigest
+		}
+		if isConfig {
+			mf, ok := chk.result.Manifest.(*manifestV2.DeserializedManifest)
+			if !ok {
+				d.Error = "node reports an image ID, which can only be compared with schema2 images"
+				drifts = append(drifts, d)
+				continue
+			}
+			d.CurrentDigest = mf.Config.Digest.String()
+		}
+		if d.CurrentDigest == "" {
+			d.Error = "registry did not report a digest"
+			drifts = append(drifts, d)
+			continue
+		}
+
+		d.Drifted = d.CurrentDigest != d.RunningDigest
+		if d.Drifted {
+			if cfg, err := FetchConfig(chk.result); err != nil {
+				glog.V(2).Infof("Failed to fetch config of %s: %s", c.Image, err)
+			} else {
+				d.Changed = cfg.Created
+			}
+		}
+		drifts = append(drifts, d)
+	}
+	return drifts
+}
+
+// podPullSecrets returns the pull secrets of a Pod, which include those of its service account.
+func podPullSecrets(kc kubernetes.Interface, pod *core.Pod) ([]core.Secret, []string) {
+	var (
+		secrets []core.Secret
+		names   []string
+	)
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		sec, err := kc.CoreV1().Secrets(pod.Namespace).Get(ref.Name, metav1.GetOptions{})
+		if err != nil {
+			glog.Warningf("Pull secret %s/%s of pod %s: %s", pod.Namespace, ref.Name, pod.Name, err)
+			continue
+		}
+		secrets = append(secrets, *sec)
+		names = append(names, pod.Namespace+"/"+ref.Name)
+	}
+	sort.Strings(names)
+	return secrets, names
+}
+
+func runDrift(kc kubernetes.Interface, namespace string, output string) {
+	pods, err := kc.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		glog.Fatalln(err)
+	}
+
+	results := imageChecks{}
+	var drifts []Drift
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase != core.PodRunning {
+			continue
+		}
+		pullSecrets, secretNames := podPullSecrets(kc, pod)
+		for _, d := range DetectDrift(pod, func(img string) imageCheck {
+			return results.pull(img, pullSecrets, secretNames)
+		}) {
+			if d.Drifted || d.Error != "" {
+				drifts = append(drifts, d)
+			}
+		}
+	}
+
+	if output == "json" {
+		data, _ := json.MarshalIndent(drifts, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tPOD\tCONTAINER\tIMAGE\tRUNNING\tCURRENT\tCHANGED\tRUNNING-SINCE\tERROR")
+	for _, d := range drifts {
+		changed, since := "-", "-"
+		if d.Changed != nil {
+			changed = units.HumanDuration(time.Since(*d.Changed)) + " ago"
+		}
+		if d.StartedAt != nil {
+			since = units.HumanDuration(time.Since(*d.StartedAt))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", d.Namespace, d.Pod, d.Container, d.Image,
+			orDash(shortDigest(d.RunningDigest)), orDash(shortDigest(d.CurrentDigest)), changed, since, d.Error)
+	}
+	w.Flush()
+}
+
+// shortDigest abbreviates a digest for tables, like docker does for image IDs.
+func shortDigest(d string) string {
+	if i := strings.Index(d, ":"); i >= 0 && len(d) > i+13 {
+		return d[:i+13]
+	}
+	return d
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	reg "github.com/appscode/docker-registry-client/registry"
+	manifestV1 "github.com/docker/distribution/manifest/schema1"
+	manifestV2 "github.com/docker/distribution/manifest/schema2"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrorCategory classifies why talking to a registry failed.
+type ErrorCategory string
+
+const (
+	CategoryNotFound             ErrorCategory = "NotFound"
+	CategoryUnauthorized         ErrorCategory = "Unauthorized"
+	CategoryDenied               ErrorCategory = "Denied"
+	CategoryRateLimited          ErrorCategory = "RateLimited"
+	CategoryTLS                  ErrorCategory = "TLS"
+	CategoryNetwork              ErrorCategory = "Network"
+	CategoryUnsupportedMediaType ErrorCategory = "UnsupportedMediaType"
+	CategoryInvalidManifest      ErrorCategory = "InvalidManifest"
+	CategoryNeverPull            ErrorCategory = "NeverPull"
+	CategorySignatureMissing     ErrorCategory = "SignatureMissing"
+	CategorySignatureInvalid     ErrorCategory = "SignatureInvalid"
+	CategoryPolicyDenied         ErrorCategory = "PolicyDenied"
+	CategoryUnknown              ErrorCategory = "Unknown"
+)
+
+// Reasons reported by the kubelet when a container image can not be pulled.
+// ref: https://github.com/kubernetes/kubernetes/blob/release-1.9/pkg/kubelet/images/types.go
+const (
+	ReasonErrImagePull      = "ErrImagePull"
+	ReasonImageInspectError = "ImageInspectError"
+	ReasonErrImageNeverPull = "ErrImageNeverPull"
+)
+
+// categoryPriority orders categories from most to least actionable. When several
+// credentials fail for different reasons, the most actionable one is reported.
+var categoryPriority = []ErrorCategory{
+	CategoryNeverPull,
+	CategoryNotFound,
+	CategoryRateLimited,
+	CategoryDenied,
+	CategoryUnauthorized,
+	CategoryUnsupportedMediaType,
+	CategoryInvalidManifest,
+	CategoryTLS,
+	CategoryNetwork,
+	CategorySignatureInvalid,
+	CategorySignatureMissing,
+	CategoryPolicyDenied,
+	CategoryUnknown,
+}
+
+var exitCodes = map[ErrorCategory]int{
+	CategoryUnknown:              1,
+	CategoryNotFound:             10,
+	CategoryUnauthorized:         11,
+	CategoryDenied:               12,
+	CategoryRateLimited:          13,
+	CategoryTLS:                  14,
+	CategoryNetwork:              15,
+	CategoryUnsupportedMediaType: 16,
+	CategoryInvalidManifest:      17,
+	CategoryNeverPull:            18,
+	CategorySignatureMissing:     19,
+	CategorySignatureInvalid:     20,
+	CategoryPolicyDenied:         21,
+}
+
+// ErrorDetail is one entry of the distribution API error envelope.
+// ref: https://github.com/opencontainers/distribution-spec/blob/main/spec.md#error-codes
+type ErrorDetail struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message,omitempty"`
+	Detail  json.RawMessage `json:"detail,omitempty"`
+}
+
+// RegistryError is a classified error returned while pulling an image.
+type RegistryError struct {
+	Category   ErrorCategory `json:"category"`
+	Reason     string        `json:"reason"`
+	StatusCode int           `json:"statusCode,omitempty"`
+	Message    string        `json:"message"`
+	Details    []ErrorDetail `json:"details,omitempty"`
+	// Source is the credential source the request was made with, if known.
+	Source string `json:"source,omitempty"`
+
+	Err error `json:"-"`
+}
+
+var _ error = &RegistryError{}
+
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("%s (%s): %s", e.Reason, e.Category, e.Message)
+}
+
+// ExitCode is the process exit code used by the CLI for this error.
+func (e *RegistryError) ExitCode() int {
+	if code, ok := exitCodes[e.Category]; ok {
+		return code
+	}
+	return 1
+}
+
+func newRegistryError(category ErrorCategory, err error) *RegistryError {
+	e := &RegistryError{
+		Category: category,
+		Reason:   reasonFor(category),
+		Err:      err,
+	}
+	if err != nil {
+		e.Message = err.Error()
+	}
+	return e
+}
+
+func reasonFor(category ErrorCategory) string {
+	switch category {
+	case CategoryUnsupportedMediaType, CategoryInvalidManifest:
+		return ReasonImageInspectError
+	case CategoryNeverPull:
+		return ReasonErrImageNeverPull
+	default:
+		return ReasonErrImagePull
+	}
+}
+
+// ClassifyError converts an error returned by the registry client into a *RegistryError.
+// mediaType is the Content-Type of the manifest response, if one was received.
+func ClassifyError(err error, mediaType string) *RegistryError {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*RegistryError); ok {
+		return e
+	}
+
+	cause := err
+	if ue, ok := cause.(*url.Error); ok {
+		cause = ue.Err
+	}
+
+	switch e := cause.(type) {
+	case *reg.HttpStatusError:
+		return classifyStatusError(err, e)
+	case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError, tls.RecordHeaderError:
+		return newRegistryError(CategoryTLS, err)
+	case net.Error:
+		return newRegistryError(CategoryNetwork, err)
+	}
+	if strings.Contains(cause.Error(), "x509: ") || strings.Contains(cause.Error(), "tls: ") {
+		return newRegistryError(CategoryTLS, err)
+	}
+	if _, ok := err.(*url.Error); ok {
+		return newRegistryError(CategoryNetwork, err)
+	}
+
+	if mediaType == "" {
+		return newRegistryError(CategoryUnknown, err)
+	}
+	// a manifest was received, so decoding it failed
+	if !isSupportedMediaType(mediaType) {
+		e := newRegistryError(CategoryUnsupportedMediaType, err)
+		e.Message = fmt.Sprintf("registry returned unsupported manifest media type %q: %v", mediaType, err)
+		return e
+	}
+	return newRegistryError(CategoryInvalidManifest, err)
+}
+
+func classifyStatusError(err error, se *reg.HttpStatusError) *RegistryError {
+	var envelope struct {
+		Errors []ErrorDetail `json:"errors"`
+	}
+	json.Unmarshal(se.Body, &envelope)
+
+	category := CategoryUnknown
+	for _, d := range envelope.Errors {
+		if c, ok := errorCodeCategories[d.Code]; ok {
+			category = c
+			break
+		}
+	}
+	if category == CategoryUnknown {
+		switch se.Response.StatusCode {
+		case http.StatusNotFound:
+			category = CategoryNotFound
+		case http.StatusUnauthorized:
+			category = CategoryUnauthorized
+		case http.StatusForbidden:
+			category = CategoryDenied
+		case http.StatusTooManyRequests:
+			category = CategoryRateLimited
+		case http.StatusNotAcceptable, http.StatusUnsupportedMediaType:
+			category = CategoryUnsupportedMediaType
+		}
+	}
+
+	e := newRegistryError(category, err)
+	e.StatusCode = se.Response.StatusCode
+	e.Details = envelope.Errors
+	if len(envelope.Errors) > 0 {
+		var msgs []string
+		for _, d := range envelope.Errors {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", d.Code, d.Message))
+		}
+		e.Message = strings.Join(msgs, "; ")
+	}
+	return e
+}
+
+var errorCodeCategories = map[string]ErrorCategory{
+	"BLOB_UNKNOWN":          CategoryNotFound,
+	"MANIFEST_UNKNOWN":      CategoryNotFound,
+	"NAME_UNKNOWN":          CategoryNotFound,
+	"UNAUTHORIZED":          CategoryUnauthorized,
+	"DENIED":                CategoryDenied,
+	"TOOMANYREQUESTS":       CategoryRateLimited,
+	"UNSUPPORTED":           CategoryUnsupportedMediaType,
+	"MANIFEST_INVALID":      CategoryInvalidManifest,
+	"MANIFEST_UNVERIFIED":   CategoryInvalidManifest,
+	"MANIFEST_BLOB_UNKNOWN": CategoryInvalidManifest,
+}
+
+func isSupportedMediaType(mediaType string) bool {
+	mediaType = mediaTypeOf(mediaType)
+	if isIndexMediaType(mediaType) {
+		return true
+	}
+	switch mediaType {
+	case manifestV2.MediaTypeManifest, ocispec.MediaTypeImageManifest, manifestV1.MediaTypeManifest, manifestV1.MediaTypeSignedManifest, "application/json":
+		return true
+	}
+	return false
+}
+
+// mostActionable returns the error with the highest priority category.
+func mostActionable(errs []*RegistryError) *RegistryError {
+	for _, c := range categoryPriority {
+		for _, e := range errs {
+			if e.Category == c {
+				return e
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
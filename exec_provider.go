@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/kubernetes/pkg/credentialprovider"
+)
+
+// Types of the kubelet credential provider plugin API.
+// ref: https://kubernetes.io/docs/reference/config-api/kubelet-credentialprovider.v1/
+// ref: https://kubernetes.io/docs/reference/config-api/kubelet-config.v1/#kubelet-config-k8s-io-v1-CredentialProviderConfig
+
+const (
+	credentialProviderRequestKind  = "CredentialProviderRequest"
+	credentialProviderResponseKind = "CredentialProviderResponse"
+
+	CacheKeyTypeImage    = "Image"
+	CacheKeyTypeRegistry = "Registry"
+	CacheKeyTypeGlobal   = "Global"
+
+	execProviderTimeout = time.Minute
+)
+
+var credentialProviderAPIVersions = map[string]bool{
+	"credentialprovider.kubelet.k8s.io/v1":       true,
+	"credentialprovider.kubelet.k8s.io/v1beta1":  true,
+	"credentialprovider.kubelet.k8s.io/v1alpha1": true,
+}
+
+// CredentialProviderConfig is the kubelet's --image-credential-provider-config file.
+type CredentialProviderConfig struct {
+	APIVersion string                       `json:"apiVersion"`
+	Kind       string                       `json:"kind"`
+	Providers  []ExecCredentialProviderSpec `json:"providers"`
+}
+
+// ExecCredentialProviderSpec configures one credential provider plugin.
+type ExecCredentialProviderSpec struct {
+	// Name is the name of the plugin binary in the plugin directory.
+	Name                 string    `json:"name"`
+	MatchImages          []string  `json:"matchImages"`
+	DefaultCacheDuration *Duration `json:"defaultCacheDuration,omitempty"`
+	APIVersion           string    `json:"apiVersion"`
+	Args                 []string  `json:"args,omitempty"`
+	Env                  []ExecEnv `json:"env,omitempty"`
+}
+
+type ExecEnv struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type CredentialProviderRequest struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Image      string `json:"image"`
+}
+
+type CredentialProviderResponse struct {
+	APIVersion    string                  `json:"apiVersion"`
+	Kind          string                  `json:"kind"`
+	CacheKeyType  string                  `json:"cacheKeyType"`
+	CacheDuration *Duration               `json:"cacheDuration,omitempty"`
+	Auth          map[string]AuthConfigV1 `json:"auth,omitempty"`
+}
+
+// AuthConfigV1 is the username and password a plugin returns for a registry.
+type AuthConfigV1 struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Duration is a time.Duration encoded as a string, like metav1.Duration.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// LoadCredentialProviderConfig reads a kubelet credential provider config file.
+func LoadCredentialProviderConfig(path string) (*CredentialProviderConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg CredentialProviderConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse credential provider config %s: %v", path, err)
+	}
+	if cfg.Kind != "CredentialProviderConfig" {
+		return nil, fmt.Errorf("credential provider config %s has kind %q, expected CredentialProviderConfig", path, cfg.Kind)
+	}
+	for _, p := range cfg.Providers {
+		if p.Name == "" || strings.ContainsAny(p.Name, `/\`) || p.Name == "." || p.Name == ".." {
+			return nil, fmt.Errorf("invalid credential provider name %q", p.Name)
+		}
+		if len(p.MatchImages) == 0 {
+			return nil, fmt.Errorf("credential provider %s has no matchImages", p.Name)
+		}
+		if !credentialProviderAPIVersions[p.APIVersion] {
+			return nil, fmt.Errorf("credential provider %s uses unsupported apiVersion %q", p.Name, p.APIVersion)
+		}
+	}
+	return &cfg, nil
+}
+
+// imageProvider is implemented by providers that need the image to provide credentials for.
+// DockerConfigProvider.Provide has no image parameter in this version of the kubelet.
+type imageProvider interface {
+	ProvideForImage(image string) credentialprovider.DockerConfig
+}
+
+// execProvider is a DockerConfigProvider that runs a kubelet credential provider plugin.
+type execProvider struct {
+	Spec ExecCredentialProviderSpec
+	// Path of the plugin binary.
+	Path string
+
+	mu    sync.Mutex
+	cache map[string]*execCacheEntry
+	err   error
+}
+
+type execCacheEntry struct {
+	cfg       credentialprovider.DockerConfig
+	expiresAt time.Time
+}
+
+var (
+	_ credentialprovider.DockerConfigProvider = &execProvider{}
+	_ imageProvider                           = &execProvider{}
+)
+
+func newExecProvider(spec ExecCredentialProviderSpec, binDir string) *execProvider {
+	return &execProvider{
+		Spec:  spec,
+		Path:  filepath.Join(binDir, spec.Name),
+		cache: map[string]*execCacheEntry{},
+	}
+}
+
+func (p *execProvider) Enabled() bool {
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		p.setError(fmt.Errorf("credential provider plugin %s not found: %v", p.Path, err))
+		return false
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		p.setError(fmt.Errorf("credential provider plugin %s is not executable", p.Path))
+		return false
+	}
+	return true
+}
+
+// Provide returns all cached credentials, as the plugin can only be asked for a specific image.
+func (p *execProvider) Provide() credentialprovider.DockerConfig {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cfg := credentialprovider.DockerConfig{}
+	now := time.Now()
+	for _, e := range p.cache {
+		if now.Before(e.expiresAt) {
+			for registry, entry := range e.cfg {
+				cfg[registry] = entry
+			}
+		}
+	}
+	return cfg
+}
+
+func (p *execProvider) LazyProvide() *credentialprovider.DockerConfigEntry {
+	return nil
+}
+
+// ProvideForImage returns credentials for image, running the plugin unless they are cached.
+func (p *execProvider) ProvideForImage(image string) credentialprovider.DockerConfig {
+	if !matchesAnyImage(p.Spec.MatchImages, image) {
+		return credentialprovider.DockerConfig{}
+	}
+
+	p.mu.Lock()
+	for _, key := range []string{image, imageRegistry(image), ""} {
+		if e, ok := p.cache[key]; ok && time.Now().Before(e.expiresAt) {
+			p.mu.Unlock()
+			return e.cfg
+		}
+	}
+	p.mu.Unlock()
+
+	resp, err := p.exec(image)
+	if err != nil {
+		p.setError(err)
+		return credentialprovider.DockerConfig{}
+	}
+
+	cfg := credentialprovider.DockerConfig{}
+	for registry, auth := range resp.Auth {
+		cfg[registry] = credentialprovider.DockerConfigEntry{
+			Username: auth.Username,
+			Password: auth.Password,
+		}
+	}
+
+	var duration time.Duration
+	switch {
+	case resp.CacheDuration != nil:
+		duration = resp.CacheDuration.Duration
+	case p.Spec.DefaultCacheDuration != nil:
+		duration = p.Spec.DefaultCacheDuration.Duration
+	}
+	var key string
+	switch resp.CacheKeyType {
+	case CacheKeyTypeImage:
+		key = image
+	case CacheKeyTypeRegistry:
+		key = imageRegistry(image)
+	case CacheKeyTypeGlobal:
+	default:
+		// like the kubelet, do not use credentials that could be cached under the wrong key
+		p.setError(fmt.Errorf("credential provider plugin %s returned invalid cacheKeyType %q", p.Spec.Name, resp.CacheKeyType))
+		return credentialprovider.DockerConfig{}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = nil
+	if duration > 0 {
+		p.cache[key] = &execCacheEntry{cfg: cfg, expiresAt: time.Now().Add(duration)}
+	}
+	return cfg
+}
+
+func (p *execProvider) exec(image string) (*CredentialProviderResponse, error) {
+	req, err := json.Marshal(CredentialProviderRequest{
+		APIVersion: p.Spec.APIVersion,
+		Kind:       credentialProviderRequestKind,
+		Image:      image,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), execProviderTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.Path, p.Spec.Args...)
+	cmd.Env = os.Environ()
+	for _, e := range p.Spec.Env {
+		cmd.Env = append(cmd.Env, e.Name+"="+e.Value)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("credential provider plugin %s failed: %v: %s", p.Spec.Name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var resp CredentialProviderResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("credential provider plugin %s returned invalid response: %v", p.Spec.Name, err)
+	}
+	if resp.Kind != credentialProviderResponseKind {
+		return nil, fmt.Errorf("credential provider plugin %s returned kind %q, expected %s", p.Spec.Name, resp.Kind, credentialProviderResponseKind)
+	}
+	if resp.APIVersion != p.Spec.APIVersion {
+		return nil, fmt.Errorf("credential provider plugin %s returned apiVersion %q, expected %s", p.Spec.Name, resp.APIVersion, p.Spec.APIVersion)
+	}
+	return &resp, nil
+}
+
+// ExpiresAt returns when the earliest cached credential expires.
+func (p *execProvider) ExpiresAt() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var expiresAt time.Time
+	for _, e := range p.cache {
+		if expiresAt.IsZero() || e.expiresAt.Before(expiresAt) {
+			expiresAt = e.expiresAt
+		}
+	}
+	return expiresAt
+}
+
+func (p *execProvider) LastError() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *execProvider) setError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+// imageRegistry returns the registry host of an image reference.
+func imageRegistry(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 1 || !strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost" {
+		return "docker.io"
+	}
+	return parts[0]
+}
+
+func matchesAnyImage(patterns []string, image string) bool {
+	for _, pattern := range patterns {
+		if matchImage(pattern, image) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchImage reports whether image matches a matchImages pattern. Like the kubelet, each label of
+// the host may be a glob, the port must match exactly if present and the path is a prefix.
+func matchImage(pattern, image string) bool {
+	pu, err := url.Parse("https://" + strings.TrimPrefix(strings.TrimPrefix(pattern, "https://"), "http://"))
+	if err != nil {
+		return false
+	}
+	iu, err := url.Parse("https://" + image)
+	if err != nil {
+		return false
+	}
+
+	if pu.Port() != "" && pu.Port() != iu.Port() {
+		return false
+	}
+	patternLabels := strings.Split(pu.Hostname(), ".")
+	imageLabels := strings.Split(iu.Hostname(), ".")
+	if len(patternLabels) != len(imageLabels) {
+		return false
+	}
+	for i := range patternLabels {
+		if ok, _ := filepath.Match(patternLabels[i], imageLabels[i]); !ok {
+			return false
+		}
+	}
+	return strings.HasPrefix(iu.Path, pu.Path)
+}
+
+// NewExecCredentialProviders returns a provider for every plugin in the config file.
+func NewExecCredentialProviders(configFile, binDir string) (CredentialProviders, error) {
+	cfg, err := LoadCredentialProviderConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	var providers CredentialProviders
+	for _, spec := range cfg.Providers {
+		registries := append([]string(nil), spec.MatchImages...)
+		sort.Strings(registries)
+		providers = append(providers, &CredentialProvider{
+			Name:       "exec:" + spec.Name,
+			Registries: registries,
+			Provider:   newExecProvider(spec, binDir),
+		})
+	}
+	return providers, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	core "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Types of tag updates, as named by Renovate.
+const (
+	UpdatePatch = "patch"
+	UpdateMinor = "minor"
+	UpdateMajor = "major"
+	UpdateDate  = "date"
+)
+
+var (
+	// semverTagRE matches tags such as 1, v1.13, 1.13.2 and 1.13.2-alpine.
+	semverTagRE = regexp.MustCompile(`^(v?)(\d+)(?:\.(\d+))?(?:\.(\d+))?(-.+)?$`)
+	// dateTagRE matches tags such as 20240115, 2024.01.15, 2024-01-15.2 and 20240115-slim.
+	dateTagRE = regexp.MustCompile(`^(20\d{2})([.-]?)(0[1-9]|1[0-2])([.-]?)([0-2]\d|3[01])(?:[.-](\d+))?(-[A-Za-z].*)?$`)
+)
+
+// tagVersion is a tag parsed as a version. Tags are only compared with tags of the same scheme,
+// prefix, suffix and number of components, so that 1.13-alpine is never updated to 1.14 or 1.14.1-alpine.
+type tagVersion struct {
+	tag    string
+	date   bool
+	scheme string
+	nums   []int
+}
+
+func parseTagVersion(tag string) (tagVersion, bool) {
+	if m := dateTagRE.FindStringSubmatch(tag); m != nil {
+		v := tagVersion{tag: tag, date: true, scheme: "date" + m[2] + m[4] + "|" + m[7]}
+		for _, s := range []string{m[1], m[3], m[5], m[6]} {
+			n, _ := strconv.Atoi(s)
+			v.nums = append(v.nums, n)
+		}
+		if m[6] != "" {
+			v.scheme += "|build"
+		}
+		return v, true
+	}
+	m := semverTagRE.FindStringSubmatch(tag)
+	if m == nil {
+		return tagVersion{}, false
+	}
+	v := tagVersion{tag: tag}
+	for _, s := range m[2:5] {
+		if s == "" {
+			break
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return tagVersion{}, false
+		}
+		v.nums = append(v.nums, n)
+	}
+	v.scheme = fmt.Sprintf("%s|%d|%s", m[1], len(v.nums), m[5])
+	return v, true
+}
+
+// compare orders versions of the same scheme.
+func (v tagVersion) compare(o tagVersion) int {
+	for i := range v.nums {
+		if v.nums[i] != o.nums[i] {
+			if v.nums[i] < o.nums[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// updateType returns how newer o is than v.
+func (v tagVersion) updateType(o tagVersion) string {
+	switch {
+	case v.date:
+		return UpdateDate
+	case v.nums[0] != o.nums[0]:
+		return UpdateMajor
+	case v.nums[1] != o.nums[1]:
+		return UpdateMinor
+	}
+	return UpdatePatch
+}
+
+// TagUpdate is a newer tag of an image.
+type TagUpdate struct {
+	Type    string     `json:"type"`
+	Tag     string     `json:"tag"`
+	Digest  string     `json:"digest,omitempty"`
+	Created *time.Time `json:"created,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// ImageFreshness lists the newest patch, minor and major updates of the tag of an image.
+type ImageFreshness struct {
+	Image   string      `json:"image"`
+	Tag     string      `json:"tag,omitempty"`
+	Digest  string      `json:"digest,omitempty"`
+	Created *time.Time  `json:"created,omitempty"`
+	Updates []TagUpdate `json:"updates,omitempty"`
+	// Note explains why the tag could not be checked for updates.
+	Note  string `json:"note,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// imageName returns an image reference without its tag and digest.
+func imageName(img string) string {
+	if i := strings.Index(img, "@"); i >= 0 {
+		img = img[:i]
+	}
+	if i := strings.LastIndex(img, ":"); i > strings.LastIndex(img, "/") {
+		img = img[:i]
+	}
+	return img
+}
+
+// newerTags returns the newest tag of every update type among tags.
+func newerTags(current string, tags []string) ([]tagVersion, []string, bool) {
+	cur, ok := parseTagVersion(current)
+	if !ok {
+		return nil, nil, false
+	}
+	best := map[string]tagVersion{}
+	for _, t := range tags {
+		v, ok := parseTagVersion(t)
+		if !ok || v.scheme != cur.scheme || v.compare(cur) <= 0 {
+			continue
+		}
+		typ := cur.updateType(v)
+		if b, ok := best[typ]; !ok || v.compare(b) > 0 {
+			best[typ] = v
+		}
+	}
+	var versions []tagVersion
+	var types []string
+	for _, typ := range []string{UpdatePatch, UpdateMinor, UpdateMajor, UpdateDate} {
+		if v, ok := best[typ]; ok {
+			versions = append(versions, v)
+			types = append(types, typ)
+		}
+	}
+	return versions, types, true
+}
+
+// CheckFreshness lists the tags of the repository of a pulled image with the credentials it was
+// pulled with, and pulls the newest patch, minor and major updates of its tag.
+func CheckFreshness(result *PullResult, pullSecrets []core.Secret) (*ImageFreshness, error) {
+	f := &ImageFreshness{Image: result.Image, Digest: result.Digest}
+	if cfg, err := FetchConfig(result); err == nil {
+		f.Created = cfg.Created
+	}
+	f.Tag, _ = imageReference(result.Image)
+	if f.Tag == "" {
+		if _, dgst := imageReference(result.Image); dgst != "" {
+			f.Note = "pinned by digest only"
+			return f, nil
+		}
+		f.Tag = "latest"
+	}
+
+	hub, err := result.artifactClient()
+	if err != nil {
+		return nil, err
+	}
+	tags, err := hub.Tags(result.Repository)
+	if err != nil {
+		return nil, err
+	}
+	versions, types, ok := newerTags(f.Tag, tags)
+	if !ok {
+		f.Note = "tag is not a version"
+		return f, nil
+	}
+	for i, v := range versions {
+		u := TagUpdate{Type: types[i], Tag: v.tag}
+		candidate, err := PullImage(imageName(result.Image)+":"+v.tag, pullSecrets)
+		if err == nil {
+			u.Digest = candidate.Digest
+			var cfg *ImageConfig
+			if cfg, err = FetchConfig(candidate); err == nil {
+				u.Created = cfg.Created
+			}
+		}
+		if err != nil {
+			u.Error = ClassifyError(err, candidate.MediaType).Error()
+		}
+		f.Updates = append(f.Updates, u)
+	}
+	return f, nil
+}
+
+// runFreshness reports newer tags of img, or of the images given with -images or -images-file, or
+// else of the images used by Pods, as a Renovate style upgrade table.
+func runFreshness(img string, opts *WatchOptions, kubeClient func() kubernetes.Interface, pullSecrets func() []core.Secret, namespace, output string) {
+	var targets []sizeTarget
+	switch {
+	case img != "":
+		targets = append(targets, sizeTarget{image: img, pullSecrets: pullSecrets()})
+	case len(opts.Images) > 0 || opts.ImagesFile != "":
+		images, err := opts.images()
+		if err != nil {
+			glog.Fatalln(err)
+		}
+		secrets := pullSecrets()
+		for _, img := range images {
+			targets = append(targets, sizeTarget{image: img, pullSecrets: secrets})
+		}
+	default:
+		var err error
+		if targets, err = podImageTargets(kubeClient(), namespace); err != nil {
+			glog.Fatalln(err)
+		}
+	}
+
+	var report []*ImageFreshness
+	for _, t := range targets {
+		result, err := PullImage(t.image, t.pullSecrets)
+		var f *ImageFreshness
+		if err == nil {
+			f, err = CheckFreshness(result, t.pullSecrets)
+		}
+		if err != nil {
+			f = &ImageFreshness{Image: t.image, Error: ClassifyError(err, result.MediaType).Error()}
+		}
+		report = append(report, f)
+	}
+
+	if output == "json" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	created := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.UTC().Format("2006-01-02")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tUPDATE\tCHANGE\tDIGEST\tCREATED\tNOTE")
+	for _, f := range report {
+		name := imageName(f.Image)
+		switch {
+		case f.Error != "":
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t%s\n", name, f.Error)
+		case len(f.Updates) == 0:
+			note := f.Note
+			if note == "" {
+				note = "up to date"
+			}
+			fmt.Fprintf(w, "%s\t-\t%s\t%s\t%s\t%s\n", name, orDash(f.Tag), orDash(shortDigest(f.Digest)), created(f.Created), note)
+		}
+		for _, u := range f.Updates {
+			fmt.Fprintf(w, "%s\t%s\t%s -> %s\t%s\t%s\t%s\n", name, u.Type, f.Tag, u.Tag, orDash(shortDigest(u.Digest)), created(u.Created), u.Error)
+		}
+	}
+	w.Flush()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+const (
+	ImagePullCheckGroup        = "docker-image-puller.appscode.com"
+	ImagePullCheckVersion      = "v1alpha1"
+	ResourceImagePullChecks    = "imagepullchecks"
+	ResourceKindImagePullCheck = "ImagePullCheck"
+
+	// ImagePullCheck condition types
+	ConditionPullable          = "Pullable"
+	ConditionPlatformAvailable = "PlatformAvailable"
+	ConditionLayersPulled      = "LayersPulled"
+)
+
+var ImagePullCheckGroupVersion = schema.GroupVersion{Group: ImagePullCheckGroup, Version: ImagePullCheckVersion}
+
+// ImagePullCheck asks the controller to check that an image can be pulled with the pull secrets
+// of a namespace, the way the kubelet would pull it for a Pod.
+type ImagePullCheck struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              ImagePullCheckSpec   `json:"spec"`
+	Status            ImagePullCheckStatus `json:"status,omitempty"`
+}
+
+type ImagePullCheckSpec struct {
+	Image string `json:"image"`
+	// Namespace whose pull secrets are used. It defaults to, and must be, the namespace of the check,
+	// so a check never grants access to the pull secrets of another namespace.
+	Namespace string `json:"namespace,omitempty"`
+	// ServiceAccount whose image pull secrets are used, "default" if empty.
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	// Platform the image must be built for, in os/arch[/variant] form.
+	Platform string `json:"platform,omitempty"`
+	// PullLayers downloads and verifies every layer, not only the manifest.
+	PullLayers bool `json:"pullLayers,omitempty"`
+}
+
+type ImagePullCheckStatus struct {
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+	Digest             string `json:"digest,omitempty"`
+	MediaType          string `json:"mediaType,omitempty"`
+	// Size is the compressed size of the config and layers in bytes.
+	Size             int64                     `json:"size,omitempty"`
+	CredentialSource string                    `json:"credentialSource,omitempty"`
+	Conditions       []ImagePullCheckCondition `json:"conditions,omitempty"`
+	LastChecked      *metav1.Time              `json:"lastChecked,omitempty"`
+}
+
+type ImagePullCheckCondition struct {
+	Type               string               `json:"type"`
+	Status             core.ConditionStatus `json:"status"`
+	Reason             string               `json:"reason,omitempty"`
+	Message            string               `json:"message,omitempty"`
+	LastTransitionTime metav1.Time          `json:"lastTransitionTime,omitempty"`
+}
+
+type ImagePullCheckList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImagePullCheck `json:"items"`
+}
+
+// ImagePullCheck types are registered with the client-go scheme, so that Events can refer to them.
+func init() {
+	addImagePullCheckTypes(scheme.Scheme)
+}
+
+func addImagePullCheckTypes(s *runtime.Scheme) {
+	s.AddKnownTypes(ImagePullCheckGroupVersion, &ImagePullCheck{}, &ImagePullCheckList{})
+	metav1.AddToGroupVersion(s, ImagePullCheckGroupVersion)
+}
+
+// setCondition adds or replaces the condition of the same type, keeping the transition time if the status did not change.
+func (s *ImagePullCheckStatus) setCondition(cond ImagePullCheckCondition) {
+	cond.LastTransitionTime = metav1.Now()
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == cond.Type {
+			if s.Conditions[i].Status == cond.Status {
+				cond.LastTransitionTime = s.Conditions[i].LastTransitionTime
+			}
+			s.Conditions[i] = cond
+			return
+		}
+	}
+	s.Conditions = append(s.Conditions, cond)
+}
+
+// removeCondition drops the condition of the given type.
+func (s *ImagePullCheckStatus) removeCondition(condType string) {
+	conds := s.Conditions[:0]
+	for _, c := range s.Conditions {
+		if c.Type != condType {
+			conds = append(conds, c)
+		}
+	}
+	s.Conditions = conds
+}
+
+func (in *ImagePullCheck) DeepCopyInto(out *ImagePullCheck) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+func (in *ImagePullCheck) DeepCopy() *ImagePullCheck {
+	if in == nil {
+		return nil
+	}
+	out := new(ImagePullCheck)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *ImagePullCheck) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+func (in *ImagePullCheckStatus) DeepCopyInto(out *ImagePullCheckStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		out.Conditions = make([]ImagePullCheckCondition, len(in.Conditions))
+		for i := range in.Conditions {
+			in.Conditions[i].DeepCopyInto(&out.Conditions[i])
+		}
+	}
+	if in.LastChecked != nil {
+		out.LastChecked = in.LastChecked.DeepCopy()
+	}
+}
+
+func (in *ImagePullCheckCondition) DeepCopyInto(out *ImagePullCheckCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+}
+
+func (in *ImagePullCheckList) DeepCopyInto(out *ImagePullCheckList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]ImagePullCheck, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+func (in *ImagePullCheckList) DeepCopy() *ImagePullCheckList {
+	if in == nil {
+		return nil
+	}
+	out := new(ImagePullCheckList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *ImagePullCheckList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
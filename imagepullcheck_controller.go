@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	core "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/scheme"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// NewImagePullCheckClient returns a REST client for ImagePullCheck objects.
+func NewImagePullCheckClient(config *rest.Config) (*rest.RESTClient, error) {
+	cfg := *config
+	cfg.GroupVersion = &ImagePullCheckGroupVersion
+	cfg.APIPath = "/apis"
+	cfg.ContentType = runtime.ContentTypeJSON
+	cfg.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: scheme.Codecs}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+	return rest.RESTClientFor(&cfg)
+}
+
+// ImagePullCheckController runs the checks requested by ImagePullCheck objects and writes their status.
+// A check runs when its spec changes and again once its last check is older than CheckInterval.
+type ImagePullCheckController struct {
+	client   *rest.RESTClient
+	options  *ControllerOptions
+	factory  informers.SharedInformerFactory
+	recorder record.EventRecorder
+	informer cache.SharedIndexInformer
+
+	secretLister         corelisters.SecretLister
+	serviceAccountLister corelisters.ServiceAccountLister
+	secretsSynced        cache.InformerSynced
+	serviceAccountSynced cache.InformerSynced
+
+	mu      sync.Mutex
+	pending map[string]bool
+	queue   chan string
+}
+
+func NewImagePullCheckController(config *rest.Config, factory informers.SharedInformerFactory, recorder record.EventRecorder, options *ControllerOptions) (*ImagePullCheckController, error) {
+	client, err := NewImagePullCheckClient(config)
+	if err != nil {
+		return nil, err
+	}
+	c := &ImagePullCheckController{
+		client:               client,
+		options:              options,
+		factory:              factory,
+		recorder:             recorder,
+		secretLister:         factory.Core().V1().Secrets().Lister(),
+		serviceAccountLister: factory.Core().V1().ServiceAccounts().Lister(),
+		secretsSynced:        factory.Core().V1().Secrets().Informer().HasSynced,
+		serviceAccountSynced: factory.Core().V1().ServiceAccounts().Informer().HasSynced,
+		pending:              map[string]bool{},
+		queue:                make(chan string, 1024),
+	}
+	c.informer = cache.NewSharedIndexInformer(
+		cache.NewListWatchFromClient(client, ResourceImagePullChecks, options.Namespace, fields.Everything()),
+		&ImagePullCheck{},
+		options.ResyncPeriod,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(obj) },
+	})
+	return c, nil
+}
+
+func (c *ImagePullCheckController) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorln(err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending[key] {
+		return
+	}
+	c.pending[key] = true
+	go func() { c.queue <- key }()
+}
+
+// Run processes ImagePullCheck objects until stopCh is closed.
+func (c *ImagePullCheckController) Run(stopCh <-chan struct{}) error {
+	go c.informer.Run(stopCh)
+	c.factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced, c.secretsSynced, c.serviceAccountSynced) {
+		return fmt.Errorf("timed out waiting for caches to sync")
+	}
+	for {
+		select {
+		case <-stopCh:
+			return nil
+		case key := <-c.queue:
+			c.mu.Lock()
+			delete(c.pending, key)
+			c.mu.Unlock()
+			if err := c.sync(key); err != nil {
+				glog.Errorf("Failed to sync ImagePullCheck %s: %s", key, err)
+			}
+		}
+	}
+}
+
+func (c *ImagePullCheckController) sync(key string) error {
+	obj, exists, err := c.informer.GetIndexer().GetByKey(key)
+	if err != nil || !exists {
+		return err
+	}
+	check := obj.(*ImagePullCheck)
+
+	status := check.Status
+	due := status.LastChecked == nil || time.Since(status.LastChecked.Time) >= c.options.CheckInterval
+	if status.ObservedGeneration == check.Generation && !due {
+		return nil
+	}
+
+	check = check.DeepCopy()
+	c.run(check)
+	return c.updateStatus(check)
+}
+
+// run checks the image of check and sets its status.
+func (c *ImagePullCheckController) run(check *ImagePullCheck) {
+	spec := check.Spec
+	status := &check.Status
+	now := metav1.Now()
+	status.ObservedGeneration = check.Generation
+	status.LastChecked = &now
+	status.Digest, status.MediaType, status.Size, status.CredentialSource = "", "", 0, ""
+
+	fail := func(condType, reason, msg string) {
+		status.setCondition(ImagePullCheckCondition{Type: condType, Status: core.ConditionFalse, Reason: reason, Message: msg})
+		c.recorder.Event(check, core.EventTypeWarning, reason, msg)
+	}
+
+	if spec.Namespace != "" && spec.Namespace != check.Namespace {
+		fail(ConditionPullable, "NamespaceNotAllowed", fmt.Sprintf("pull secrets of namespace %s can only be checked from an ImagePullCheck in that namespace", spec.Namespace))
+		return
+	}
+	saName := spec.ServiceAccount
+	if saName == "" {
+		saName = "default"
+	}
+	sa, err := c.serviceAccountLister.ServiceAccounts(check.Namespace).Get(saName)
+	if err != nil {
+		fail(ConditionPullable, EventReasonPullSecretInvalid, fmt.Sprintf("service account %s/%s: %s", check.Namespace, saName, err))
+		return
+	}
+	pullSecrets, _, problems := resolvePullSecrets(c.secretLister, check.Namespace, sa.ImagePullSecrets)
+	for _, msg := range problems {
+		c.recorder.Event(check, core.EventTypeWarning, EventReasonPullSecretInvalid, msg)
+	}
+
+	result, err := PullImage(spec.Image, pullSecrets)
+	recordCheck(result, err)
+	status.MediaType = result.MediaType
+	if err != nil {
+		regErr := ClassifyError(err, result.MediaType)
+		fail(ConditionPullable, string(regErr.Category), regErr.Error())
+		status.removeCondition(ConditionPlatformAvailable)
+		status.removeCondition(ConditionLayersPulled)
+		return
+	}
+	status.Digest = result.Digest
+	status.Size = ManifestSize(result.Manifest)
+	status.CredentialSource = result.CredentialSource
+	status.setCondition(ImagePullCheckCondition{Type: ConditionPullable, Status: core.ConditionTrue, Reason: "ManifestPulled", Message: fmt.Sprintf("pulled %s with %s", spec.Image, result.CredentialSource)})
+
+	// image indexes are resolved to the platform of the check, not to the -platform of the controller
+	if spec.Platform == "" {
+		status.removeCondition(ConditionPlatformAvailable)
+	} else if result.Index != nil {
+		if _, err := selectPlatform(result.Index, spec.Platform); err != nil {
+			fail(ConditionPlatformAvailable, "PlatformMismatch", fmt.Sprintf("image index has no manifest for %s, only for %s", spec.Platform, strings.Join(mapKeys(IndexPlatforms(result.Index)), ", ")))
+		} else if platformResult, err := pullPlatform(result, spec.Platform, pullSecrets); err != nil {
+			regErr := ClassifyError(err, platformResult.MediaType)
+			fail(ConditionPlatformAvailable, string(regErr.Category), regErr.Error())
+		} else {
+			result = platformResult
+			status.setCondition(ImagePullCheckCondition{Type: ConditionPlatformAvailable, Status: core.ConditionTrue, Reason: "PlatformMatches", Message: fmt.Sprintf("%s manifest %s", spec.Platform, result.Digest)})
+		}
+	} else if cfg, err := FetchConfig(result); err != nil {
+		fail(ConditionPlatformAvailable, "ConfigUnavailable", err.Error())
+	} else if !platformMatches(spec.Platform, cfg.Platform()) {
+		fail(ConditionPlatformAvailable, "PlatformMismatch", fmt.Sprintf("image is built for %s, not %s", cfg.Platform(), spec.Platform))
+	} else {
+		status.setCondition(ImagePullCheckCondition{Type: ConditionPlatformAvailable, Status: core.ConditionTrue, Reason: "PlatformMatches", Message: cfg.Platform()})
+	}
+
+	if !spec.PullLayers {
+		status.removeCondition(ConditionLayersPulled)
+	} else if n, err := PullLayers(result); err != nil {
+		fail(ConditionLayersPulled, "LayerPullFailed", err.Error())
+	} else {
+		if status.Size == 0 {
+			status.Size = n
+		}
+		status.setCondition(ImagePullCheckCondition{Type: ConditionLayersPulled, Status: core.ConditionTrue, Reason: "LayersVerified", Message: fmt.Sprintf("downloaded and verified %d bytes", n)})
+	}
+}
+
+func (c *ImagePullCheckController) updateStatus(check *ImagePullCheck) error {
+	err := c.client.Put().
+		Namespace(check.Namespace).
+		Resource(ResourceImagePullChecks).
+		Name(check.Name).
+		SubResource("status").
+		Body(check).
+		Do().
+		Error()
+	if kerr.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// platformMatches reports whether the image platform satisfies want. A want without variant matches any variant.
+func platformMatches(want, got string) bool {
+	if want == got {
+		return true
+	}
+	return len(got) > len(want) && got[:len(want)+1] == want+"/"
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	core "k8s.io/api/core/v1"
+)
+
+// mediaTypeManifestList is the media type of Docker manifest lists, which share the format of OCI image indexes.
+const mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == mediaTypeManifestList || mediaType == ocispec.MediaTypeImageIndex
+}
+
+// descriptorPlatform returns the platform of an index entry in os/arch[/variant] form, or "" if it has none.
+// Attestation manifests, such as the provenance buildkit pushes, have the platform unknown/unknown.
+func descriptorPlatform(d ocispec.Descriptor) string {
+	if d.Platform == nil || d.Platform.OS == "" || d.Platform.OS == "unknown" {
+		return ""
+	}
+	p := d.Platform.OS + "/" + d.Platform.Architecture
+	if d.Platform.Variant != "" {
+		p += "/" + d.Platform.Variant
+	}
+	return p
+}
+
+// selectPlatform returns the first entry of idx for want, a platform in os/arch[/variant] form.
+func selectPlatform(idx *ocispec.Index, want string) (ocispec.Descriptor, error) {
+	for _, d := range idx.Manifests {
+		if p := descriptorPlatform(d); p != "" && platformMatches(want, p) {
+			return d, nil
+		}
+	}
+	return ocispec.Descriptor{}, newRegistryError(CategoryNotFound, fmt.Errorf("image index has no manifest for platform %s", want))
+}
+
+// pullPlatform returns the pull of the manifest of want from the image index of result, or result
+// itself if it has no index or its manifest already is that of want.
+func pullPlatform(result *PullResult, want string, pullSecrets []core.Secret) (*PullResult, error) {
+	if result.Index == nil {
+		return result, nil
+	}
+	d, err := selectPlatform(result.Index, want)
+	if err != nil {
+		return result, err
+	}
+	if d.Digest.String() == result.Digest {
+		return result, nil
+	}
+	return PullImage(imageName(result.Image)+"@"+d.Digest.String(), pullSecrets)
+}
+
+// IndexPlatforms returns the digest of the manifest of every platform of an image index.
+func IndexPlatforms(idx *ocispec.Index) map[string]string {
+	platforms := map[string]string{}
+	for _, d := range idx.Manifests {
+		if p := descriptorPlatform(d); p != "" {
+			if _, ok := platforms[p]; !ok {
+				platforms[p] = d.Digest.String()
+			}
+		}
+	}
+	return platforms
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	manifestV2 "github.com/docker/distribution/manifest/schema2"
+	units "github.com/docker/go-units"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	core "k8s.io/api/core/v1"
+)
+
+// Layer is a layer of an image manifest. Size is unknown for schema1 manifests.
+type Layer struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"mediaType,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+}
+
+// ImageInspect describes an image from its manifest and config, like skopeo inspect.
+type ImageInspect struct {
+	Image          string `json:"image"`
+	Registry       string `json:"registry"`
+	Repository     string `json:"repository"`
+	Reference      string `json:"reference"`
+	Digest         string `json:"digest,omitempty"`
+	MediaType      string `json:"mediaType,omitempty"`
+	IndexDigest    string `json:"indexDigest,omitempty"`
+	IndexMediaType string `json:"indexMediaType,omitempty"`
+	// Platforms are the manifest digests of the platforms of the image index, if the image has one.
+	Platforms        map[string]string `json:"platforms,omitempty"`
+	CredentialSource string            `json:"credentialSource,omitempty"`
+	Created          *time.Time        `json:"created,omitempty"`
+	Author           string            `json:"author,omitempty"`
+	Architecture     string            `json:"architecture,omitempty"`
+	OS               string            `json:"os,omitempty"`
+	Variant          string            `json:"variant,omitempty"`
+	User             string            `json:"user,omitempty"`
+	WorkingDir       string            `json:"workingDir,omitempty"`
+	Entrypoint       []string          `json:"entrypoint,omitempty"`
+	Cmd              []string          `json:"cmd,omitempty"`
+	Env              []string          `json:"env,omitempty"`
+	ExposedPorts     []string          `json:"exposedPorts,omitempty"`
+	Volumes          []string          `json:"volumes,omitempty"`
+	StopSignal       string            `json:"stopSignal,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Layers           []Layer           `json:"layers,omitempty"`
+	History          []ocispec.History `json:"history,omitempty"`
+}
+
+// Layers returns the layers of a manifest, base layer first.
+func Layers(mf interface{}) []Layer {
+	if m, ok := mf.(*manifestV2.DeserializedManifest); ok {
+		layers := make([]Layer, 0, len(m.Layers))
+		for _, l := range m.Layers {
+			layers = append(layers, Layer{Digest: l.Digest.String(), MediaType: l.MediaType, Size: l.Size})
+		}
+		return layers
+	}
+	var layers []Layer
+	for _, d := range layerDigests(mf) {
+		layers = append(layers, Layer{Digest: d.String()})
+	}
+	return layers
+}
+
+// InspectImage pulls the manifest and config of img.
+func InspectImage(img string, pullSecrets []core.Secret) (*ImageInspect, *PullResult, error) {
+	result, err := PullImage(img, pullSecrets)
+	if err != nil {
+		return nil, result, err
+	}
+	cfg, err := FetchConfig(result)
+	if err != nil {
+		return nil, result, err
+	}
+
+	ins := &ImageInspect{
+		Image:            result.Image,
+		Registry:         result.Registry,
+		Repository:       result.Repository,
+		Reference:        result.Reference,
+		Digest:           result.Digest,
+		MediaType:        result.MediaType,
+		IndexDigest:      result.IndexDigest,
+		IndexMediaType:   result.IndexMediaType,
+		CredentialSource: result.CredentialSource,
+		Created:          cfg.Created,
+		Author:           cfg.Author,
+		Architecture:     cfg.Architecture,
+		OS:               cfg.OS,
+		Variant:          cfg.Variant,
+		User:             cfg.Config.User,
+		WorkingDir:       cfg.Config.WorkingDir,
+		Entrypoint:       cfg.Config.Entrypoint,
+		Cmd:              cfg.Config.Cmd,
+		Env:              cfg.Config.Env,
+		ExposedPorts:     sortedKeys(cfg.Config.ExposedPorts),
+		Volumes:          sortedKeys(cfg.Config.Volumes),
+		StopSignal:       cfg.Config.StopSignal,
+		Labels:           cfg.Config.Labels,
+		Layers:           Layers(result.Manifest),
+		History:          cfg.History,
+	}
+	if result.Index != nil {
+		ins.Platforms = IndexPlatforms(result.Index)
+	}
+	return ins, result, nil
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func runInspect(img string, pullSecrets []core.Secret, output string) {
+	ins, result, err := InspectImage(img, pullSecrets)
+	if err != nil {
+		regErr := ClassifyError(err, result.MediaType)
+		fmt.Fprintln(os.Stderr, regErr.Error())
+		os.Exit(regErr.ExitCode())
+	}
+	if output == "json" {
+		data, _ := json.MarshalIndent(ins, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(w, "%s:\t%s\n", name, value)
+		}
+	}
+	list := func(name string, values []string) {
+		for i, v := range values {
+			if i == 0 {
+				fmt.Fprintf(w, "%s:\t%s\n", name, v)
+			} else {
+				fmt.Fprintf(w, "\t%s\n", v)
+			}
+		}
+	}
+	field("Name", ins.Registry+"/"+ins.Repository)
+	field("Reference", ins.Reference)
+	field("Digest", ins.Digest)
+	field("MediaType", ins.MediaType)
+	field("IndexDigest", ins.IndexDigest)
+	field("IndexMediaType", ins.IndexMediaType)
+	var platforms []string
+	for p, d := range ins.Platforms {
+		platforms = append(platforms, p+" "+d)
+	}
+	sort.Strings(platforms)
+	list("Platforms", platforms)
+	field("CredentialSource", ins.CredentialSource)
+	field("Created", formatTime(ins.Created))
+	field("Author", ins.Author)
+	field("Architecture", ins.Architecture)
+	field("Os", ins.OS)
+	field("Variant", ins.Variant)
+	field("User", ins.User)
+	field("WorkingDir", ins.WorkingDir)
+	field("Entrypoint", quoteArgs(ins.Entrypoint))
+	field("Cmd", quoteArgs(ins.Cmd))
+	list("Env", ins.Env)
+	list("ExposedPorts", ins.ExposedPorts)
+	list("Volumes", ins.Volumes)
+	field("StopSignal", ins.StopSignal)
+	var labels []string
+	for k, v := range ins.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	list("Labels", labels)
+	w.Flush()
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LAYER\tSIZE\tMEDIA TYPE")
+	for _, l := range ins.Layers {
+		size := "-"
+		if l.Size > 0 {
+			size = units.HumanSize(float64(l.Size))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", l.Digest, size, orDash(l.MediaType))
+	}
+	w.Flush()
+
+	if len(ins.History) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CREATED\tCREATED BY\tEMPTY LAYER\tCOMMENT")
+		for _, h := range ins.History {
+			created := "-"
+			if h.Created != nil {
+				created = h.Created.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%t\t%s\n", created, strings.Replace(h.CreatedBy, "\t", " ", -1), h.EmptyLayer, h.Comment)
+		}
+		w.Flush()
+	}
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// quoteArgs formats an exec form command like the Dockerfile JSON array syntax.
+func quoteArgs(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(args)
+	return string(data)
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Package types, as used in package URLs.
+// ref: https://github.com/package-url/purl-spec/blob/master/PURL-TYPES.rst
+const (
+	PackageTypeDeb      = "deb"
+	PackageTypeAPK      = "apk"
+	PackageTypeNPM      = "npm"
+	PackageTypePyPI     = "pypi"
+	PackageTypeCargo    = "cargo"
+	PackageTypeGem      = "gem"
+	PackageTypeComposer = "composer"
+)
+
+// maxInventoryFileSize bounds the package databases and lockfiles read into memory.
+const maxInventoryFileSize = 32 << 20
+
+// Package is a package found in an image filesystem.
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Type    string `json:"type"`
+	Arch    string `json:"arch,omitempty"`
+	License string `json:"license,omitempty"`
+	// SourcePackage is the source package an OS package was built from, if it differs from Name.
+	SourcePackage string `json:"sourcePackage,omitempty"`
+	// Path is the package database or lockfile the package was found in.
+	Path string `json:"path"`
+	PURL string `json:"purl"`
+}
+
+// OSRelease is the operating system an image is based on, from /etc/os-release.
+// ref: https://www.freedesktop.org/software/systemd/man/os-release.html
+type OSRelease struct {
+	ID              string `json:"id"`
+	IDLike          string `json:"idLike,omitempty"`
+	VersionID       string `json:"versionID,omitempty"`
+	VersionCodename string `json:"versionCodename,omitempty"`
+	PrettyName      string `json:"prettyName,omitempty"`
+}
+
+// Inventory lists the packages installed in an image.
+type Inventory struct {
+	Image    string     `json:"image"`
+	Digest   string     `json:"digest,omitempty"`
+	OS       *OSRelease `json:"os,omitempty"`
+	Packages []Package  `json:"packages"`
+	// EmbeddedSBOMs are SBOM documents shipped inside the image filesystem.
+	EmbeddedSBOMs []string `json:"embeddedSBOMs,omitempty"`
+	// Warnings are package databases that were found but could not be read.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// inventoryParsers parse the content of package databases and lockfiles, by file path.
+var inventoryParsers = []struct {
+	match func(p string) bool
+	parse func(p string, data []byte) ([]Package, error)
+}{
+	{func(p string) bool { return p == "/var/lib/dpkg/status" }, parseDpkgStatus},
+	// distroless images have one status file per package
+	{func(p string) bool {
+		return path.Dir(p) == "/var/lib/dpkg/status.d" && !strings.HasSuffix(p, ".md5sums")
+	}, parseDpkgStatus},
+	{func(p string) bool { return p == "/lib/apk/db/installed" }, parseAPKInstalled},
+	{func(p string) bool { return path.Base(p) == "package-lock.json" }, parseNPMLock},
+	{func(p string) bool {
+		return path.Base(p) == "METADATA" && strings.HasSuffix(path.Dir(p), ".dist-info")
+	}, parsePythonMetadata},
+	{func(p string) bool { return path.Base(p) == "Cargo.lock" }, parseCargoLock},
+	{func(p string) bool { return path.Base(p) == "Gemfile.lock" }, parseGemfileLock},
+	{func(p string) bool { return path.Base(p) == "composer.lock" }, parseComposerLock},
+}
+
+// rpmDatabases are the rpm databases. Reading them needs Berkeley DB or SQLite, which are not vendored.
+var rpmDatabases = map[string]bool{
+	"/var/lib/rpm/Packages":              true,
+	"/var/lib/rpm/Packages.db":           true,
+	"/var/lib/rpm/rpmdb.sqlite":          true,
+	"/usr/lib/sysimage/rpm/Packages":     true,
+	"/usr/lib/sysimage/rpm/Packages.db":  true,
+	"/usr/lib/sysimage/rpm/rpmdb.sqlite": true,
+}
+
+func isOSRelease(p string) bool {
+	return p == "/etc/os-release" || p == "/usr/lib/os-release"
+}
+
+func isEmbeddedSBOM(p string) bool {
+	return strings.HasSuffix(p, ".spdx.json") || strings.HasSuffix(p, ".spdx") || strings.HasSuffix(p, ".cdx.json")
+}
+
+func inventoryFile(p string) bool {
+	if isOSRelease(p) {
+		return true
+	}
+	for _, ip := range inventoryParsers {
+		if ip.match(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectFiles streams the layers of a pulled image and returns the final content of the files
+// accepted by match, and the paths of the other files accepted by list, honouring whiteouts.
+func collectFiles(result *PullResult, match, list func(p string) bool) (map[string][]byte, map[string]bool, error) {
+	files := map[string][]byte{}
+	listed := map[string]bool{}
+	for _, d := range layerDigests(result.Manifest) {
+		layerFiles := map[string][]byte{}
+		layerListed := map[string]bool{}
+		var whiteouts, opaque []string
+		err := walkLayer(result, d, func(hdr *tar.Header, r io.Reader) error {
+			dir, base := path.Split(hdr.Name)
+			switch {
+			case base == whiteoutOpaque:
+				opaque = append(opaque, path.Clean(dir))
+			case strings.HasPrefix(base, whiteoutPrefix):
+				whiteouts = append(whiteouts, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			case hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA:
+			case match(hdr.Name):
+				w := &limitedBuffer{limit: maxInventoryFileSize}
+				if _, err := io.Copy(w, r); err != nil {
+					return fmt.Errorf("%s: %v", hdr.Name, err)
+				}
+				layerFiles[hdr.Name] = w.data
+			case list(hdr.Name):
+				layerListed[hdr.Name] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range append(opaque, whiteouts...) {
+			prefix := strings.TrimSuffix(p, "/") + "/"
+			for name := range files {
+				if name == p || strings.HasPrefix(name, prefix) {
+					delete(files, name)
+				}
+			}
+			for name := range listed {
+				if name == p || strings.HasPrefix(name, prefix) {
+					delete(listed, name)
+				}
+			}
+		}
+		for name, data := range layerFiles {
+			files[name] = data
+		}
+		for name := range layerListed {
+			listed[name] = true
+		}
+	}
+	return files, listed, nil
+}
+
+// ImageInventory lists the OS packages and language dependencies of a pulled image by streaming its layers.
+func ImageInventory(result *PullResult) (*Inventory, error) {
+	files, listed, err := collectFiles(result, inventoryFile, func(p string) bool {
+		return rpmDatabases[p] || isEmbeddedSBOM(p)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	inv := &Inventory{Image: result.Image, Digest: result.Digest, Packages: []Package{}}
+	for _, p := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		if data, ok := files[p]; ok {
+			inv.OS = parseOSRelease(data)
+			break
+		}
+	}
+
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		for _, ip := range inventoryParsers {
+			if !ip.match(p) {
+				continue
+			}
+			pkgs, err := ip.parse(p, files[p])
+			if err != nil {
+				inv.Warnings = append(inv.Warnings, fmt.Sprintf("%s: %v", p, err))
+			}
+			for _, pkg := range pkgs {
+				pkg.Path = p
+				pkg.PURL = packageURL(pkg, inv.OS)
+				inv.Packages = append(inv.Packages, pkg)
+			}
+			break
+		}
+	}
+	for p := range listed {
+		if rpmDatabases[p] {
+			inv.Warnings = append(inv.Warnings, fmt.Sprintf("%s: rpm databases are not supported", p))
+		} else {
+			inv.EmbeddedSBOMs = append(inv.EmbeddedSBOMs, p)
+		}
+	}
+	sort.Strings(inv.Warnings)
+	sort.Strings(inv.EmbeddedSBOMs)
+	return inv, nil
+}
+
+// packageURL returns the purl of a package. OS packages are qualified with the distribution.
+func packageURL(pkg Package, rel *OSRelease) string {
+	name := pkg.Name
+	namespace := ""
+	switch pkg.Type {
+	case PackageTypeDeb, PackageTypeAPK:
+		if rel != nil {
+			namespace = rel.ID
+		}
+	case PackageTypeComposer:
+		if i := strings.Index(name, "/"); i >= 0 {
+			namespace, name = name[:i], name[i+1:]
+		}
+	case PackageTypeNPM:
+		if strings.HasPrefix(name, "@") {
+			if i := strings.Index(name, "/"); i >= 0 {
+				namespace, name = "%40"+name[1:i], name[i+1:]
+			}
+		}
+	case PackageTypePyPI:
+		name = strings.ToLower(strings.Replace(name, "_", "-", -1))
+	}
+
+	purl := "pkg:" + pkg.Type + "/"
+	if namespace != "" {
+		purl += namespace + "/"
+	}
+	purl += name + "@" + pkg.Version
+
+	var qualifiers []string
+	if pkg.Arch != "" {
+		qualifiers = append(qualifiers, "arch="+pkg.Arch)
+	}
+	if (pkg.Type == PackageTypeDeb || pkg.Type == PackageTypeAPK) && rel != nil && rel.VersionID != "" {
+		qualifiers = append(qualifiers, "distro="+rel.ID+"-"+rel.VersionID)
+	}
+	if len(qualifiers) > 0 {
+		purl += "?" + strings.Join(qualifiers, "&")
+	}
+	return purl
+}
+
+func parseOSRelease(data []byte) *OSRelease {
+	rel := &OSRelease{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(kv) != 2 || strings.HasPrefix(kv[0], "#") {
+			continue
+		}
+		v := kv[1]
+		if uq, err := strconv.Unquote(v); err == nil {
+			v = uq
+		} else {
+			v = strings.Trim(v, `'"`)
+		}
+		switch kv[0] {
+		case "ID":
+			rel.ID = v
+		case "ID_LIKE":
+			rel.IDLike = v
+		case "VERSION_ID":
+			rel.VersionID = v
+		case "VERSION_CODENAME":
+			rel.VersionCodename = v
+		case "PRETTY_NAME":
+			rel.PrettyName = v
+		}
+	}
+	return rel
+}
+
+// parseStanzas splits RFC 822 style paragraphs, like dpkg status files, into fields. Continuation lines are dropped.
+func parseStanzas(data []byte, sep string) []map[string]string {
+	var (
+		stanzas []map[string]string
+		cur     map[string]string
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			cur = nil
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		kv := strings.SplitN(line, sep, 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if cur == nil {
+			cur = map[string]string{}
+			stanzas = append(stanzas, cur)
+		}
+		cur[kv[0]] = strings.TrimSpace(kv[1])
+	}
+	return stanzas
+}
+
+// parseDpkgStatus reads a dpkg status file. Only installed packages are listed.
+func parseDpkgStatus(_ string, data []byte) ([]Package, error) {
+	var pkgs []Package
+	for _, s := range parseStanzas(data, ":") {
+		if s["Package"] == "" {
+			continue
+		}
+		if status, ok := s["Status"]; ok && !strings.HasSuffix(status, " installed") {
+			continue
+		}
+		pkg := Package{Name: s["Package"], Version: s["Version"], Type: PackageTypeDeb, Arch: s["Architecture"]}
+		// Source may carry the source version, e.g. "glibc (2.36-9)"
+		if src := strings.Fields(s["Source"]); len(src) > 0 && src[0] != pkg.Name {
+			pkg.SourcePackage = src[0]
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
+
+// parseAPKInstalled reads the alpine package database.
+// ref: https://wiki.alpinelinux.org/wiki/Apk_spec
+func parseAPKInstalled(_ string, data []byte) ([]Package, error) {
+	var pkgs []Package
+	for _, s := range parseStanzas(data, ":") {
+		if s["P"] == "" {
+			continue
+		}
+		pkg := Package{Name: s["P"], Version: s["V"], Type: PackageTypeAPK, Arch: s["A"], License: s["L"]}
+		if s["o"] != pkg.Name {
+			pkg.SourcePackage = s["o"]
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
+
+// parsePythonMetadata reads the METADATA file of an installed Python distribution.
+func parsePythonMetadata(_ string, data []byte) ([]Package, error) {
+	stanzas := parseStanzas(data, ":")
+	if len(stanzas) == 0 || stanzas[0]["Name"] == "" {
+		return nil, fmt.Errorf("no package name")
+	}
+	s := stanzas[0]
+	return []Package{{Name: s["Name"], Version: s["Version"], Type: PackageTypePyPI, License: s["License"]}}, nil
+}
+
+// parseNPMLock reads an npm lockfile, version 1 with nested dependencies or version 2 and 3 with packages.
+func parseNPMLock(_ string, data []byte) ([]Package, error) {
+	type dependency struct {
+		Version      string                     `json:"version"`
+		Dependencies map[string]json.RawMessage `json:"dependencies"`
+	}
+	var lock struct {
+		Packages     map[string]dependency      `json:"packages"`
+		Dependencies map[string]json.RawMessage `json:"dependencies"`
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+
+	var pkgs []Package
+	if len(lock.Packages) > 0 {
+		for p, dep := range lock.Packages {
+			i := strings.LastIndex(p, "node_modules/")
+			if i < 0 || dep.Version == "" {
+				continue
+			}
+			pkgs = append(pkgs, Package{Name: p[i+len("node_modules/"):], Version: dep.Version, Type: PackageTypeNPM})
+		}
+	} else {
+		var walk func(deps map[string]json.RawMessage)
+		walk = func(deps map[string]json.RawMessage) {
+			for name, raw := range deps {
+				var dep dependency
+				if json.Unmarshal(raw, &dep) != nil {
+					continue
+				}
+				pkgs = append(pkgs, Package{Name: name, Version: dep.Version, Type: PackageTypeNPM})
+				walk(dep.Dependencies)
+			}
+		}
+		walk(lock.Dependencies)
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].Name < pkgs[j].Name })
+	return pkgs, nil
+}
+
+// parseCargoLock reads the [[package]] tables of a Cargo lockfile.
+func parseCargoLock(_ string, data []byte) ([]Package, error) {
+	var (
+		pkgs []Package
+		cur  *Package
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "[[package]]" {
+			pkgs = append(pkgs, Package{Type: PackageTypeCargo})
+			cur = &pkgs[len(pkgs)-1]
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			cur = nil
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if cur == nil || len(kv) != 2 {
+			continue
+		}
+		v, _ := strconv.Unquote(strings.TrimSpace(kv[1]))
+		switch strings.TrimSpace(kv[0]) {
+		case "name":
+			cur.Name = v
+		case "version":
+			cur.Version = v
+		}
+	}
+	return pkgs, nil
+}
+
+// parseGemfileLock reads the gems of the GEM section of a Bundler lockfile, indented by four spaces.
+func parseGemfileLock(_ string, data []byte) ([]Package, error) {
+	var (
+		pkgs []Package
+		gem  bool
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" && line[0] != ' ' {
+			gem = line == "GEM"
+			continue
+		}
+		if !gem || !strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "     ") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.HasPrefix(fields[1], "(") {
+			pkgs = append(pkgs, Package{Name: fields[0], Version: strings.Trim(fields[1], "()"), Type: PackageTypeGem})
+		}
+	}
+	return pkgs, nil
+}
+
+// parseComposerLock reads a PHP Composer lockfile.
+func parseComposerLock(_ string, data []byte) ([]Package, error) {
+	type pkg struct {
+		Name    string   `json:"name"`
+		Version string   `json:"version"`
+		License []string `json:"license"`
+	}
+	var lock struct {
+		Packages    []pkg `json:"packages"`
+		PackagesDev []pkg `json:"packages-dev"`
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	var pkgs []Package
+	for _, p := range append(lock.Packages, lock.PackagesDev...) {
+		pkgs = append(pkgs, Package{Name: p.Name, Version: p.Version, Type: PackageTypeComposer, License: strings.Join(p.License, " OR ")})
+	}
+	return pkgs, nil
+}
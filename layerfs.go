@@ -0,0 +1,263 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// FileEntry is a file of an image filesystem.
+type FileEntry struct {
+	Path     string      `json:"path"`
+	Size     int64       `json:"size"`
+	Mode     os.FileMode `json:"mode"`
+	Linkname string      `json:"linkname,omitempty"`
+	ModTime  time.Time   `json:"modTime"`
+	// Digest is the digest of the content of regular files.
+	Digest string `json:"digest,omitempty"`
+	// Layer is the digest of the layer the file comes from.
+	Layer string `json:"layer"`
+}
+
+// decompressLayer returns an uncompressed tar stream of a gzip, zstd or uncompressed layer. The
+// compression is detected from the content, since schema1 manifests do not record layer media types.
+func decompressLayer(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		d, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// walkLayer calls fn for every entry of the tar of layer d. Paths are cleaned and absolute. The
+// compressed stream is checked against d once the tar ends, so an error of fn skips the check.
+func walkLayer(result *PullResult, d digest.Digest, fn func(hdr *tar.Header, r io.Reader) error) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	hub, err := result.client()
+	if err != nil {
+		return err
+	}
+	rc, err := hub.DownloadLayer(result.Repository, d)
+	if err != nil {
+		return ClassifyError(err, "")
+	}
+	defer rc.Close()
+
+	verifier := d.Verifier()
+	compressed := io.TeeReader(rc, verifier)
+	r, err := decompressLayer(compressed)
+	if err != nil {
+		return fmt.Errorf("layer %s: %v", d, err)
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("layer %s: %v", d, err)
+		}
+		hdr.Name = path.Clean("/" + hdr.Name)
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+
+	// the decompressor stops reading before it is closed; the tar may end before the compressed stream does
+	r.Close()
+	if _, err := io.Copy(ioutil.Discard, compressed); err != nil {
+		return fmt.Errorf("layer %s: %v", d, err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("layer %s does not match its digest", d)
+	}
+	return nil
+}
+
+// ImageFiles builds the filesystem of a pulled image by applying its layers in order, honouring
+// OCI whiteouts: ".wh.NAME" removes NAME of lower layers and ".wh..wh..opq" empties its directory.
+func ImageFiles(result *PullResult) (map[string]*FileEntry, error) {
+	files := map[string]*FileEntry{}
+	for _, d := range layerDigests(result.Manifest) {
+		var (
+			entries   []*FileEntry
+			whiteouts []string
+			opaque    []string
+		)
+		err := walkLayer(result, d, func(hdr *tar.Header, r io.Reader) error {
+			dir, base := path.Split(hdr.Name)
+			switch {
+			case base == whiteoutOpaque:
+				opaque = append(opaque, path.Clean(dir))
+			case strings.HasPrefix(base, whiteoutPrefix):
+				whiteouts = append(whiteouts, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			default:
+				e := &FileEntry{
+					Path:     hdr.Name,
+					Size:     hdr.Size,
+					Mode:     hdr.FileInfo().Mode(),
+					Linkname: hdr.Linkname,
+					ModTime:  hdr.ModTime,
+					Layer:    d.String(),
+				}
+				// the content is streamed past anyway, so hashing it is cheap
+				if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+					dgst, err := digest.FromReader(r)
+					if err != nil {
+						return fmt.Errorf("layer %s: %s: %v", d, hdr.Name, err)
+					}
+					e.Digest = dgst.String()
+				}
+				entries = append(entries, e)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// whiteouts only hide files of lower layers, so they are applied before this layer's files are added
+		for _, dir := range opaque {
+			removeTree(files, dir, false)
+		}
+		for _, p := range whiteouts {
+			removeTree(files, p, true)
+		}
+		for _, e := range entries {
+			if old, ok := files[e.Path]; ok && old.Mode.IsDir() && !e.Mode.IsDir() {
+				removeTree(files, e.Path, false)
+			}
+			files[e.Path] = e
+		}
+	}
+	return files, nil
+}
+
+// removeTree deletes everything below p, and p itself if self is set.
+func removeTree(files map[string]*FileEntry, p string, self bool) {
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for name := range files {
+		if strings.HasPrefix(name, prefix) || (self && name == p) {
+			delete(files, name)
+		}
+	}
+}
+
+// maxSymlinks bounds the symlinks followed when resolving a path, like the kernel's limit.
+const maxSymlinks = 40
+
+// resolvePath follows symlinks in every component of p within the image filesystem.
+func resolvePath(files map[string]*FileEntry, p string) (string, error) {
+	p = path.Clean("/" + p)
+	links := 0
+	resolved := "/"
+	rest := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		if name == "" {
+			continue
+		}
+		next := path.Join(resolved, name)
+		e, ok := files[next]
+		if !ok || e.Mode&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", p)
+		}
+		target := e.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+		rest = append(strings.Split(strings.TrimPrefix(path.Clean(target), "/"), "/"), rest...)
+		resolved = "/"
+	}
+	return resolved, nil
+}
+
+// CopyFile writes the content of file p of a pulled image to w.
+func CopyFile(result *PullResult, files map[string]*FileEntry, p string, w io.Writer) error {
+	resolved, err := resolvePath(files, p)
+	if err != nil {
+		return err
+	}
+	e, ok := files[resolved]
+	if !ok {
+		return fmt.Errorf("%s: no such file in image %s", p, result.Image)
+	}
+	// hard links point to a file of the same layer
+	name := resolved
+	if e.Linkname != "" && e.Mode&os.ModeSymlink == 0 {
+		name = path.Clean("/" + e.Linkname)
+	}
+	if !e.Mode.IsRegular() && e.Linkname == "" {
+		return fmt.Errorf("%s: not a regular file", p)
+	}
+
+	// the content is only written to w once the whole layer is verified
+	tmp, err := ioutil.TempFile("", "layer-file")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	found := false
+	err = walkLayer(result, digest.Digest(e.Layer), func(hdr *tar.Header, r io.Reader) error {
+		if found || hdr.Name != name || hdr.Typeflag == tar.TypeLink {
+			return nil
+		}
+		found = true
+		_, err := io.Copy(tmp, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%s: not found in layer %s", p, e.Layer)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, tmp)
+	return err
+}
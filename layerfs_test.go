@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// compressedLayer returns a tar of files compressed with gzip or zstd. The tar reader stops at the
+// end-of-archive blocks, before the end of the compressed stream.
+func compressedLayer(t *testing.T, compression string, files map[string]string) []byte {
+	var buf bytes.Buffer
+	var zw io.WriteCloser = gzip.NewWriter(&buf)
+	if compression == "zstd" {
+		var err error
+		if zw, err = zstd.NewWriter(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw := tar.NewWriter(zw)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	zw.Close()
+	return buf.Bytes()
+}
+
+// fakeBlobRegistry serves blobs by digest, without authentication.
+func fakeBlobRegistry(blobs map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := strings.LastIndex(r.URL.Path, "/blobs/")
+		data, ok := blobs[r.URL.Path[i+len("/blobs/"):]]
+		if i < 0 || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+}
+
+func TestWalkLayerVerifiesDigest(t *testing.T) {
+	for _, compression := range []string{"gzip", "zstd"} {
+		layer := compressedLayer(t, compression, map[string]string{"etc/version": "1.0"})
+		good := digest.FromBytes(layer)
+		tampered := digest.FromString("other layer")
+		srv := fakeBlobRegistry(map[string][]byte{good.String(): layer, tampered.String(): layer})
+		result := &PullResult{Repository: "team/app", auth: &AuthConfig{ServerAddress: srv.URL}}
+
+		var content string
+		err := walkLayer(result, good, func(hdr *tar.Header, r io.Reader) error {
+			data, err := ioutil.ReadAll(r)
+			content = hdr.Name + "=" + string(data)
+			return err
+		})
+		if err != nil {
+			t.Errorf("%s: %v", compression, err)
+		}
+		if content != "/etc/version=1.0" {
+			t.Errorf("%s: walked %q, want /etc/version=1.0", compression, content)
+		}
+
+		err = walkLayer(result, tampered, func(hdr *tar.Header, r io.Reader) error { return nil })
+		if err == nil || !strings.Contains(err.Error(), "does not match its digest") {
+			t.Errorf("%s: err = %v, want a digest mismatch", compression, err)
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	core "k8s.io/api/core/v1"
+)
+
+// ListFiles returns the entries of the image filesystem at and below dir, sorted by path.
+func ListFiles(files map[string]*FileEntry, dir string) ([]*FileEntry, error) {
+	resolved, err := resolvePath(files, dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimSuffix(resolved, "/") + "/"
+
+	var entries []*FileEntry
+	for p, e := range files {
+		if p == resolved || strings.HasPrefix(p, prefix) {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 && resolved != "/" {
+		return nil, fmt.Errorf("%s: no such file or directory", dir)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// pullImageFiles pulls img and builds its filesystem, exiting on errors like the other commands.
+func pullImageFiles(img string, pullSecrets []core.Secret) (*PullResult, map[string]*FileEntry) {
+	result, err := PullImage(img, pullSecrets)
+	if err != nil {
+		regErr := ClassifyError(err, result.MediaType)
+		fmt.Fprintln(os.Stderr, regErr.Error())
+		os.Exit(regErr.ExitCode())
+	}
+	files, err := ImageFiles(result)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return result, files
+}
+
+func runLs(img, dir string, pullSecrets []core.Secret, output string) {
+	_, files := pullImageFiles(img, pullSecrets)
+	entries, err := ListFiles(files, dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if output == "json" {
+		data, _ := json.MarshalIndent(entries, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.AlignRight)
+	for _, e := range entries {
+		name := e.Path
+		if e.Linkname != "" {
+			name += " -> " + e.Linkname
+		}
+		fmt.Fprintf(w, "%s\t%d\t %s\t %s\n", e.Mode, e.Size, e.ModTime.Format("2006-01-02 15:04"), name)
+	}
+	w.Flush()
+}
+
+func runCat(img, file string, pullSecrets []core.Secret) {
+	result, files := pullImageFiles(img, pullSecrets)
+	if err := CopyFile(result, files, path.Clean("/"+file), os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
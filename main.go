@@ -1,36 +1,37 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
-
-	"flag"
-	"net/url"
+	"time"
 
 	reg "github.com/appscode/docker-registry-client/registry"
+	"github.com/appscode/kutil/meta"
+	"github.com/docker/distribution/manifest"
 	manifestV1 "github.com/docker/distribution/manifest/schema1"
 	manifestV2 "github.com/docker/distribution/manifest/schema2"
 	"github.com/golang/glog"
 	"github.com/moul/http2curl"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"k8s.io/api/core/v1"
 	core "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 	"k8s.io/kubernetes/pkg/credentialprovider"
-	// Credential providers
-	"github.com/appscode/kutil/meta"
-	_ "k8s.io/kubernetes/pkg/credentialprovider/aws"
-	_ "k8s.io/kubernetes/pkg/credentialprovider/azure"
-	_ "k8s.io/kubernetes/pkg/credentialprovider/gcp"
-	// _ "k8s.io/kubernetes/pkg/credentialprovider/rancher" // enable in Kube 1.10
-	"net/http/httputil"
-
 	"k8s.io/kubernetes/pkg/util/parsers"
 )
 
@@ -46,6 +47,15 @@ func main() {
 		img            string = "tigerworks/nginx:1.13"
 		masterURL      string
 		kubeconfigPath string
+		output         string = "text"
+		pullPolicy     string = string(core.PullIfNotPresent)
+		diffFiles      bool
+		artifactType   string
+		fetchDir       string
+		policyFile     string
+		sbomFormat     string = SBOMFormatSPDX
+		advisoryDB     string
+		baseImages     []string
 	)
 	if !meta.PossiblyInCluster() {
 		kubeconfigPath = filepath.Join(homedir.HomeDir(), ".kube/config")
@@ -54,18 +64,149 @@ func main() {
 	flag.StringVar(&img, "image", img, "Name of docker image as used in a Kubernetes container")
 	flag.StringVar(&masterURL, "master", "", "The address of the Kubernetes API server (overrides any value in kubeconfig)")
 	flag.StringVar(&kubeconfigPath, "kubeconfig", kubeconfigPath, "Path to kubeconfig file")
+	flag.StringVar(&output, "output", output, "Output format, one of text or json")
+	flag.StringVar(&pullPolicy, "pull-policy", pullPolicy, "Image pull policy of the container, one of Always, IfNotPresent or Never")
+	flag.BoolVar(&diffFiles, "files", diffFiles, "Compare the file lists of the images in the diff command, downloading all layers")
+	flag.StringVar(&artifactType, "artifact-type", artifactType, "Only list referrers of this artifact type in the referrers command")
+	flag.StringVar(&fetchDir, "fetch-dir", fetchDir, "Download the manifests and blobs of the referrers into this directory in the referrers command")
+	flag.StringVar(&policyFile, "policy", policyFile, "Path to a YAML policy file images are checked against by the pull and policy commands")
+	flag.StringVar(&sbomFormat, "sbom-format", sbomFormat, "Output format of the sbom command, one of spdx, cyclonedx or table")
+	flag.Var((*stringList)(&baseImages), "base-images", "Comma separated known base images the layers of images are matched against by the base command")
+	flag.StringVar(&advisoryDB, "advisory-db", advisoryDB, "Path to a directory or zip file of OSV advisories the scan command matches packages against")
+	transportOptions.AddFlags(flag.CommandLine)
+	retryOptions.AddFlags(flag.CommandLine)
+	providerOptions.AddFlags(flag.CommandLine)
+	watchOptions.AddFlags(flag.CommandLine)
+	controllerOptions.AddFlags(flag.CommandLine)
+	signatureOptions.AddFlags(flag.CommandLine)
+	schema1Options.AddFlags(flag.CommandLine)
+	prepullOptions.AddFlags(flag.CommandLine)
+	criOptions.AddFlags(flag.CommandLine)
+	flag.StringVar(&platform, "platform", platform, "Platform in os/arch[/variant] form that manifest lists and OCI image indexes resolve to")
+	flag.BoolVar(&forceOAuth, "oauth2", forceOAuth, "Request registry tokens with the OAuth2 password grant instead of basic auth")
 	flag.Parse()
 
-	config, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfigPath)
+	if output != "text" && output != "json" {
+		glog.Fatalf("Unknown output format %q", output)
+	}
+	rand.Seed(time.Now().UnixNano())
+
+	var err error
+	credentialProviders, err = providerOptions.NewCredentialProviders()
 	if err != nil {
-		glog.Fatalf("Could not get Kubernetes config: %s", err)
+		glog.Fatalln(err)
+	}
+	if policyFile != "" {
+		if policy, err = LoadPolicy(policyFile); err != nil {
+			glog.Fatalln(err)
+		}
+	}
+
+	kubeConfig := func() *rest.Config {
+		config, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfigPath)
+		if err != nil {
+			glog.Fatalf("Could not get Kubernetes config: %s", err)
+		}
+		return config
+	}
+	kubeClient := func() kubernetes.Interface {
+		return kubernetes.NewForConfigOrDie(kubeConfig())
+	}
+	pullSecrets := func() []v1.Secret {
+		pullSecrets, err := ListPullSecrets(kubeClient())
+		if err != nil {
+			glog.Fatalln(err)
+		}
+		return pullSecrets
 	}
 
-	kc := kubernetes.NewForConfigOrDie(config)
+	cmd := "pull"
+	if flag.NArg() > 0 {
+		cmd = flag.Arg(0)
+	}
+	switch cmd {
+	case "pull":
+		runPull(img, core.PullPolicy(pullPolicy), pullSecrets(), output)
+	case "diff":
+		if flag.NArg() != 3 {
+			glog.Fatalln("Usage: diff IMAGE_A IMAGE_B")
+		}
+		runDiff(flag.Arg(1), flag.Arg(2), pullSecrets(), diffFiles, output)
+	case "ls":
+		if flag.NArg() < 2 || flag.NArg() > 3 {
+			glog.Fatalln("Usage: ls IMAGE [PATH]")
+		}
+		dir := "/"
+		if flag.NArg() == 3 {
+			dir = flag.Arg(2)
+		}
+		runLs(flag.Arg(1), dir, pullSecrets(), output)
+	case "cat":
+		if flag.NArg() != 3 {
+			glog.Fatalln("Usage: cat IMAGE PATH")
+		}
+		runCat(flag.Arg(1), flag.Arg(2), pullSecrets())
+	case "inspect":
+		if flag.NArg() != 2 {
+			glog.Fatalln("Usage: inspect IMAGE")
+		}
+		runInspect(flag.Arg(1), pullSecrets(), output)
+	case "referrers":
+		if flag.NArg() != 2 {
+			glog.Fatalln("Usage: referrers IMAGE")
+		}
+		runReferrers(flag.Arg(1), pullSecrets(), artifactType, fetchDir, output)
+	case "sbom":
+		if flag.NArg() != 2 {
+			glog.Fatalln("Usage: sbom IMAGE")
+		}
+		runSBOM(flag.Arg(1), pullSecrets(), sbomFormat)
+	case "scan":
+		if flag.NArg() > 2 {
+			glog.Fatalln("Usage: scan [IMAGE]")
+		}
+		runScan(flag.Arg(1), advisoryDB, watchOptions, kubeClient, pullSecrets, controllerOptions.Namespace, output)
+	case "base":
+		if flag.NArg() > 2 {
+			glog.Fatalln("Usage: base [IMAGE]")
+		}
+		runBase(flag.Arg(1), baseImages, watchOptions, kubeClient, pullSecrets, controllerOptions.Namespace, output)
+	case "freshness":
+		if flag.NArg() > 2 {
+			glog.Fatalln("Usage: freshness [IMAGE]")
+		}
+		runFreshness(flag.Arg(1), watchOptions, kubeClient, pullSecrets, controllerOptions.Namespace, output)
+	case "prepull":
+		runPrepull(prepullOptions, watchOptions, kubeClient(), controllerOptions.Namespace, output)
+	case "node":
+		if flag.NArg() > 2 {
+			glog.Fatalln("Usage: node [IMAGE]")
+		}
+		runNode(criOptions, flag.Arg(1), core.PullPolicy(pullPolicy), watchOptions, kubeClient, pullSecrets, controllerOptions.Namespace, output)
+	case "policy":
+		runPolicy(watchOptions, kubeClient, pullSecrets, controllerOptions.Namespace, output)
+	case "size":
+		runSize(watchOptions, kubeClient, pullSecrets, controllerOptions.Namespace, output)
+	case "ratelimit":
+		runRateLimit(pullSecrets(), output)
+	case "providers":
+		runProviders(credentialProviders, output)
+	case "watch":
+		runWatch(watchOptions, kubeClient())
+	case "drift":
+		runDrift(kubeClient(), controllerOptions.Namespace, output)
+	case "controller":
+		runController(controllerOptions, kubeConfig())
+	default:
+		glog.Fatalf("Unknown command %q", cmd)
+	}
+}
 
+// ListPullSecrets returns the image pull secrets of all namespaces.
+func ListPullSecrets(kc kubernetes.Interface) ([]v1.Secret, error) {
 	secrets, err := kc.CoreV1().Secrets(metav1.NamespaceAll).List(metav1.ListOptions{})
 	if err != nil {
-		glog.Fatalln(err)
+		return nil, err
 	}
 
 	var pullSecrets []v1.Secret
@@ -74,12 +215,47 @@ func main() {
 			pullSecrets = append(pullSecrets, sec)
 		}
 	}
+	return pullSecrets, nil
+}
+
+func runPull(img string, pullPolicy core.PullPolicy, pullSecrets []v1.Secret, output string) {
+	var (
+		result *PullResult
+		err    error
+	)
+	if pullPolicy == core.PullNever {
+		// the kubelet never contacts a registry for these containers
+		result = &PullResult{Image: img}
+		err = newRegistryError(CategoryNeverPull, fmt.Errorf("container image %q is not present with pull policy of Never", img))
+	} else {
+		result, err = PullImage(img, pullSecrets)
+	}
+	if err == nil {
+		err = checkSchema1(result)
+	}
+	if err == nil && signatureOptions.Enabled() {
+		err = checkSignature(result)
+	}
+	if err == nil {
+		err = checkPolicy(result)
+	}
 
-	mf2, err := PullImage(img, pullSecrets)
+	exitCode := 0
 	if err != nil {
-		glog.Fatalln(err)
+		regErr := ClassifyError(err, result.MediaType)
+		result.Error, result.Reason = regErr.Error(), regErr.Reason
+		exitCode = regErr.ExitCode()
+	}
+	if output == "json" {
+		data, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(data))
+		os.Exit(exitCode)
 	}
-	switch manifest := mf2.(type) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, result.Error)
+		os.Exit(exitCode)
+	}
+	switch manifest := result.Manifest.(type) {
 	case *manifestV2.DeserializedManifest:
 		data, _ := manifest.MarshalJSON()
 		fmt.Println("V2 Manifest:", string(data))
@@ -87,25 +263,85 @@ func main() {
 		data, _ := manifest.MarshalJSON()
 		fmt.Println("V1 Manifest:", string(data))
 	}
+	if s1 := result.Schema1; s1 != nil {
+		var ids []string
+		for _, k := range s1.Keys {
+			ids = append(ids, k.KeyID)
+		}
+		switch {
+		case s1.Trusted:
+			fmt.Println("Schema1 (deprecated) signed by trusted key:", strings.Join(ids, ", "))
+		case s1.Verified:
+			fmt.Println("Schema1 (deprecated) signed by untrusted keys, unsigned-equivalent:", strings.Join(ids, ", "))
+		default:
+			fmt.Println("Schema1 (deprecated) signature invalid, unsigned-equivalent:", s1.Error)
+		}
+	}
+	if sig := result.Signature; sig != nil {
+		if sig.Verified {
+			fmt.Printf("Signature verified by %s (%s) from %s %s\n", sig.Signer, sig.KeyFingerprint, sig.Source, sig.SignatureRef)
+		} else {
+			fmt.Println("Signature not verified:", sig.Error)
+		}
+	}
+	if e := result.Policy; e != nil {
+		for _, v := range e.Violations {
+			if v.Enforcement == EnforcementWarn {
+				fmt.Printf("Policy warning (%s): %s\n", v.Rule, v.Message)
+			}
+		}
+	}
+	if rl := result.RateLimit; rl != nil {
+		fmt.Printf("Docker Hub pulls remaining: %d/%d\n", rl.Remaining, rl.Limit)
+	}
 }
 
 // ref: https://github.com/kubernetes/kubernetes/blob/release-1.9/pkg/kubelet/kuberuntime/kuberuntime_image.go#L29
 
+// PullResult is the structured outcome of pulling an image manifest.
+type PullResult struct {
+	Image      string      `json:"image"`
+	Registry   string      `json:"registry"`
+	Repository string      `json:"repository"`
+	Reference  string      `json:"reference"`
+	Manifest   interface{} `json:"manifest,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Reason     string      `json:"reason,omitempty"`
+	// CredentialSource is the pull secret, node provider or anonymous access the manifest was pulled with.
+	CredentialSource string `json:"credentialSource,omitempty"`
+	// Errors holds the classified error of every credential that was tried.
+	Errors []*RegistryError `json:"errors,omitempty"`
+	// Signature is the outcome of verifying the image signatures, if requested.
+	Signature *SignatureVerification `json:"signature,omitempty"`
+	// Schema1 is the outcome of verifying the JWS signatures of a schema1 manifest.
+	Schema1 *Schema1Verification `json:"schema1,omitempty"`
+	// Policy is the outcome of checking the image against -policy.
+	Policy *PolicyEvaluation `json:"policy,omitempty"`
+	Trace
+
+	// auth are the credentials the manifest was pulled with
+	auth *AuthConfig
+}
+
 // PullImage pulls an image from the network to local storage using the supplied secrets if necessary.
-func PullImage(img string, pullSecrets []v1.Secret) (interface{}, error) {
+// The returned result is never nil, so callers can report what happened even when the pull failed.
+func PullImage(img string, pullSecrets []v1.Secret) (*PullResult, error) {
+	result := &PullResult{Image: img}
+
 	repoToPull, tag, digest, err := parsers.ParseImageName(img)
 	if err != nil {
-		return nil, err
+		return result, err
 	}
 
 	parts := strings.SplitN(repoToPull, "/", 2)
 	regURL := parts[0]
 	repo := parts[1]
-	fmt.Println(regURL, repo, tag, digest)
+	glog.V(3).Infoln(regURL, repo, tag, digest)
 	ref := tag
 	if ref == "" {
 		ref = digest
 	}
+	result.Registry, result.Repository, result.Reference = regURL, repo, ref
 
 	if strings.HasPrefix(regURL, "docker.io") || strings.HasPrefix(regURL, "index.docker.io") {
 		regURL = "registry-1.docker.io"
@@ -115,21 +351,36 @@ func PullImage(img string, pullSecrets []v1.Secret) (interface{}, error) {
 	}
 	_, err = url.Parse(regURL)
 	if err != nil {
-		return nil, err
+		return result, err
 	}
 
-	keyring, err := credentialprovider.MakeDockerKeyring(pullSecrets, credentialprovider.NewDockerKeyring())
+	keyring, err := credentialprovider.MakeDockerKeyring(pullSecrets, credentialProviders.Keyring())
 	if err != nil {
-		return nil, err
+		return result, err
 	}
 
+	identityTokens := NewIdentityTokens(pullSecrets)
+
 	creds, withCredentials := keyring.Lookup(repoToPull)
 	if !withCredentials {
 		glog.V(3).Infof("Pulling image %q without credentials", img)
-		return PullManifest(repo, ref, &AuthConfig{ServerAddress: regURL})
+		result.CredentialSource = credentialSourceAnonymous
+		auth := &AuthConfig{ServerAddress: regURL}
+		result.Manifest, err = PullManifest(repo, ref, auth, &result.Trace)
+		recordCredentialSource(result.CredentialSource, err)
+		if err != nil {
+			regErr := ClassifyError(err, result.MediaType)
+			regErr.Source = result.CredentialSource
+			result.Errors = append(result.Errors, regErr)
+			return result, regErr
+		}
+		result.auth = auth
+		return result, nil
 	}
 
-	var pullErrs []error
+	sources := credentialSources(repoToPull, pullSecrets, credentialProviders)
+
+	var pullErrs []*RegistryError
 	for _, currentCreds := range creds {
 		authConfig := credentialprovider.LazyProvide(currentCreds)
 		auth := &AuthConfig{
@@ -137,29 +388,188 @@ func PullImage(img string, pullSecrets []v1.Secret) (interface{}, error) {
 			Password:      authConfig.Password,
 			Auth:          authConfig.Auth,
 			ServerAddress: authConfig.ServerAddress,
+			IdentityToken: authConfig.IdentityToken,
+			RegistryToken: authConfig.RegistryToken,
 		}
 		if auth.ServerAddress == "" {
 			auth.ServerAddress = regURL
 		}
+		if auth.IdentityToken == "" {
+			auth.IdentityToken = identityTokens.Lookup(regURL, auth.Username)
+		}
 
-		mf, err := PullManifest(repo, ref, auth)
+		source := sources.Lookup(auth.Username, auth.Password)
+		mf, err := PullManifest(repo, ref, auth, &result.Trace)
+		recordCredentialSource(source, err)
 		if err == nil {
-			return mf, nil
+			result.Manifest = mf
+			result.CredentialSource = source
+			result.auth = auth
+			return result, nil
 		}
-		pullErrs = append(pullErrs, err)
+		regErr := ClassifyError(err, result.MediaType)
+		regErr.Source = source
+		pullErrs = append(pullErrs, regErr)
 	}
-	return nil, utilerrors.NewAggregate(pullErrs)
+	result.Errors = pullErrs
+	if len(pullErrs) == 0 {
+		return result, fmt.Errorf("no usable credentials for image %q", img)
+	}
+	return result, mostActionable(pullErrs)
+}
+
+var (
+	// transportOptions configures the connections PullManifest makes to registries.
+	transportOptions = NewTransportOptions()
+	// retryOptions controls retries of failed registry requests.
+	retryOptions = NewRetryOptions()
+	// forceOAuth requests tokens with the OAuth2 password grant.
+	forceOAuth bool
+	// providerOptions selects the node credential providers.
+	providerOptions = NewProviderOptions()
+	// watchOptions configures the watch command.
+	watchOptions = NewWatchOptions()
+	// controllerOptions configures the controller command.
+	controllerOptions = NewControllerOptions()
+	// signatureOptions configures the verification of image signatures.
+	signatureOptions = NewSignatureOptions()
+	// schema1Options configures the verification of schema1 manifest signatures.
+	schema1Options = NewSchema1Options()
+	// prepullOptions configures the prepull command.
+	prepullOptions = NewPrepullOptions()
+	// criOptions configures the node command.
+	criOptions = NewCRIOptions()
+	// platform is the os/arch[/variant] manifest lists and OCI image indexes resolve to.
+	platform = "linux/" + runtime.GOARCH
+	// policy is the admission policy images are checked against, if -policy is set.
+	policy *Policy
+)
+
+// PullManifest fetches the manifest of repo:ref, recording retries and other wire events in trace if it is not nil.
+// Errors are returned as *RegistryError.
+func PullManifest(repo, ref string, auth *AuthConfig, trace *Trace) (interface{}, error) {
+	if trace == nil {
+		trace = &Trace{}
+	}
+	defer observeDuration(manifestFetchDuration, auth.ServerAddress, time.Now())
+	hub, err := NewRegistry(auth, trace, RepositoryScope(repo, "pull"))
+	if err != nil {
+		return nil, newRegistryError(CategoryUnknown, err)
+	}
+	mf, err := fetchManifest(hub, repo, ref, trace)
+	if err != nil {
+		return nil, ClassifyError(err, trace.MediaType)
+	}
+	return mf, nil
 }
 
-func PullManifest(repo, ref string, auth *AuthConfig) (interface{}, error) {
-	hub := &reg.Registry{
+// fetchManifest fetches a schema2, OCI or schema1 manifest. The registry client only accepts the Docker
+// media types; OCI image manifests have the format of schema2 manifests, so they are decoded as such.
+// Manifest lists and OCI image indexes are recorded in trace and resolved to the manifest of -platform.
+func fetchManifest(hub *reg.Registry, repo, ref string, trace *Trace) (interface{}, error) {
+	trace.Index, trace.IndexDigest, trace.IndexMediaType = nil, "", ""
+	mf, idx, err := decodeManifest(hub, repo, ref, trace)
+	if err != nil || idx == nil {
+		return mf, err
+	}
+	trace.Index, trace.IndexDigest, trace.IndexMediaType = idx, trace.Digest, mediaTypeOf(trace.MediaType)
+	d, err := selectPlatform(idx, platform)
+	if err != nil {
+		return nil, err
+	}
+	if mf, idx, err = decodeManifest(hub, repo, d.Digest.String(), trace); err != nil {
+		return nil, err
+	}
+	if idx != nil {
+		return nil, fmt.Errorf("manifest %s of platform %s is an image index", d.Digest, platform)
+	}
+	return mf, nil
+}
+
+// decodeManifest fetches the manifest or image index of repo:ref and records its digest in trace.
+// The content is verified against ref if it is a digest, and against the Docker-Content-Digest header.
+func decodeManifest(hub *reg.Registry, repo, ref string, trace *Trace) (interface{}, *ocispec.Index, error) {
+	trace.contentDigest = ""
+	data, err := fetchJSON(hub, manifestURL(hub, repo, ref),
+		manifestV2.MediaTypeManifest, ocispec.MediaTypeImageManifest, mediaTypeManifestList, ocispec.MediaTypeImageIndex,
+		manifestV1.MediaTypeSignedManifest, manifestV1.MediaTypeManifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	var versioned manifest.Versioned
+	if err := json.Unmarshal(data, &versioned); err != nil {
+		return nil, nil, err
+	}
+
+	var mf interface{}
+	var idx *ocispec.Index
+	// the digest of a signed schema1 manifest is that of its payload without the signatures
+	content := data
+	switch {
+	case versioned.SchemaVersion == 1:
+		m := &manifestV1.SignedManifest{}
+		if err := m.UnmarshalJSON(data); err != nil {
+			return nil, nil, err
+		}
+		mf = m
+		if len(m.Canonical) > 0 {
+			content = m.Canonical
+		}
+	case isIndexMediaType(versioned.MediaType) || isIndexMediaType(mediaTypeOf(trace.MediaType)):
+		idx = &ocispec.Index{}
+		if err := json.Unmarshal(data, idx); err != nil {
+			return nil, nil, err
+		}
+	default:
+		m := &manifestV2.DeserializedManifest{}
+		if err := m.UnmarshalJSON(data); err != nil {
+			return nil, nil, err
+		}
+		mf = m
+	}
+
+	dgst := digest.FromBytes(content)
+	for _, expected := range []string{trace.contentDigest, ref} {
+		d, err := digest.Parse(expected)
+		if err != nil {
+			// tags, and registries that send no or invalid Docker-Content-Digest headers
+			continue
+		}
+		verifier := d.Verifier()
+		verifier.Write(content)
+		if !verifier.Verified() {
+			return nil, nil, newRegistryError(CategoryInvalidManifest, fmt.Errorf("manifest of %s:%s does not match digest %s", repo, ref, d))
+		}
+		dgst = d
+	}
+	trace.Digest = dgst.String()
+	return mf, idx, nil
+}
+
+// mediaTypeOf strips the parameters of a Content-Type.
+func mediaTypeOf(contentType string) string {
+	return strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+}
+
+// NewRegistry returns a registry client for auth.ServerAddress using the configured transport and retry options.
+// Tokens are requested for the scopes demanded by the registry plus the given scopes.
+func NewRegistry(auth *AuthConfig, trace *Trace, scopes ...string) (*reg.Registry, error) {
+	rt, err := transportOptions.TransportFor(auth.ServerAddress)
+	if err != nil {
+		return nil, err
+	}
+	return &reg.Registry{
 		URL: auth.ServerAddress,
 		Client: &http.Client{
-			Transport: reg.WrapTransport(CC(http.DefaultTransport), auth.ServerAddress, auth.Username, auth.Password),
+			Transport: wrapTransport(&retryTransport{
+				Transport: &traceTransport{Transport: CC(rt), Trace: trace},
+				Options:   retryOptions,
+				Trace:     trace,
+			}, auth, scopes),
+			Timeout: transportOptions.RequestTimeout,
 		},
 		Logf: reg.Log,
-	}
-	return hub.ManifestVx(repo, ref)
+	}, nil
 }
 
 // AuthConfig contains authorization information for connecting to a registry.
@@ -168,6 +578,10 @@ type AuthConfig struct {
 	Password      string
 	Auth          string
 	ServerAddress string
+	// IdentityToken is an OAuth2 refresh token used to request registry tokens.
+	IdentityToken string
+	// RegistryToken is a bearer token sent to the registry as is.
+	RegistryToken string
 }
 
 func CC(t http.RoundTripper) http.RoundTripper {
@@ -179,17 +593,15 @@ type logTransport struct {
 }
 
 func (t *logTransport) RoundTrip(request *http.Request) (*http.Response, error) {
-	cmd, _ := http2curl.GetCurlCommand(request)
-	fmt.Println(cmd)
 	if glog.V(10) {
 		cmd, _ := http2curl.GetCurlCommand(request)
 		glog.Infoln("request:", cmd)
 	}
 	resp, err := t.Transport.RoundTrip(request)
-	if err == nil {
+	if err == nil && glog.V(10) {
 		b, err := httputil.DumpResponse(resp, true)
 		if err == nil {
-			fmt.Println(string(b))
+			glog.Infoln("response:", string(b))
 		}
 	}
 	return resp, err
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	reg "github.com/appscode/docker-registry-client/registry"
+	manifestV2 "github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+)
+
+const testManifest = `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json",` +
+	`"config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":2,"digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"},"layers":[]}`
+
+// fakeManifestRegistry serves body for every manifest, with headerDigest as its Docker-Content-Digest.
+func fakeManifestRegistry(body, headerDigest string) (*httptest.Server, *reg.Registry, *Trace) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", manifestV2.MediaTypeManifest)
+		if headerDigest != "" {
+			w.Header().Set("Docker-Content-Digest", headerDigest)
+		}
+		w.Write([]byte(body))
+	}))
+	trace := &Trace{}
+	hub := &reg.Registry{
+		URL:    srv.URL,
+		Client: &http.Client{Transport: &traceTransport{Transport: http.DefaultTransport, Trace: trace}},
+	}
+	return srv, hub, trace
+}
+
+func TestDecodeManifestDigest(t *testing.T) {
+	good := digest.FromString(testManifest).String()
+	other := digest.FromString("other").String()
+	tests := []struct {
+		name   string
+		ref    string
+		header string
+		err    bool
+	}{
+		{name: "tag without header", ref: "latest"},
+		{name: "tag with header", ref: "latest", header: good},
+		{name: "digest", ref: good, header: good},
+		{name: "header mismatch", ref: "latest", header: other, err: true},
+		{name: "ref mismatch", ref: other, header: good, err: true},
+		{name: "ref mismatch without header", ref: other, err: true},
+	}
+	for _, test := range tests {
+		srv, hub, trace := fakeManifestRegistry(testManifest, test.header)
+		_, _, err := decodeManifest(hub, "team/app", test.ref, trace)
+		srv.Close()
+		if test.err {
+			if e, ok := err.(*RegistryError); !ok || e.Category != CategoryInvalidManifest || !strings.Contains(e.Error(), "does not match") {
+				t.Errorf("%s: err = %v, want an InvalidManifest error", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if trace.Digest != good {
+			t.Errorf("%s: digest = %s, want the digest of the content %s", test.name, trace.Digest, good)
+		}
+	}
+}
@@ -11,6 +11,7 @@ IMG=docker-image-puller
 main() {
     pushd $REPO_ROOT
     echo "building alpine based binary ..."
+    # Go 1.13 is the oldest toolchain with crypto/ed25519, which signature verification needs
     docker run                                                              \
         --rm                                                                \
         -u $(id -u):$(id -g)                                                \
@@ -20,8 +21,8 @@ main() {
         -e GOOS=linux                                                       \
         -e GOARCH=amd64                                                     \
         -e CGO_ENABLED=0                                                    \
-        golang:1.10.0-alpine                                                \
-        go build -a -installsuffix cgo -o docker-image-puller main.go
+        golang:1.13-alpine                                                  \
+        go build -a -installsuffix cgo -o docker-image-puller .
 	chmod +x docker-image-puller
 
     echo "Building docker image..."
@@ -38,7 +39,7 @@ main() {
 
 main
 
-# go build -v -o docker-image-puller main.go
+# go build -v -o docker-image-puller .
 # chmod +x docker-image-puller
 
 # docker build -t appscode/docker-image-puller .
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "image_puller"
+
+var (
+	checksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "checks_total",
+		Help:      "Image pull checks by result, kubelet reason and error category.",
+	}, []string{"result", "reason", "category"})
+
+	manifestFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "manifest_fetch_duration_seconds",
+		Help:      "Latency of manifest fetches by registry host, including authentication and retries.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"registry"})
+
+	tokenFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_fetch_duration_seconds",
+		Help:      "Latency of registry token requests by token server host.",
+		Buckets:   prometheus.ExponentialBuckets(0.025, 2, 10),
+	}, []string{"realm"})
+
+	retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "retries_total",
+		Help:      "Retry decisions for failed registry requests by registry host and decision.",
+	}, []string{"registry", "decision"})
+
+	rateLimitRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ratelimit_remaining",
+		Help:      "Docker Hub pulls remaining by credential source.",
+	}, []string{"source"})
+
+	credentialSourceTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "credential_source_total",
+		Help:      "Manifest pulls by credential source (pull secret, node provider or anonymous) and result.",
+	}, []string{"source", "result"})
+)
+
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+func init() {
+	prometheus.MustRegister(
+		checksTotal,
+		manifestFetchDuration,
+		tokenFetchDuration,
+		retriesTotal,
+		rateLimitRemaining,
+		credentialSourceTotal,
+	)
+}
+
+// recordCheck updates the metrics of a finished image check.
+func recordCheck(result *PullResult, err error) {
+	if err == nil {
+		checksTotal.WithLabelValues(resultSuccess, "", "").Inc()
+	} else {
+		regErr := ClassifyError(err, result.MediaType)
+		checksTotal.WithLabelValues(resultFailure, regErr.Reason, string(regErr.Category)).Inc()
+	}
+	if result.RateLimit != nil && result.CredentialSource != "" {
+		rateLimitRemaining.WithLabelValues(result.CredentialSource).Set(float64(result.RateLimit.Remaining))
+	}
+}
+
+// observeDuration records the time since start in the histogram for the host of address.
+func observeDuration(h *prometheus.HistogramVec, address string, start time.Time) {
+	host, err := registryHost(address)
+	if err != nil {
+		host = address
+	}
+	h.WithLabelValues(host).Observe(time.Since(start).Seconds())
+}
+
+// recordCredentialSource counts a manifest pull made with credentials from source.
+func recordCredentialSource(source string, err error) {
+	result := resultSuccess
+	if err != nil {
+		result = resultFailure
+	}
+	credentialSourceTotal.WithLabelValues(source, result).Inc()
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	goruntime "runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	manifestV2 "github.com/docker/distribution/manifest/schema2"
+	units "github.com/docker/go-units"
+	"github.com/golang/glog"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Statuses of an image on a node compared with what its registry serves.
+const (
+	NodeImageCurrent = "Current"
+	NodeImageStale   = "Stale"
+	NodeImageMissing = "Missing"
+	NodeImagePresent = "Present"
+	NodeImagePulled  = "Pulled"
+)
+
+// CRIOptions configures the node command, which checks the images of a node through the CRI ImageService.
+type CRIOptions struct {
+	Endpoint string
+	Node     string
+	// Pull pulls missing and stale images on the node.
+	Pull    bool
+	Timeout time.Duration
+}
+
+func NewCRIOptions() *CRIOptions {
+	return &CRIOptions{
+		Endpoint: "unix:///run/containerd/containerd.sock",
+		Node:     os.Getenv("NODE_NAME"),
+		Timeout:  5 * time.Minute,
+	}
+}
+
+func (o *CRIOptions) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Endpoint, "cri-endpoint", o.Endpoint, "Unix socket of the CRI ImageService of the node command, e.g. unix:///var/run/crio/crio.sock")
+	fs.StringVar(&o.Node, "node-name", o.Node, "Node whose Pods the node command checks, defaults to $NODE_NAME")
+	fs.BoolVar(&o.Pull, "cri-pull", o.Pull, "Pull missing and stale images through the CRI in the node command, with the credentials the keyring resolves")
+	fs.DurationVar(&o.Timeout, "cri-timeout", o.Timeout, "Timeout of CRI calls, including pulls")
+}
+
+// NodeImageCheck compares an image on a node with what its registry serves for the same reference,
+// and tells whether a container using it with its pull policy can start on the node.
+type NodeImageCheck struct {
+	Namespace  string `json:"namespace,omitempty"`
+	Pod        string `json:"pod,omitempty"`
+	Container  string `json:"container,omitempty"`
+	Image      string `json:"image"`
+	PullPolicy string `json:"pullPolicy"`
+	Status     string `json:"status"`
+	// NodeImageID is the image ID on the node, the digest of the image config.
+	NodeImageID     string   `json:"nodeImageID,omitempty"`
+	NodeRepoDigests []string `json:"nodeRepoDigests,omitempty"`
+	RegistryDigest  string   `json:"registryDigest,omitempty"`
+	RegistryImageID string   `json:"registryImageID,omitempty"`
+	PulledRef       string   `json:"pulledRef,omitempty"`
+	Startable       bool     `json:"startable"`
+	RegistryError   string   `json:"registryError,omitempty"`
+	CRIError        string   `json:"criError,omitempty"`
+}
+
+// normalizeImageID adds the algorithm to image IDs reported without one, as CRI-O does.
+func normalizeImageID(id string) string {
+	if id != "" && !strings.Contains(id, ":") {
+		return "sha256:" + id
+	}
+	return id
+}
+
+// CheckNodeImage looks up img on the node and in its registry, and pulls it on the node if it is
+// missing or stale and pull is set. Multi-platform images are compared with the manifest of the
+// platform of the node, in os/arch form.
+func CheckNodeImage(cri *CRIClient, img string, pullPolicy core.PullPolicy, pullSecrets []core.Secret, pull bool, nodePlatform string) *NodeImageCheck {
+	c := &NodeImageCheck{Image: img, PullPolicy: string(pullPolicy), Status: NodeImageMissing}
+	local, err := cri.ImageStatus(img)
+	if err != nil {
+		c.CRIError = err.Error()
+		return c
+	}
+
+	var result *PullResult
+	if pullPolicy != core.PullNever {
+		if result, err = PullImage(img, pullSecrets); err != nil {
+			c.RegistryError = ClassifyError(err, result.MediaType).Error()
+			result = nil
+		} else {
+			// runtimes record the digest of the image index in the repo digests of multi-platform images
+			c.RegistryDigest = result.Digest
+			if result.IndexDigest != "" {
+				c.RegistryDigest = result.IndexDigest
+			}
+			platformResult, err := pullPlatform(result, nodePlatform, pullSecrets)
+			if err != nil {
+				c.RegistryError = ClassifyError(err, platformResult.MediaType).Error()
+				result = nil
+			} else if mf, ok := platformResult.Manifest.(*manifestV2.DeserializedManifest); ok {
+				c.RegistryImageID = mf.Config.Digest.String()
+			}
+		}
+	}
+
+	compare := func() {
+		if local == nil {
+			c.Status = NodeImageMissing
+			return
+		}
+		c.NodeImageID, c.NodeRepoDigests = normalizeImageID(local.ID), local.RepoDigests
+		c.Status = NodeImagePresent
+		if result == nil {
+			return
+		}
+		c.Status = NodeImageStale
+		if c.RegistryImageID != "" {
+			if c.RegistryImageID == c.NodeImageID {
+				c.Status = NodeImageCurrent
+			}
+			return
+		}
+		// schema1 images have no config digest, compare the manifest digest
+		for _, d := range local.RepoDigests {
+			if i := strings.LastIndex(d, "@"); i >= 0 && d[i+1:] == c.RegistryDigest {
+				c.Status = NodeImageCurrent
+			}
+		}
+	}
+	compare()
+
+	if pull && result != nil && (c.Status == NodeImageMissing || c.Status == NodeImageStale) {
+		ref, err := cri.PullImage(img, result.auth)
+		if err != nil {
+			c.CRIError = err.Error()
+		} else {
+			c.PulledRef = ref
+			if local, err = cri.ImageStatus(img); err != nil {
+				c.CRIError = err.Error()
+			}
+			compare()
+			if c.Status == NodeImageCurrent {
+				c.Status = NodeImagePulled
+			}
+		}
+	}
+
+	// the kubelet pulls images with Always, with IfNotPresent only if they are missing
+	switch pullPolicy {
+	case core.PullNever:
+		c.Startable = local != nil
+	case core.PullAlways:
+		c.Startable = result != nil
+	default:
+		c.Startable = local != nil || result != nil
+	}
+	return c
+}
+
+// runNode checks img, or the images given with -images or -images-file, or else the containers of
+// the Pods scheduled to -node-name, against the container runtime of the node.
+func runNode(opts *CRIOptions, img string, pullPolicy core.PullPolicy, watchOpts *WatchOptions, kubeClient func() kubernetes.Interface, pullSecrets func() []core.Secret, namespace, output string) {
+	cri, err := NewCRIClient(opts.Endpoint, opts.Timeout)
+	if err != nil {
+		glog.Fatalln(err)
+	}
+	cached, err := cri.ListImages()
+	if err != nil {
+		glog.Fatalf("Could not list the images of the container runtime at %s: %s", opts.Endpoint, err)
+	}
+
+	// the node command runs on the node, unless the Node object tells otherwise
+	nodePlatform := goruntime.GOOS + "/" + goruntime.GOARCH
+	var checks []*NodeImageCheck
+	switch {
+	case img != "":
+		checks = append(checks, CheckNodeImage(cri, img, pullPolicy, pullSecrets(), opts.Pull, nodePlatform))
+	case len(watchOpts.Images) > 0 || watchOpts.ImagesFile != "":
+		images, err := watchOpts.images()
+		if err != nil {
+			glog.Fatalln(err)
+		}
+		secrets := pullSecrets()
+		for _, img := range images {
+			checks = append(checks, CheckNodeImage(cri, img, pullPolicy, secrets, opts.Pull, nodePlatform))
+		}
+	default:
+		if opts.Node == "" {
+			glog.Fatalln("The node command needs -node-name or $NODE_NAME to check the Pods of a node")
+		}
+		kc := kubeClient()
+		if node, err := kc.CoreV1().Nodes().Get(opts.Node, metav1.GetOptions{}); err != nil {
+			glog.Warningf("Could not get node %s, assuming platform %s: %s", opts.Node, nodePlatform, err)
+		} else if info := node.Status.NodeInfo; info.OperatingSystem != "" && info.Architecture != "" {
+			nodePlatform = info.OperatingSystem + "/" + info.Architecture
+		}
+		pods, err := kc.CoreV1().Pods(namespace).List(metav1.ListOptions{FieldSelector: "spec.nodeName=" + opts.Node})
+		if err != nil {
+			glog.Fatalln(err)
+		}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			secrets, _ := podPullSecrets(kc, pod)
+			containers := append(append([]core.Container(nil), pod.Spec.InitContainers...), pod.Spec.Containers...)
+			for _, container := range containers {
+				c := CheckNodeImage(cri, container.Image, container.ImagePullPolicy, secrets, opts.Pull, nodePlatform)
+				c.Namespace, c.Pod, c.Container = pod.Namespace, pod.Name, container.Name
+				checks = append(checks, c)
+			}
+		}
+	}
+
+	startable := true
+	for _, c := range checks {
+		startable = startable && c.Startable
+	}
+	if output == "json" {
+		data, _ := json.MarshalIndent(struct {
+			CachedImages []CRIImage        `json:"cachedImages"`
+			Checks       []*NodeImageCheck `json:"checks"`
+		}{cached, checks}, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		var size uint64
+		for _, i := range cached {
+			size += i.Size
+		}
+		fmt.Printf("Container runtime has %d images, %s\n", len(cached), units.HumanSize(float64(size)))
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "POD\tCONTAINER\tIMAGE\tPOLICY\tSTATUS\tNODE ID\tREGISTRY ID\tSTARTABLE\tERROR")
+		for _, c := range checks {
+			pod := "-"
+			if c.Pod != "" {
+				pod = c.Namespace + "/" + c.Pod
+			}
+			errMsg := c.CRIError
+			if errMsg == "" {
+				errMsg = c.RegistryError
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%t\t%s\n", pod, orDash(c.Container), c.Image, c.PullPolicy, c.Status,
+				orDash(shortDigest(c.NodeImageID)), orDash(shortDigest(c.RegistryImageID)), c.Startable, errMsg)
+		}
+		w.Flush()
+	}
+	if !startable {
+		os.Exit(1)
+	}
+}
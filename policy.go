@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	manifestV1 "github.com/docker/distribution/manifest/schema1"
+	units "github.com/docker/go-units"
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Enforcement levels of policy rules. Deny violations fail the check, warn violations are reported
+// and audit violations are only recorded in the structured output and the log.
+const (
+	EnforcementDeny  = "deny"
+	EnforcementWarn  = "warn"
+	EnforcementAudit = "audit"
+
+	// DecisionAllow is the decision for images without violations.
+	DecisionAllow = "allow"
+)
+
+var enforcementOrder = []string{EnforcementDeny, EnforcementWarn, EnforcementAudit, DecisionAllow}
+
+// enforcementRank orders enforcement levels from strictest to allow.
+func enforcementRank(level string) int {
+	for i, l := range enforcementOrder {
+		if l == level {
+			return i
+		}
+	}
+	return len(enforcementOrder)
+}
+
+// Policy is a set of rules images must follow.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule constrains the images matching Images, or all images if it is empty. Every set field is checked.
+type PolicyRule struct {
+	Name        string `json:"name"`
+	Enforcement string `json:"enforcement,omitempty"`
+	// Images are globs of registry/repository the rule applies to, e.g. docker.io/library/*.
+	Images []string `json:"images,omitempty"`
+
+	AllowedRegistries []string `json:"allowedRegistries,omitempty"`
+	// AllowedRepositories are globs of registry/repository.
+	AllowedRepositories []string `json:"allowedRepositories,omitempty"`
+	// ForbidLatest rejects the latest tag and references without a tag, which default to latest.
+	ForbidLatest  bool `json:"forbidLatest,omitempty"`
+	RequireDigest bool `json:"requireDigest,omitempty"`
+	// MaxAge is the maximum age of the image, from the created field of its config.
+	MaxAge *Duration `json:"maxAge,omitempty"`
+	// MaxSize is the maximum compressed size, e.g. 500MB.
+	MaxSize string `json:"maxSize,omitempty"`
+	// RequiredLabels are label keys, or key=value pairs, the image config must have.
+	RequiredLabels  []string `json:"requiredLabels,omitempty"`
+	DisallowSchema1 bool     `json:"disallowSchema1,omitempty"`
+	// RequireSignature requires a cosign signature verified with -signature-keys, or a schema1
+	// signature by one of -schema1-trusted-keys.
+	RequireSignature bool `json:"requireSignature,omitempty"`
+
+	maxSize int64
+}
+
+// LoadPolicy reads a YAML or JSON policy file.
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy %s: %v", file, err)
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i)
+		}
+		switch r.Enforcement {
+		case "":
+			r.Enforcement = EnforcementDeny
+		case EnforcementDeny, EnforcementWarn, EnforcementAudit:
+		default:
+			return nil, fmt.Errorf("policy rule %s has unknown enforcement %q", r.Name, r.Enforcement)
+		}
+		if r.MaxSize != "" {
+			if r.maxSize, err = units.FromHumanSize(r.MaxSize); err != nil {
+				return nil, fmt.Errorf("policy rule %s: invalid maxSize: %v", r.Name, err)
+			}
+		}
+		for _, globs := range [][]string{r.Images, r.AllowedRepositories} {
+			for _, glob := range globs {
+				if _, err := path.Match(glob, ""); err != nil {
+					return nil, fmt.Errorf("policy rule %s: invalid glob %q", r.Name, glob)
+				}
+			}
+		}
+	}
+	return &p, nil
+}
+
+// Violation is a broken policy rule.
+type Violation struct {
+	Rule        string `json:"rule"`
+	Enforcement string `json:"enforcement"`
+	Message     string `json:"message"`
+}
+
+// PolicyEvaluation is the outcome of checking an image against a policy.
+type PolicyEvaluation struct {
+	// Decision is the strictest enforcement level of the violations, or allow.
+	Decision   string      `json:"decision"`
+	Violations []Violation `json:"violations,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// Denied reports whether a deny rule was violated.
+func (e *PolicyEvaluation) Denied() bool {
+	return e.Decision == EnforcementDeny
+}
+
+// imageFacts are the properties of a pulled image rules check. The config, size and signature are fetched on demand.
+type imageFacts struct {
+	result *PullResult
+	config *ImageConfig
+	size   int64
+}
+
+func (f *imageFacts) imageConfig() (*ImageConfig, error) {
+	if f.config == nil {
+		cfg, err := FetchConfig(f.result)
+		if err != nil {
+			return nil, err
+		}
+		f.config = cfg
+	}
+	return f.config, nil
+}
+
+func (f *imageFacts) imageSize() (int64, error) {
+	if f.size == 0 {
+		s, err := MeasureImage(f.result)
+		if err != nil {
+			return 0, err
+		}
+		f.size = s.Size
+	}
+	return f.size, nil
+}
+
+func (f *imageFacts) signed() (bool, error) {
+	if s1 := f.result.Schema1; s1 != nil && s1.Trusted {
+		return true, nil
+	}
+	if f.result.Signature == nil {
+		keys, err := signatureOptions.Keys()
+		if err != nil {
+			return false, err
+		}
+		f.result.Signature = VerifySignature(f.result, keys)
+	}
+	return f.result.Signature.Verified, nil
+}
+
+// imageReference returns the tag and digest img names explicitly. ParseImageName defaults the tag to latest.
+func imageReference(img string) (tag, dgst string) {
+	if i := strings.Index(img, "@"); i >= 0 {
+		img, dgst = img[:i], img[i+1:]
+	}
+	if i := strings.LastIndex(img, ":"); i > strings.LastIndex(img, "/") {
+		tag = img[i+1:]
+	}
+	return tag, dgst
+}
+
+// EvaluatePolicy checks a pulled image against the rules of a policy.
+func EvaluatePolicy(p *Policy, result *PullResult) *PolicyEvaluation {
+	e := &PolicyEvaluation{}
+	facts := &imageFacts{result: result}
+	name := result.Registry + "/" + result.Repository
+	tag, dgst := imageReference(result.Image)
+
+	for _, r := range p.Rules {
+		if len(r.Images) > 0 && !matchAny(r.Images, name) {
+			continue
+		}
+		violate := func(format string, args ...interface{}) {
+			e.Violations = append(e.Violations, Violation{Rule: r.Name, Enforcement: r.Enforcement, Message: fmt.Sprintf(format, args...)})
+		}
+		check := func(what string, err error) {
+			violate("could not check %s: %v", what, err)
+		}
+
+		if len(r.AllowedRegistries) > 0 && !contains(r.AllowedRegistries, result.Registry) {
+			violate("registry %s is not allowed", result.Registry)
+		}
+		if len(r.AllowedRepositories) > 0 && !matchAny(r.AllowedRepositories, name) {
+			violate("repository %s is not allowed", name)
+		}
+		if r.ForbidLatest && dgst == "" && (tag == "" || tag == "latest") {
+			if tag == "" {
+				violate("image has no tag and defaults to latest")
+			} else {
+				violate("image uses the latest tag")
+			}
+		}
+		if r.RequireDigest && dgst == "" {
+			violate("image is not pinned by digest")
+		}
+		if r.MaxAge != nil || len(r.RequiredLabels) > 0 {
+			if cfg, err := facts.imageConfig(); err != nil {
+				check("image config", err)
+			} else {
+				if r.MaxAge != nil {
+					switch {
+					case cfg.Created == nil:
+						violate("image has no creation date")
+					case time.Since(*cfg.Created) > r.MaxAge.Duration:
+						violate("image was created %s ago, more than %s", units.HumanDuration(time.Since(*cfg.Created)), r.MaxAge.Duration)
+					}
+				}
+				for _, label := range r.RequiredLabels {
+					kv := strings.SplitN(label, "=", 2)
+					v, ok := cfg.Config.Labels[kv[0]]
+					switch {
+					case !ok:
+						violate("label %s is missing", kv[0])
+					case len(kv) == 2 && v != kv[1]:
+						violate("label %s is %q, not %q", kv[0], v, kv[1])
+					}
+				}
+			}
+		}
+		if r.maxSize > 0 {
+			if size, err := facts.imageSize(); err != nil {
+				check("image size", err)
+			} else if size > r.maxSize {
+				violate("image size %s exceeds %s", units.HumanSize(float64(size)), units.HumanSize(float64(r.maxSize)))
+			}
+		}
+		if _, ok := result.Manifest.(*manifestV1.SignedManifest); ok && r.DisallowSchema1 {
+			violate("image uses the deprecated schema1 manifest format")
+		}
+		if r.RequireSignature {
+			if ok, err := facts.signed(); err != nil {
+				check("signature", err)
+			} else if !ok {
+				violate("image has no trusted signature")
+			}
+		}
+	}
+
+	e.Decision = DecisionAllow
+	for _, v := range e.Violations {
+		if enforcementRank(v.Enforcement) < enforcementRank(e.Decision) {
+			e.Decision = v.Enforcement
+		}
+	}
+	for _, v := range e.Violations {
+		glog.V(2).Infof("Policy %s (%s) violated by %s: %s", v.Rule, v.Enforcement, result.Image, v.Message)
+	}
+	return e
+}
+
+func matchAny(globs []string, name string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPolicy evaluates a pulled image against -policy into result.Policy. Deny violations fail the check.
+func checkPolicy(result *PullResult) error {
+	if policy == nil {
+		return nil
+	}
+	e := EvaluatePolicy(policy, result)
+	result.Policy = e
+	if !e.Denied() {
+		return nil
+	}
+	var msgs []string
+	for _, v := range e.Violations {
+		if v.Enforcement == EnforcementDeny {
+			msgs = append(msgs, v.Rule+": "+v.Message)
+		}
+	}
+	return newRegistryError(CategoryPolicyDenied, fmt.Errorf("image %s: %s", result.Image, strings.Join(msgs, "; ")))
+}
+
+// ContainerPolicy is the policy evaluation of the image of a container.
+type ContainerPolicy struct {
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Container string `json:"container,omitempty"`
+	Image     string `json:"image"`
+	PolicyEvaluation
+}
+
+// runPolicy checks the images given with -images or -images-file, or else the containers of Pods, against -policy.
+func runPolicy(opts *WatchOptions, kubeClient func() kubernetes.Interface, pullSecrets func() []core.Secret, namespace, output string) {
+	if policy == nil {
+		glog.Fatalln("The policy command needs a -policy file")
+	}
+	results := imageChecks{}
+	evaluations := map[string]*PolicyEvaluation{}
+	evaluate := func(img string, secrets []core.Secret, names []string) PolicyEvaluation {
+		key := imageCheckKey(img, names)
+		if e, ok := evaluations[key]; ok {
+			return *e
+		}
+		c := results.pull(img, secrets, names)
+		e := &PolicyEvaluation{Decision: EnforcementDeny}
+		if c.err != nil {
+			e.Error = ClassifyError(c.err, c.result.MediaType).Error()
+		} else {
+			e = EvaluatePolicy(policy, c.result)
+		}
+		evaluations[key] = e
+		return *e
+	}
+
+	var reports []ContainerPolicy
+	if len(opts.Images) > 0 || opts.ImagesFile != "" {
+		images, err := opts.images()
+		if err != nil {
+			glog.Fatalln(err)
+		}
+		secrets := pullSecrets()
+		for _, img := range images {
+			reports = append(reports, ContainerPolicy{Image: img, PolicyEvaluation: evaluate(img, secrets, nil)})
+		}
+	} else {
+		kc := kubeClient()
+		pods, err := kc.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+		if err != nil {
+			glog.Fatalln(err)
+		}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			secrets, names := podPullSecrets(kc, pod)
+			for _, containers := range [][]core.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+				for _, c := range containers {
+					if c.ImagePullPolicy == core.PullNever {
+						continue
+					}
+					reports = append(reports, ContainerPolicy{
+						Namespace:        pod.Namespace,
+						Pod:              pod.Name,
+						Container:        c.Name,
+						Image:            c.Image,
+						PolicyEvaluation: evaluate(c.Image, secrets, names),
+					})
+				}
+			}
+		}
+	}
+
+	exitCode := 0
+	for _, r := range reports {
+		if r.Denied() {
+			exitCode = exitCodes[CategoryPolicyDenied]
+		}
+	}
+	if output == "json" {
+		data, _ := json.MarshalIndent(reports, "", "  ")
+		fmt.Println(string(data))
+		os.Exit(exitCode)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tPOD\tCONTAINER\tIMAGE\tDECISION\tRULE\tVIOLATION")
+	for _, r := range reports {
+		row := func(rule, msg string) {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", orDash(r.Namespace), orDash(r.Pod), orDash(r.Container), r.Image, r.Decision, rule, msg)
+		}
+		if r.Error != "" {
+			row("-", r.Error)
+		}
+		shown := false
+		for _, v := range r.Violations {
+			// audit violations are only recorded in the structured output
+			if v.Enforcement != EnforcementAudit {
+				row(v.Rule, v.Message)
+				shown = true
+			}
+		}
+		if !shown && r.Error == "" {
+			row("-", "-")
+		}
+	}
+	w.Flush()
+	os.Exit(exitCode)
+}
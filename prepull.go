@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// LabelPrepull marks the DaemonSets and Pods of a prepull run.
+	LabelPrepull = "docker-image-puller.appscode.com/prepull"
+
+	prepullVolume = "prepull"
+	prepullTrue   = "/prepull/true"
+)
+
+// Statuses of the prepull run of a node.
+const (
+	PrepullSucceeded = "Succeeded"
+	PrepullFailed    = "Failed"
+	PrepullPending   = "Pending"
+	PrepullTimeout   = "Timeout"
+)
+
+// prepullPollInterval is how often the DaemonSet is polled for the number of nodes it is scheduled to.
+var prepullPollInterval = 2 * time.Second
+
+// reasons of waiting init containers that will not pull their image without intervention.
+var prepullFailureReasons = map[string]bool{
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"ErrImageNeverPull":          true,
+	"CrashLoopBackOff":           true,
+	"CreateContainerConfigError": true,
+}
+
+// PrepullOptions configures the prepull command, which pulls images onto nodes with a short lived DaemonSet.
+type PrepullOptions struct {
+	// Namespace of the DaemonSet when prepulling the -images list.
+	Namespace    string
+	NodeSelector []string
+	// HelperImage provides a static busybox binary that is run as true by the init container of
+	// every image, so that images without a shell can be prepulled too.
+	HelperImage string
+	PauseImage  string
+	Timeout     time.Duration
+}
+
+func NewPrepullOptions() *PrepullOptions {
+	return &PrepullOptions{
+		Namespace:   metav1.NamespaceDefault,
+		HelperImage: "busybox:1.36-musl",
+		PauseImage:  "registry.k8s.io/pause:3.9",
+		Timeout:     10 * time.Minute,
+	}
+}
+
+func (o *PrepullOptions) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Namespace, "prepull-namespace", o.Namespace, "Namespace of the prepull DaemonSet for the -images list, the pull secrets of this namespace are used")
+	fs.Var((*stringList)(&o.NodeSelector), "prepull-node-selector", "Comma separated key=value labels of the nodes the prepull command pulls onto, all nodes if empty")
+	fs.StringVar(&o.HelperImage, "prepull-helper-image", o.HelperImage, "Image with a statically linked /bin/busybox used to run the prepulled images")
+	fs.StringVar(&o.PauseImage, "prepull-pause-image", o.PauseImage, "Image of the long running container of the prepull DaemonSet")
+	fs.DurationVar(&o.Timeout, "prepull-timeout", o.Timeout, "Time the prepull command waits for the nodes to pull the images")
+}
+
+func (o *PrepullOptions) nodeSelector() (map[string]string, error) {
+	if len(o.NodeSelector) == 0 {
+		return nil, nil
+	}
+	selector := map[string]string{}
+	for _, s := range o.NodeSelector {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid node selector %q, expected key=value", s)
+		}
+		selector[kv[0]] = kv[1]
+	}
+	return selector, nil
+}
+
+// PrepullPlan is the set of images prepulled by a DaemonSet in a namespace.
+type PrepullPlan struct {
+	Namespace   string
+	Images      []string
+	PullSecrets []string
+}
+
+// ImagePull is the pull of an image by a node.
+type ImagePull struct {
+	Image    string    `json:"image"`
+	Pulled   bool      `json:"pulled"`
+	Duration *Duration `json:"duration,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// NodePrepull is the outcome of a prepull run on a node.
+type NodePrepull struct {
+	Namespace string      `json:"namespace"`
+	Node      string      `json:"node"`
+	Pod       string      `json:"pod"`
+	Status    string      `json:"status"`
+	Duration  *Duration   `json:"duration,omitempty"`
+	Images    []ImagePull `json:"images"`
+	Error     string      `json:"error,omitempty"`
+}
+
+func (n *NodePrepull) done() bool {
+	return n.Status == PrepullSucceeded || n.Status == PrepullFailed
+}
+
+// NewPrepullDaemonSet returns a DaemonSet with an init container per image, each pulled with
+// imagePullPolicy Always and run as a static true binary copied from the helper image.
+func NewPrepullDaemonSet(plan PrepullPlan, id string, opts *PrepullOptions) (*apps.DaemonSet, error) {
+	nodeSelector, err := opts.nodeSelector()
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{LabelPrepull: id}
+	mount := []core.VolumeMount{{Name: prepullVolume, MountPath: "/prepull"}}
+	spec := core.PodSpec{
+		InitContainers: []core.Container{{
+			Name:            "helper",
+			Image:           opts.HelperImage,
+			Command:         []string{"cp", "/bin/busybox", prepullTrue},
+			ImagePullPolicy: core.PullIfNotPresent,
+			VolumeMounts:    mount,
+		}},
+		Containers: []core.Container{{
+			Name:            "pause",
+			Image:           opts.PauseImage,
+			ImagePullPolicy: core.PullIfNotPresent,
+		}},
+		Volumes: []core.Volume{{
+			Name:         prepullVolume,
+			VolumeSource: core.VolumeSource{EmptyDir: &core.EmptyDirVolumeSource{}},
+		}},
+		NodeSelector:                  nodeSelector,
+		Tolerations:                   []core.Toleration{{Operator: core.TolerationOpExists}},
+		AutomountServiceAccountToken:  new(bool),
+		TerminationGracePeriodSeconds: new(int64),
+	}
+	for i, img := range plan.Images {
+		spec.InitContainers = append(spec.InitContainers, core.Container{
+			Name:            fmt.Sprintf("image-%d", i),
+			Image:           img,
+			Command:         []string{prepullTrue},
+			ImagePullPolicy: core.PullAlways,
+			VolumeMounts:    mount,
+		})
+	}
+	for _, name := range plan.PullSecrets {
+		spec.ImagePullSecrets = append(spec.ImagePullSecrets, core.LocalObjectReference{Name: name})
+	}
+	return &apps.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "image-prepull-" + id,
+			Namespace: plan.Namespace,
+			Labels:    labels,
+		},
+		Spec: apps.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: core.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       spec,
+			},
+		},
+	}, nil
+}
+
+// podCondition returns the time a condition of a Pod became true.
+func podCondition(pod *core.Pod, typ core.PodConditionType) (time.Time, bool) {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == typ && c.Status == core.ConditionTrue {
+			return c.LastTransitionTime.Time, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// NodePrepullStatus reads the pull of every image from the init container statuses of a prepull Pod.
+// The duration of a pull is the time from the previous init container finishing to its init
+// container starting, which includes creating the container.
+func NodePrepullStatus(pod *core.Pod, images []string) *NodePrepull {
+	n := &NodePrepull{Namespace: pod.Namespace, Node: pod.Spec.NodeName, Pod: pod.Name, Status: PrepullPending}
+	statuses := map[string]core.ContainerStatus{}
+	for _, st := range pod.Status.InitContainerStatuses {
+		statuses[st.Name] = st
+	}
+
+	prev, _ := podCondition(pod, core.PodScheduled)
+	if st, ok := statuses["helper"]; ok {
+		switch {
+		case st.State.Terminated != nil:
+			prev = st.State.Terminated.FinishedAt.Time
+		case st.State.Waiting != nil && (prepullFailureReasons[st.State.Waiting.Reason] || st.State.Waiting.Reason == "ErrImagePull"):
+			n.Status = PrepullFailed
+			n.Error = fmt.Sprintf("helper image %s: %s", st.Image, st.State.Waiting.Reason)
+		}
+	}
+	for i, img := range images {
+		p := ImagePull{Image: img}
+		st, ok := statuses[fmt.Sprintf("image-%d", i)]
+		switch {
+		case !ok:
+		case st.State.Terminated != nil:
+			p.Pulled = true
+			if started := st.State.Terminated.StartedAt.Time; !prev.IsZero() && started.After(prev) {
+				p.Duration = &Duration{started.Sub(prev)}
+			}
+			prev = st.State.Terminated.FinishedAt.Time
+		case st.State.Running != nil:
+			p.Pulled = true
+		case st.State.Waiting != nil:
+			p.Reason, p.Message = st.State.Waiting.Reason, st.State.Waiting.Message
+			// the image was pulled if the container ran before
+			p.Pulled = st.LastTerminationState.Terminated != nil
+			if prepullFailureReasons[p.Reason] {
+				n.Status = PrepullFailed
+				n.Error = fmt.Sprintf("%s: %s", img, p.Reason)
+			}
+		}
+		n.Images = append(n.Images, p)
+	}
+
+	if n.Status == PrepullPending {
+		if initialized, ok := podCondition(pod, core.PodInitialized); ok {
+			n.Status = PrepullSucceeded
+			if scheduled, ok := podCondition(pod, core.PodScheduled); ok && initialized.After(scheduled) {
+				n.Duration = &Duration{initialized.Sub(scheduled)}
+			}
+		}
+	}
+	return n
+}
+
+// RunPrepull creates the DaemonSet of a plan, waits for every selected node to pull its images, for
+// the timeout or for stopCh to be closed, and deletes the DaemonSet.
+func RunPrepull(kc kubernetes.Interface, plan PrepullPlan, opts *PrepullOptions, stopCh <-chan struct{}) ([]*NodePrepull, error) {
+	ds, err := NewPrepullDaemonSet(plan, fmt.Sprintf("%x", time.Now().UnixNano()), opts)
+	if err != nil {
+		return nil, err
+	}
+	selector := metav1.FormatLabelSelector(ds.Spec.Selector)
+	w, err := kc.CoreV1().Pods(plan.Namespace).Watch(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	// the watch is replaced when it closes, so stop whichever is current
+	defer func() { w.Stop() }()
+
+	if ds, err = kc.AppsV1().DaemonSets(plan.Namespace).Create(ds); err != nil {
+		return nil, err
+	}
+	glog.Infof("Created DaemonSet %s/%s to prepull %d images", ds.Namespace, ds.Name, len(plan.Images))
+	defer func() {
+		background := metav1.DeletePropagationBackground
+		if err := kc.AppsV1().DaemonSets(ds.Namespace).Delete(ds.Name, &metav1.DeleteOptions{PropagationPolicy: &background}); err != nil {
+			glog.Errorf("Could not delete DaemonSet %s/%s: %s", ds.Namespace, ds.Name, err)
+		}
+	}()
+
+	nodes := map[string]*NodePrepull{}
+	desired := int32(-1)
+	finished := func() bool {
+		if desired < 0 || int32(len(nodes)) < desired {
+			return false
+		}
+		for _, n := range nodes {
+			if !n.done() {
+				return false
+			}
+		}
+		return true
+	}
+	result := func() []*NodePrepull {
+		var list []*NodePrepull
+		for _, n := range nodes {
+			list = append(list, n)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Node < list[j].Node })
+		return list
+	}
+
+	timeout := time.After(opts.Timeout)
+	ticker := time.NewTicker(prepullPollInterval)
+	defer ticker.Stop()
+	for !finished() {
+		select {
+		case ev, ok := <-w.ResultChan():
+			if !ok {
+				if w, err = kc.CoreV1().Pods(plan.Namespace).Watch(metav1.ListOptions{LabelSelector: selector}); err != nil {
+					return result(), err
+				}
+				continue
+			}
+			pod, ok := ev.Object.(*core.Pod)
+			if !ok || pod.Spec.NodeName == "" || ev.Type == watch.Deleted {
+				continue
+			}
+			nodes[pod.Spec.NodeName] = NodePrepullStatus(pod, plan.Images)
+		case <-ticker.C:
+			cur, err := kc.AppsV1().DaemonSets(ds.Namespace).Get(ds.Name, metav1.GetOptions{})
+			if err != nil {
+				return result(), err
+			}
+			if cur.Status.ObservedGeneration >= cur.Generation {
+				desired = cur.Status.DesiredNumberScheduled
+			}
+		case <-timeout:
+			for _, n := range nodes {
+				if !n.done() {
+					n.Status = PrepullTimeout
+				}
+			}
+			if desired >= 0 && int32(len(nodes)) < desired {
+				return result(), fmt.Errorf("only %d of %d nodes started prepulling within %s", len(nodes), desired, opts.Timeout)
+			}
+			return result(), nil
+		case <-stopCh:
+			return result(), fmt.Errorf("interrupted")
+		}
+	}
+	return result(), nil
+}
+
+// prepullPlans groups the images used by the Pods of namespace by namespace, along with the pull
+// secrets those Pods reference.
+func prepullPlans(kc kubernetes.Interface, namespace string) ([]PrepullPlan, error) {
+	pods, err := kc.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	plans := map[string]*PrepullPlan{}
+	var namespaces []string
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Labels[LabelPrepull] != "" {
+			continue
+		}
+		plan, ok := plans[pod.Namespace]
+		if !ok {
+			plan = &PrepullPlan{Namespace: pod.Namespace}
+			plans[pod.Namespace] = plan
+			namespaces = append(namespaces, pod.Namespace)
+		}
+		for _, img := range podImages(&pod.Spec) {
+			plan.Images = appendUnique(plan.Images, img)
+		}
+		for _, ref := range pod.Spec.ImagePullSecrets {
+			plan.PullSecrets = appendUnique(plan.PullSecrets, ref.Name)
+		}
+	}
+	sort.Strings(namespaces)
+	var list []PrepullPlan
+	for _, ns := range namespaces {
+		list = append(list, *plans[ns])
+	}
+	return list, nil
+}
+
+// runPrepull pulls the images given with -images or -images-file, or else the images used by Pods,
+// onto the nodes and reports the pulls of every node.
+func runPrepull(opts *PrepullOptions, watchOpts *WatchOptions, kc kubernetes.Interface, namespace, output string) {
+	var plans []PrepullPlan
+	if len(watchOpts.Images) > 0 || watchOpts.ImagesFile != "" {
+		images, err := watchOpts.images()
+		if err != nil {
+			glog.Fatalln(err)
+		}
+		plan := PrepullPlan{Namespace: opts.Namespace, Images: images}
+		secrets, err := ListPullSecrets(kc)
+		if err != nil {
+			glog.Fatalln(err)
+		}
+		for _, sec := range secrets {
+			if sec.Namespace == opts.Namespace {
+				plan.PullSecrets = append(plan.PullSecrets, sec.Name)
+			}
+		}
+		plans = append(plans, plan)
+	} else {
+		var err error
+		if plans, err = prepullPlans(kc, namespace); err != nil {
+			glog.Fatalln(err)
+		}
+	}
+
+	// the DaemonSets are deleted when the command is interrupted
+	stopCh := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stopCh)
+	}()
+
+	var (
+		nodes []*NodePrepull
+		errs  []string
+	)
+	for _, plan := range plans {
+		select {
+		case <-stopCh:
+			errs = append(errs, fmt.Sprintf("%s: interrupted", plan.Namespace))
+			continue
+		default:
+		}
+		result, err := RunPrepull(kc, plan, opts, stopCh)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", plan.Namespace, err))
+		}
+		nodes = append(nodes, result...)
+	}
+
+	failed := len(errs) > 0
+	for _, n := range nodes {
+		failed = failed || n.Status != PrepullSucceeded
+	}
+	if output == "json" {
+		data, _ := json.MarshalIndent(struct {
+			Nodes  []*NodePrepull `json:"nodes"`
+			Errors []string       `json:"errors,omitempty"`
+		}{nodes, errs}, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAMESPACE\tNODE\tSTATUS\tPULLED\tDURATION\tERROR")
+		for _, n := range nodes {
+			pulled := 0
+			for _, p := range n.Images {
+				if p.Pulled {
+					pulled++
+				}
+			}
+			duration := "-"
+			if n.Duration != nil {
+				duration = n.Duration.Round(time.Second).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d/%d\t%s\t%s\n", n.Namespace, n.Node, n.Status, pulled, len(n.Images), duration, n.Error)
+		}
+		w.Flush()
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, "Error:", e)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestNewPrepullDaemonSet(t *testing.T) {
+	opts := NewPrepullOptions()
+	opts.NodeSelector = []string{"pool=gpu"}
+	plan := PrepullPlan{
+		Namespace:   "team",
+		Images:      []string{"nginx:1.13", "registry.internal/team/app:1.0"},
+		PullSecrets: []string{"registry-a", "registry-b"},
+	}
+	ds, err := NewPrepullDaemonSet(plan, "abc", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.Namespace != "team" || ds.Spec.Template.Labels[LabelPrepull] != "abc" {
+		t.Errorf("DaemonSet %s/%s has template labels %v", ds.Namespace, ds.Name, ds.Spec.Template.Labels)
+	}
+	spec := ds.Spec.Template.Spec
+	if spec.NodeSelector["pool"] != "gpu" {
+		t.Errorf("node selector = %v", spec.NodeSelector)
+	}
+	if len(spec.InitContainers) != 1+len(plan.Images) || spec.InitContainers[0].Image != opts.HelperImage {
+		t.Fatalf("init containers = %+v, want the helper and one per image", spec.InitContainers)
+	}
+	for i, img := range plan.Images {
+		c := spec.InitContainers[i+1]
+		if c.Image != img || c.ImagePullPolicy != core.PullAlways || strings.Join(c.Command, " ") != prepullTrue {
+			t.Errorf("init container %d = %s %s %v, want %s Always %s", i+1, c.Image, c.ImagePullPolicy, c.Command, img, prepullTrue)
+		}
+	}
+	var secrets []string
+	for _, ref := range spec.ImagePullSecrets {
+		secrets = append(secrets, ref.Name)
+	}
+	if strings.Join(secrets, ",") != "registry-a,registry-b" {
+		t.Errorf("image pull secrets = %v", secrets)
+	}
+
+	opts.NodeSelector = []string{"pool"}
+	if _, err := NewPrepullDaemonSet(plan, "abc", opts); err == nil {
+		t.Error("invalid node selector accepted")
+	}
+}
+
+// prepullPod returns the Pod of a prepull DaemonSet on node, with the helper finished at start and
+// every image pulled for 10s and run for 1s.
+func prepullPod(node string, start time.Time, images int, initialized bool) *core.Pod {
+	at := func(d time.Duration) metav1.Time { return metav1.NewTime(start.Add(d)) }
+	pod := &core.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "image-prepull-" + node, Namespace: "team"},
+		Spec:       core.PodSpec{NodeName: node},
+		Status: core.PodStatus{
+			Conditions: []core.PodCondition{{Type: core.PodScheduled, Status: core.ConditionTrue, LastTransitionTime: at(-time.Second)}},
+			InitContainerStatuses: []core.ContainerStatus{{
+				Name:  "helper",
+				State: core.ContainerState{Terminated: &core.ContainerStateTerminated{StartedAt: at(-time.Second), FinishedAt: at(0)}},
+			}},
+		},
+	}
+	end := time.Duration(0)
+	for i := 0; i < images; i++ {
+		started := end + 10*time.Second
+		end = started + time.Second
+		pod.Status.InitContainerStatuses = append(pod.Status.InitContainerStatuses, core.ContainerStatus{
+			Name:  fmt.Sprintf("image-%d", i),
+			State: core.ContainerState{Terminated: &core.ContainerStateTerminated{StartedAt: at(started), FinishedAt: at(end)}},
+		})
+	}
+	if initialized {
+		pod.Status.Conditions = append(pod.Status.Conditions, core.PodCondition{Type: core.PodInitialized, Status: core.ConditionTrue, LastTransitionTime: at(end)})
+	}
+	return pod
+}
+
+// fakePrepullCluster returns a clientset whose prepull DaemonSets are scheduled to desired nodes and
+// whose Pod watches are served by watchers, in order.
+func fakePrepullCluster(desired int32, watchers ...*watch.FakeWatcher) *fake.Clientset {
+	kc := fake.NewSimpleClientset()
+	var created *apps.DaemonSet
+	kc.PrependReactor("create", "daemonsets", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		created = action.(clienttesting.CreateAction).GetObject().(*apps.DaemonSet).DeepCopy()
+		return false, nil, nil
+	})
+	kc.PrependReactor("get", "daemonsets", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if created == nil || action.(clienttesting.GetAction).GetName() != created.Name {
+			return false, nil, nil
+		}
+		ds := created.DeepCopy()
+		ds.Status.DesiredNumberScheduled = desired
+		return true, ds, nil
+	})
+	next := 0
+	kc.PrependWatchReactor("pods", func(action clienttesting.Action) (bool, watch.Interface, error) {
+		w := watchers[next]
+		if next < len(watchers)-1 {
+			next++
+		}
+		return true, w, nil
+	})
+	return kc
+}
+
+func assertDaemonSetDeleted(t *testing.T, kc *fake.Clientset) {
+	deleted := false
+	for _, a := range kc.Actions() {
+		if a.GetVerb() == "delete" && a.GetResource().Resource == "daemonsets" {
+			deleted = true
+		}
+	}
+	list, err := kc.AppsV1().DaemonSets("team").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted || len(list.Items) > 0 {
+		t.Errorf("prepull DaemonSet was not deleted, %d left", len(list.Items))
+	}
+}
+
+func TestRunPrepull(t *testing.T) {
+	defer func(d time.Duration) { prepullPollInterval = d }(prepullPollInterval)
+	prepullPollInterval = 10 * time.Millisecond
+
+	start := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	w := watch.NewFakeWithChanSize(10, false)
+	w.Add(prepullPod("node-a", start, 1, false))
+	w.Modify(prepullPod("node-a", start, 2, true))
+	w.Add(prepullPod("node-b", start, 2, true))
+	kc := fakePrepullCluster(2, w)
+
+	opts := NewPrepullOptions()
+	opts.Timeout = 5 * time.Second
+	plan := PrepullPlan{Namespace: "team", Images: []string{"nginx:1.13", "redis:4"}}
+	nodes, err := RunPrepull(kc, plan, opts, make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes[0].Node != "node-a" || nodes[1].Node != "node-b" {
+		t.Fatalf("nodes = %+v", nodes)
+	}
+	for _, n := range nodes {
+		if n.Status != PrepullSucceeded {
+			t.Errorf("%s: status = %s, want %s", n.Node, n.Status, PrepullSucceeded)
+		}
+		if n.Duration == nil || n.Duration.Duration != 23*time.Second {
+			t.Errorf("%s: duration = %v, want 23s", n.Node, n.Duration)
+		}
+		for _, p := range n.Images {
+			if !p.Pulled || p.Duration == nil || p.Duration.Duration != 10*time.Second {
+				t.Errorf("%s: pull of %s = %+v, want pulled in 10s", n.Node, p.Image, p)
+			}
+		}
+	}
+	if !w.IsStopped() {
+		t.Error("Pod watch was not stopped")
+	}
+	assertDaemonSetDeleted(t, kc)
+}
+
+func TestRunPrepullTimeout(t *testing.T) {
+	defer func(d time.Duration) { prepullPollInterval = d }(prepullPollInterval)
+	prepullPollInterval = 10 * time.Millisecond
+
+	pod := prepullPod("node-a", time.Now(), 0, false)
+	pod.Status.InitContainerStatuses = append(pod.Status.InitContainerStatuses, core.ContainerStatus{
+		Name:  "image-0",
+		State: core.ContainerState{Waiting: &core.ContainerStateWaiting{Reason: "ErrImagePull"}},
+	})
+	// the first watch closes, the second one reports the Pod
+	closed, w := watch.NewFakeWithChanSize(1, false), watch.NewFakeWithChanSize(1, false)
+	closed.Stop()
+	w.Add(pod)
+	kc := fakePrepullCluster(2, closed, w)
+
+	opts := NewPrepullOptions()
+	opts.Timeout = 200 * time.Millisecond
+	plan := PrepullPlan{Namespace: "team", Images: []string{"nginx:does-not-exist"}}
+	nodes, err := RunPrepull(kc, plan, opts, make(chan struct{}))
+	if err == nil || !strings.Contains(err.Error(), "only 1 of 2 nodes") {
+		t.Errorf("err = %v, want only 1 of 2 nodes started", err)
+	}
+	if len(nodes) != 1 || nodes[0].Status != PrepullTimeout || nodes[0].Images[0].Reason != "ErrImagePull" {
+		t.Errorf("nodes = %+v, want node-a timed out pulling", nodes)
+	}
+	if !w.IsStopped() {
+		t.Error("replacement Pod watch was not stopped")
+	}
+	assertDaemonSetDeleted(t, kc)
+}
+
+func TestRunPrepullInterrupted(t *testing.T) {
+	kc := fakePrepullCluster(1, watch.NewFakeWithChanSize(1, false))
+	stopCh := make(chan struct{})
+	close(stopCh)
+
+	opts := NewPrepullOptions()
+	_, err := RunPrepull(kc, PrepullPlan{Namespace: "team", Images: []string{"nginx:1.13"}}, opts, stopCh)
+	if err == nil {
+		t.Error("interrupted prepull returned no error")
+	}
+	assertDaemonSetDeleted(t, kc)
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/credentialprovider"
+	acr "k8s.io/kubernetes/pkg/credentialprovider/azure"
+)
+
+const (
+	ProviderDockerConfig = "dockercfg"
+	ProviderECR          = "ecr"
+	ProviderGCR          = "gcr"
+	ProviderACR          = "acr"
+	// ProviderNone disables all node credential providers, leaving only pull secrets.
+	ProviderNone = "none"
+)
+
+// CredentialProvider is a named source of node credentials, like the cloud credential providers
+// the kubelet uses for ECR, GCR and ACR.
+type CredentialProvider struct {
+	Name string
+	// Registries are the registry globs the provider supplies credentials for.
+	Registries []string
+	Provider   credentialprovider.DockerConfigProvider
+
+	once    sync.Once
+	enabled bool
+}
+
+// Enabled calls Provider.Enabled once, as it may block on cloud metadata services.
+func (p *CredentialProvider) Enabled() bool {
+	p.once.Do(func() {
+		p.enabled = p.Provider.Enabled()
+	})
+	return p.enabled
+}
+
+// expiringProvider is implemented by providers that know when their credentials expire.
+type expiringProvider interface {
+	ExpiresAt() time.Time
+}
+
+// failingProvider is implemented by providers that remember why they could not provide credentials.
+type failingProvider interface {
+	LastError() error
+}
+
+// registryLister is implemented by providers whose registries are only known once they are enabled.
+type registryLister interface {
+	registries() []string
+}
+
+// CredentialProviders is the ordered set of node credential providers consulted after pull secrets.
+type CredentialProviders []*CredentialProvider
+
+// credentialProviders backs the keyring PullImage builds. Set by main from --credential-providers.
+var credentialProviders CredentialProviders
+
+// ProviderOptions selects and configures the node credential providers.
+type ProviderOptions struct {
+	Names         string
+	ECRRegions    string
+	ACRConfigFile string
+	// ExecConfigFile and ExecBinDir configure kubelet credential provider plugins.
+	ExecConfigFile string
+	ExecBinDir     string
+}
+
+func NewProviderOptions() *ProviderOptions {
+	return &ProviderOptions{
+		Names:      strings.Join([]string{ProviderDockerConfig, ProviderECR, ProviderGCR, ProviderACR}, ","),
+		ECRRegions: os.Getenv("AWS_REGION"),
+	}
+}
+
+func (o *ProviderOptions) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Names, "credential-providers", o.Names, "Comma separated node credential providers to use: dockercfg, ecr, gcr, acr or none")
+	fs.StringVar(&o.ECRRegions, "ecr-regions", o.ECRRegions, "Comma separated AWS regions to get ECR credentials for (defaults to $AWS_REGION, or else the region of the EC2 instance)")
+	fs.StringVar(&o.ACRConfigFile, "azure-container-registry-config", o.ACRConfigFile, "Path to the Azure cloud config used to get ACR credentials")
+	fs.StringVar(&o.ExecConfigFile, "image-credential-provider-config", o.ExecConfigFile, "Path to a kubelet CredentialProviderConfig file; its plugins are used in addition to --credential-providers")
+	fs.StringVar(&o.ExecBinDir, "image-credential-provider-bin-dir", o.ExecBinDir, "Directory of the credential provider plugin binaries")
+}
+
+// NewCredentialProviders returns the providers selected in the options, in the given order.
+func (o *ProviderOptions) NewCredentialProviders() (CredentialProviders, error) {
+	names := splitList(o.Names)
+	for _, name := range names {
+		if name == ProviderNone {
+			names = nil
+			break
+		}
+	}
+
+	var providers CredentialProviders
+	for _, name := range names {
+		switch name {
+		case ProviderDockerConfig:
+			providers = append(providers, &CredentialProvider{
+				Name: ProviderDockerConfig,
+				Provider: &credentialprovider.CachingDockerConfigProvider{
+					Provider: &dockerConfigProvider{},
+					Lifetime: 5 * time.Minute,
+				},
+			})
+		case ProviderECR:
+			p := &ecrProvider{Regions: splitList(o.ECRRegions)}
+			providers = append(providers, &CredentialProvider{
+				Name:       ProviderECR,
+				Registries: p.registries(),
+				Provider:   p,
+			})
+		case ProviderGCR:
+			providers = append(providers, &CredentialProvider{
+				Name:       ProviderGCR,
+				Registries: gcrRegistries,
+				Provider:   newGCRProvider(),
+			})
+		case ProviderACR:
+			configFile := o.ACRConfigFile
+			providers = append(providers, &CredentialProvider{
+				Name:       ProviderACR,
+				Registries: []string{"*.azurecr.io", "*.azurecr.cn", "*.azurecr.de", "*.azurecr.us"},
+				Provider: &credentialprovider.CachingDockerConfigProvider{
+					Provider: acr.NewACRProvider(&configFile),
+					Lifetime: 1 * time.Minute,
+				},
+			})
+		default:
+			return nil, fmt.Errorf("unknown credential provider %q", name)
+		}
+	}
+
+	if o.ExecConfigFile != "" {
+		execProviders, err := NewExecCredentialProviders(o.ExecConfigFile, o.ExecBinDir)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, execProviders...)
+	}
+	return providers, nil
+}
+
+// Keyring returns a keyring that draws credentials from the enabled providers.
+func (ps CredentialProviders) Keyring() credentialprovider.DockerKeyring {
+	return &providerKeyring{providers: ps}
+}
+
+type providerKeyring struct {
+	providers CredentialProviders
+}
+
+func (k *providerKeyring) Lookup(image string) ([]credentialprovider.LazyAuthConfiguration, bool) {
+	keyring := &credentialprovider.BasicDockerKeyring{}
+	for _, p := range k.providers {
+		if !p.Enabled() {
+			continue
+		}
+		if ip, ok := p.Provider.(imageProvider); ok {
+			keyring.Add(ip.ProvideForImage(image))
+		} else {
+			keyring.Add(p.Provider.Provide())
+		}
+	}
+	return keyring.Lookup(image)
+}
+
+// ProviderStatus reports the state of a node credential provider.
+type ProviderStatus struct {
+	Name       string   `json:"name"`
+	Enabled    bool     `json:"enabled"`
+	Registries []string `json:"registries,omitempty"`
+	// Provided are the registries the provider returned credentials for.
+	Provided  []string   `json:"provided,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// Status asks every provider for credentials and reports what it returned.
+func (ps CredentialProviders) Status() []ProviderStatus {
+	var statuses []ProviderStatus
+	for _, p := range ps {
+		s := ProviderStatus{
+			Name:       p.Name,
+			Enabled:    p.Enabled(),
+			Registries: p.Registries,
+		}
+		if rl, ok := unwrapProvider(p.Provider).(registryLister); ok && s.Enabled {
+			s.Registries = rl.registries()
+		}
+		if s.Enabled {
+			for registry := range p.Provider.Provide() {
+				s.Provided = append(s.Provided, registry)
+			}
+			sort.Strings(s.Provided)
+			if ep, ok := unwrapProvider(p.Provider).(expiringProvider); ok {
+				if t := ep.ExpiresAt(); !t.IsZero() {
+					s.ExpiresAt = &t
+				}
+			}
+		}
+		if fp, ok := unwrapProvider(p.Provider).(failingProvider); ok && fp.LastError() != nil {
+			s.Error = fp.LastError().Error()
+		} else if _, perImage := p.Provider.(imageProvider); s.Enabled && !perImage && len(s.Registries) > 0 && len(s.Provided) == 0 {
+			s.Error = "provider is enabled but returned no credentials"
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+func unwrapProvider(p credentialprovider.DockerConfigProvider) credentialprovider.DockerConfigProvider {
+	if c, ok := p.(*credentialprovider.CachingDockerConfigProvider); ok {
+		return c.Provider
+	}
+	return p
+}
+
+func runProviders(providers CredentialProviders, output string) {
+	statuses := providers.Status()
+	if output == "json" {
+		data, _ := json.MarshalIndent(statuses, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tENABLED\tREGISTRIES\tPROVIDED\tEXPIRES\tERROR")
+	for _, s := range statuses {
+		expires := "-"
+		if s.ExpiresAt != nil {
+			expires = s.ExpiresAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%v\t%s\t%s\t%s\t%s\n", s.Name, s.Enabled, orDash(strings.Join(s.Registries, ",")), orDash(strings.Join(s.Provided, ",")), expires, strings.Replace(s.Error, "\n", " ", -1))
+	}
+	w.Flush()
+}
+
+// dockerConfigProvider reads the docker config files of the node, like the kubelet's default provider.
+type dockerConfigProvider struct{}
+
+func (d *dockerConfigProvider) Enabled() bool {
+	return true
+}
+
+func (d *dockerConfigProvider) Provide() credentialprovider.DockerConfig {
+	// a node without docker config files is normal
+	if cfg, err := credentialprovider.ReadDockerConfigFile(); err == nil {
+		return cfg
+	}
+	return credentialprovider.DockerConfig{}
+}
+
+func (d *dockerConfigProvider) LazyProvide() *credentialprovider.DockerConfigEntry {
+	return nil
+}
+
+// ecrTokenGetter is the part of the ECR API used to get registry credentials.
+type ecrTokenGetter interface {
+	GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error)
+}
+
+// ecrProvider gets 12 hour ECR tokens for the configured regions, or else for the region of the EC2
+// instance it runs on. Unlike the kubelet's provider, it keeps the token expiry.
+type ecrProvider struct {
+	Regions []string
+	// NewClient returns the ECR client of a region. Defaults to the AWS SDK client.
+	NewClient func(region string) ecrTokenGetter
+	// InstanceRegion returns the region of the EC2 instance, or "" off EC2. Defaults to ec2InstanceRegion.
+	InstanceRegion func() (string, error)
+
+	mu        sync.Mutex
+	cfg       credentialprovider.DockerConfig
+	expiresAt time.Time
+	err       error
+}
+
+var _ credentialprovider.DockerConfigProvider = &ecrProvider{}
+
+func (p *ecrProvider) registries() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return ecrRegistries(p.Regions)
+}
+
+func ecrRegistries(regions []string) []string {
+	var registries []string
+	for _, region := range regions {
+		suffix := "amazonaws.com"
+		if strings.HasPrefix(region, "cn-") {
+			suffix = "amazonaws.com.cn"
+		}
+		registries = append(registries, fmt.Sprintf("*.dkr.ecr.%s.%s", region, suffix))
+	}
+	return registries
+}
+
+func (p *ecrProvider) Enabled() bool {
+	if len(p.Regions) > 0 {
+		return true
+	}
+	instanceRegion := p.InstanceRegion
+	if instanceRegion == nil {
+		instanceRegion = ec2InstanceRegion
+	}
+	region, err := instanceRegion()
+	if err != nil {
+		glog.Warningf("Could not get the region of the EC2 instance for ECR credentials: %v", err)
+		return false
+	}
+	if region == "" {
+		return false
+	}
+	p.mu.Lock()
+	p.Regions = []string{region}
+	p.mu.Unlock()
+	return true
+}
+
+const (
+	ec2SysVendorFile   = "/sys/class/dmi/id/sys_vendor"
+	ec2BIOSVersionFile = "/sys/class/dmi/id/bios_version"
+)
+
+// ec2InstanceRegion returns the region of the EC2 instance from the instance metadata. The DMI data
+// of the machine is checked first, so nodes outside EC2 do not wait for the metadata service.
+func ec2InstanceRegion() (string, error) {
+	vendor, _ := ioutil.ReadFile(ec2SysVendorFile)
+	bios, _ := ioutil.ReadFile(ec2BIOSVersionFile)
+	// Nitro instances report the vendor Amazon EC2, Xen instances a BIOS version like 4.2.amazon
+	if !strings.Contains(string(vendor), "Amazon") && !strings.Contains(strings.ToLower(string(bios)), "amazon") {
+		return "", nil
+	}
+	metadata := ec2metadata.New(session.New(&aws.Config{
+		HTTPClient: &http.Client{Timeout: 5 * time.Second},
+		MaxRetries: aws.Int(2),
+	}))
+	return metadata.Region()
+}
+
+func (p *ecrProvider) LazyProvide() *credentialprovider.DockerConfigEntry {
+	return nil
+}
+
+func (p *ecrProvider) Provide() credentialprovider.DockerConfig {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// refresh a little before the tokens expire
+	if p.cfg != nil && time.Now().Before(p.expiresAt.Add(-5*time.Minute)) {
+		return p.cfg
+	}
+
+	newClient := p.NewClient
+	if newClient == nil {
+		newClient = func(region string) ecrTokenGetter {
+			return ecr.New(session.New(&aws.Config{Region: aws.String(region)}))
+		}
+	}
+
+	cfg := credentialprovider.DockerConfig{}
+	var expiresAt time.Time
+	var errs []string
+	registries := ecrRegistries(p.Regions)
+	for i, region := range p.Regions {
+		output, err := newClient(region).GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", region, err))
+			continue
+		}
+		for _, data := range output.AuthorizationData {
+			if data.AuthorizationToken == nil {
+				continue
+			}
+			decoded, err := base64.StdEncoding.DecodeString(aws.StringValue(data.AuthorizationToken))
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: invalid authorization token: %v", region, err))
+				continue
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				errs = append(errs, fmt.Sprintf("%s: invalid authorization token", region))
+				continue
+			}
+			cfg[registries[i]] = credentialprovider.DockerConfigEntry{
+				Username: parts[0],
+				Password: parts[1],
+				// ECR ignores it
+				Email: "not@val.id",
+			}
+			if data.ExpiresAt != nil && (expiresAt.IsZero() || data.ExpiresAt.Before(expiresAt)) {
+				expiresAt = *data.ExpiresAt
+			}
+		}
+	}
+
+	p.err = nil
+	if len(errs) > 0 {
+		p.err = fmt.Errorf("failed to get ECR authorization token: %s", strings.Join(errs, "; "))
+	}
+	p.cfg, p.expiresAt = cfg, expiresAt
+	return cfg
+}
+
+func (p *ecrProvider) ExpiresAt() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.expiresAt
+}
+
+func (p *ecrProvider) LastError() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+const (
+	gceMetadataToken   = "http://metadata.google.internal./computeMetadata/v1/instance/service-accounts/default/token"
+	gceProductNameFile = "/sys/class/dmi/id/product_name"
+)
+
+var gcrRegistries = []string{"container.cloud.google.com", "gcr.io", "*.gcr.io", "*.pkg.dev"}
+
+// gcrProvider gets access tokens of the default service account from the GCE metadata server.
+type gcrProvider struct {
+	Client          *http.Client
+	ProductNameFile string
+
+	mu        sync.Mutex
+	cfg       credentialprovider.DockerConfig
+	expiresAt time.Time
+	err       error
+}
+
+var _ credentialprovider.DockerConfigProvider = &gcrProvider{}
+
+func newGCRProvider() *gcrProvider {
+	return &gcrProvider{
+		Client:          &http.Client{Timeout: 10 * time.Second},
+		ProductNameFile: gceProductNameFile,
+	}
+}
+
+func (g *gcrProvider) Enabled() bool {
+	data, err := ioutil.ReadFile(g.ProductNameFile)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(data), "Google")
+}
+
+func (g *gcrProvider) LazyProvide() *credentialprovider.DockerConfigEntry {
+	return nil
+}
+
+func (g *gcrProvider) Provide() credentialprovider.DockerConfig {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.cfg != nil && time.Now().Before(g.expiresAt.Add(-time.Minute)) {
+		return g.cfg
+	}
+
+	data, err := credentialprovider.ReadUrl(gceMetadataToken, g.Client, &http.Header{"Metadata-Flavor": []string{"Google"}})
+	if err != nil {
+		g.err = fmt.Errorf("failed to read access token from GCE metadata: %v", err)
+		return credentialprovider.DockerConfig{}
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		g.err = fmt.Errorf("failed to parse access token from GCE metadata: %v", err)
+		return credentialprovider.DockerConfig{}
+	}
+
+	cfg := credentialprovider.DockerConfig{}
+	for _, registry := range gcrRegistries {
+		cfg[registry] = credentialprovider.DockerConfigEntry{
+			Username: "_token",
+			Password: token.AccessToken,
+		}
+	}
+	g.cfg, g.expiresAt, g.err = cfg, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second), nil
+	return cfg
+}
+
+func (g *gcrProvider) ExpiresAt() time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.expiresAt
+}
+
+func (g *gcrProvider) LastError() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
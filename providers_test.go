@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"k8s.io/kubernetes/pkg/credentialprovider"
+)
+
+// fakeProvider provides cfg when enabled, and counts the calls of Enabled.
+type fakeProvider struct {
+	enabled   bool
+	enabledN  int
+	cfg       credentialprovider.DockerConfig
+	expiresAt time.Time
+	err       error
+}
+
+func (f *fakeProvider) Enabled() bool {
+	f.enabledN++
+	return f.enabled
+}
+
+func (f *fakeProvider) Provide() credentialprovider.DockerConfig {
+	return f.cfg
+}
+
+func (f *fakeProvider) LazyProvide() *credentialprovider.DockerConfigEntry {
+	return nil
+}
+
+func (f *fakeProvider) ExpiresAt() time.Time {
+	return f.expiresAt
+}
+
+func (f *fakeProvider) LastError() error {
+	return f.err
+}
+
+func TestProviderKeyring(t *testing.T) {
+	enabled := &fakeProvider{
+		enabled: true,
+		cfg:     credentialprovider.DockerConfig{"registry.internal": {Username: "user", Password: "secret"}},
+	}
+	disabled := &fakeProvider{
+		cfg: credentialprovider.DockerConfig{"registry.disabled": {Username: "other", Password: "secret"}},
+	}
+	providers := CredentialProviders{
+		{Name: "enabled", Provider: enabled},
+		{Name: "disabled", Provider: disabled},
+	}
+	keyring := providers.Keyring()
+
+	for i := 0; i < 2; i++ {
+		creds, ok := keyring.Lookup("registry.internal/team/app:1.0")
+		if !ok || len(creds) != 1 || creds[0].Username != "user" || creds[0].Password != "secret" {
+			t.Errorf("Lookup(registry.internal/team/app:1.0) = %+v, %t, want the credentials of user", creds, ok)
+		}
+	}
+	if creds, ok := keyring.Lookup("registry.disabled/team/app:1.0"); ok {
+		t.Errorf("Lookup(registry.disabled/team/app:1.0) = %+v, want no credentials of a disabled provider", creds)
+	}
+	if enabled.enabledN != 1 || disabled.enabledN != 1 {
+		t.Errorf("Enabled called %d and %d times, want once", enabled.enabledN, disabled.enabledN)
+	}
+}
+
+func TestProviderStatus(t *testing.T) {
+	expiresAt := time.Date(2024, 1, 15, 22, 0, 0, 0, time.UTC)
+	providers := CredentialProviders{
+		{
+			Name:       "current",
+			Registries: []string{"*.registry.internal"},
+			Provider: &credentialprovider.CachingDockerConfigProvider{
+				Provider: &fakeProvider{
+					enabled: true,
+					cfg: credentialprovider.DockerConfig{
+						"b.registry.internal": {Username: "user"},
+						"a.registry.internal": {Username: "user"},
+					},
+					expiresAt: expiresAt,
+				},
+				Lifetime: time.Minute,
+			},
+		},
+		{Name: "disabled", Registries: []string{"registry.disabled"}, Provider: &fakeProvider{}},
+		{Name: "empty", Registries: []string{"registry.empty"}, Provider: &fakeProvider{enabled: true}},
+		{Name: "failing", Registries: []string{"registry.failing"}, Provider: &fakeProvider{enabled: true, err: errors.New("token request failed")}},
+	}
+
+	statuses := providers.Status()
+	if len(statuses) != len(providers) {
+		t.Fatalf("got %d statuses, want %d", len(statuses), len(providers))
+	}
+	s := statuses[0]
+	if !s.Enabled || strings.Join(s.Provided, ",") != "a.registry.internal,b.registry.internal" || s.Error != "" {
+		t.Errorf("current: %+v", s)
+	}
+	if s.ExpiresAt == nil || !s.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("current: expires at %v, want %v", s.ExpiresAt, expiresAt)
+	}
+	if s := statuses[1]; s.Enabled || len(s.Provided) > 0 || s.ExpiresAt != nil || s.Error != "" {
+		t.Errorf("disabled: %+v", s)
+	}
+	if s := statuses[2]; !s.Enabled || s.Error != "provider is enabled but returned no credentials" {
+		t.Errorf("empty: %+v", s)
+	}
+	if s := statuses[3]; s.Error != "token request failed" {
+		t.Errorf("failing: %+v", s)
+	}
+}
+
+// fakeECR returns the token of a region, or fails if it has none.
+type fakeECR struct {
+	token     string
+	expiresAt time.Time
+}
+
+func (f fakeECR) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	if f.token == "" {
+		return nil, errors.New("AccessDeniedException")
+	}
+	return &ecr.GetAuthorizationTokenOutput{AuthorizationData: []*ecr.AuthorizationData{{
+		AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte(f.token))),
+		ExpiresAt:          aws.Time(f.expiresAt),
+	}}}, nil
+}
+
+func TestECRProvider(t *testing.T) {
+	expiresAt := time.Now().Add(12 * time.Hour).Round(time.Second)
+	clients := map[string]fakeECR{
+		"us-east-1":  {token: "AWS:east", expiresAt: expiresAt},
+		"cn-north-1": {token: "AWS:north", expiresAt: expiresAt.Add(time.Hour)},
+		"eu-west-1":  {},
+	}
+	p := &ecrProvider{
+		Regions:   []string{"us-east-1", "cn-north-1", "eu-west-1"},
+		NewClient: func(region string) ecrTokenGetter { return clients[region] },
+	}
+	if !p.Enabled() {
+		t.Fatal("ECR provider with regions is disabled")
+	}
+
+	cfg := p.Provide()
+	want := map[string]string{
+		"*.dkr.ecr.us-east-1.amazonaws.com":     "east",
+		"*.dkr.ecr.cn-north-1.amazonaws.com.cn": "north",
+	}
+	if len(cfg) != len(want) {
+		t.Errorf("provided %v, want %v", cfg, want)
+	}
+	for registry, password := range want {
+		if e := cfg[registry]; e.Username != "AWS" || e.Password != password {
+			t.Errorf("%s: %s:%s, want AWS:%s", registry, e.Username, e.Password, password)
+		}
+	}
+	if !p.ExpiresAt().Equal(expiresAt) {
+		t.Errorf("expires at %v, want the earliest expiry %v", p.ExpiresAt(), expiresAt)
+	}
+	if err := p.LastError(); err == nil || !strings.Contains(err.Error(), "eu-west-1: AccessDeniedException") {
+		t.Errorf("last error = %v, want the eu-west-1 failure", err)
+	}
+
+	// tokens are reused until shortly before they expire
+	clients["us-east-1"] = fakeECR{}
+	if e := p.Provide()["*.dkr.ecr.us-east-1.amazonaws.com"]; e.Password != "east" {
+		t.Errorf("cached token not reused, got %+v", e)
+	}
+}
+
+func TestECRProviderInstanceRegion(t *testing.T) {
+	p := &ecrProvider{
+		InstanceRegion: func() (string, error) { return "", nil },
+	}
+	if p.Enabled() {
+		t.Error("ECR provider without regions is enabled off EC2")
+	}
+
+	p = &ecrProvider{
+		InstanceRegion: func() (string, error) { return "us-west-2", nil },
+		NewClient:      func(region string) ecrTokenGetter { return fakeECR{token: "AWS:" + region} },
+	}
+	providers := CredentialProviders{{Name: ProviderECR, Registries: p.registries(), Provider: p}}
+	s := providers.Status()[0]
+	if !s.Enabled || strings.Join(s.Registries, ",") != "*.dkr.ecr.us-west-2.amazonaws.com" || strings.Join(s.Provided, ",") != "*.dkr.ecr.us-west-2.amazonaws.com" {
+		t.Errorf("status = %+v, want the registry of the instance region", s)
+	}
+	creds, ok := providers.Keyring().Lookup("123456789012.dkr.ecr.us-west-2.amazonaws.com/team/app:1.0")
+	if !ok || creds[0].Password != "us-west-2" {
+		t.Errorf("Lookup = %+v, %t, want the credentials of us-west-2", creds, ok)
+	}
+}
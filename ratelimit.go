@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	"k8s.io/kubernetes/pkg/credentialprovider"
+)
+
+const (
+	dockerHubRegistry = "https://registry-1.docker.io"
+	// rateLimitProbe is the repository Docker documents for checking pull limits.
+	rateLimitProbe = "ratelimitpreview/test"
+)
+
+// RateLimit is the pull quota Docker Hub reports in ratelimit-* response headers.
+type RateLimit struct {
+	Limit     int    `json:"limit"`
+	Remaining int    `json:"remaining"`
+	Window    string `json:"window,omitempty"`
+	Source    string `json:"source,omitempty"`
+}
+
+// parseRateLimit reads the ratelimit headers of resp, returning nil if the registry sent none.
+func parseRateLimit(h http.Header) *RateLimit {
+	limit, window, ok := parseRateLimitHeader(h.Get("RateLimit-Limit"))
+	if !ok {
+		return nil
+	}
+	rl := &RateLimit{
+		Limit:  limit,
+		Source: h.Get("Docker-RateLimit-Source"),
+	}
+	if window > 0 {
+		rl.Window = window.String()
+	}
+	if remaining, _, ok := parseRateLimitHeader(h.Get("RateLimit-Remaining")); ok {
+		rl.Remaining = remaining
+	}
+	return rl
+}
+
+// parseRateLimitHeader parses values of the form "100;w=21600".
+func parseRateLimitHeader(value string) (int, time.Duration, bool) {
+	if value == "" {
+		return 0, 0, false
+	}
+	parts := strings.Split(value, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, false
+	}
+	var window time.Duration
+	for _, p := range parts[1:] {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, "w=") {
+			if secs, err := strconv.Atoi(p[2:]); err == nil {
+				window = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return n, window, true
+}
+
+// traceTransport records response metadata, such as rate limits and manifest media types, in a Trace.
+type traceTransport struct {
+	Transport http.RoundTripper
+	Trace     *Trace
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	if err == nil && t.Trace != nil {
+		if rl := parseRateLimit(resp.Header); rl != nil {
+			t.Trace.RateLimit = rl
+		}
+		if strings.Contains(req.URL.Path, "/manifests/") {
+			t.Trace.MediaType = resp.Header.Get("Content-Type")
+			t.Trace.contentDigest = resp.Header.Get("Docker-Content-Digest")
+		}
+	}
+	return resp, err
+}
+
+// RateLimitStatus is the Docker Hub pull quota left for one credential.
+type RateLimitStatus struct {
+	// Source is "anonymous" or "secret:" followed by the namespace/name of the pull secret.
+	Source    string     `json:"source"`
+	Username  string     `json:"username,omitempty"`
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// CheckRateLimits reports the remaining Docker Hub pulls for anonymous access and for every
+// Docker Hub credential in pullSecrets. It uses HEAD requests, which do not consume quota.
+func CheckRateLimits(pullSecrets []v1.Secret) []RateLimitStatus {
+	statuses := []RateLimitStatus{checkRateLimit(credentialSourceAnonymous, &AuthConfig{ServerAddress: dockerHubRegistry})}
+
+	for i := range pullSecrets {
+		sec := pullSecrets[i]
+		source := secretSource(&sec)
+		keyring, err := credentialprovider.MakeDockerKeyring([]v1.Secret{sec}, &credentialprovider.BasicDockerKeyring{})
+		if err != nil {
+			statuses = append(statuses, RateLimitStatus{Source: source, Error: err.Error()})
+			continue
+		}
+		creds, ok := keyring.Lookup("docker.io/" + rateLimitProbe)
+		if !ok {
+			continue
+		}
+		for _, c := range creds {
+			authConfig := credentialprovider.LazyProvide(c)
+			statuses = append(statuses, checkRateLimit(source, &AuthConfig{
+				Username:      authConfig.Username,
+				Password:      authConfig.Password,
+				Auth:          authConfig.Auth,
+				ServerAddress: dockerHubRegistry,
+			}))
+		}
+	}
+	return statuses
+}
+
+func checkRateLimit(source string, auth *AuthConfig) RateLimitStatus {
+	status := RateLimitStatus{Source: source, Username: auth.Username}
+
+	var trace Trace
+	hub, err := NewRegistry(auth, &trace)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	if _, err = hub.ManifestDigest(rateLimitProbe, "latest"); err != nil {
+		status.Error = err.Error()
+	}
+	status.RateLimit = trace.RateLimit
+	if status.RateLimit == nil && status.Error == "" {
+		status.Error = "registry did not report a rate limit"
+	}
+	if status.RateLimit != nil {
+		rateLimitRemaining.WithLabelValues(source).Set(float64(status.RateLimit.Remaining))
+	}
+	return status
+}
+
+func runRateLimit(pullSecrets []v1.Secret, output string) {
+	statuses := CheckRateLimits(pullSecrets)
+	if output == "json" {
+		data, _ := json.MarshalIndent(statuses, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tUSERNAME\tLIMIT\tREMAINING\tWINDOW\tRATELIMIT-SOURCE\tERROR")
+	for _, s := range statuses {
+		limit, remaining, window, rlSource := "-", "-", "-", "-"
+		if s.RateLimit != nil {
+			limit = strconv.Itoa(s.RateLimit.Limit)
+			remaining = strconv.Itoa(s.RateLimit.Remaining)
+			window = s.RateLimit.Window
+			rlSource = s.RateLimit.Source
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Source, orDash(s.Username), limit, remaining, orDash(window), orDash(rlSource), s.Error)
+		if s.RateLimit != nil && s.RateLimit.Remaining == 0 {
+			glog.Warningf("Docker Hub pulls exhausted for %s", s.Source)
+		}
+	}
+	w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
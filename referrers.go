@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	reg "github.com/appscode/docker-registry-client/registry"
+	manifestV2 "github.com/docker/distribution/manifest/schema2"
+	units "github.com/docker/go-units"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	core "k8s.io/api/core/v1"
+)
+
+// Kinds of artifacts attached to an image.
+const (
+	ArtifactKindSignature     = "signature"
+	ArtifactKindSBOM          = "sbom"
+	ArtifactKindProvenance    = "provenance"
+	ArtifactKindVulnerability = "vulnerability-report"
+	ArtifactKindOther         = "other"
+)
+
+const (
+	// mediaTypeArtifactManifest is the artifact manifest of OCI 1.1 release candidates, still served by some registries.
+	mediaTypeArtifactManifest = "application/vnd.oci.artifact.manifest.v1+json"
+
+	ReferrerSourceAPI = "referrers"
+	ReferrerSourceTag = "tag"
+)
+
+// Referrer is a manifest referring to an image. The vendored image-spec predates artifactType.
+type Referrer struct {
+	ocispec.Descriptor
+	ArtifactType string `json:"artifactType,omitempty"`
+	// Kind classifies the artifact type, e.g. sbom or signature.
+	Kind string `json:"kind"`
+	// Source is how the referrer was found, the referrers API or the sha256-<hex> fallback tag.
+	Source string `json:"source"`
+}
+
+// ArtifactKind classifies an artifact type.
+func ArtifactKind(artifactType string) string {
+	t := strings.ToLower(artifactType)
+	switch {
+	case strings.Contains(t, "signature"), strings.Contains(t, "cosign.artifact.sig"), strings.Contains(t, "sigstore.bundle"):
+		return ArtifactKindSignature
+	case strings.Contains(t, "spdx"), strings.Contains(t, "cyclonedx"), strings.Contains(t, "sbom"), strings.Contains(t, "syft"):
+		return ArtifactKindSBOM
+	case strings.Contains(t, "in-toto"), strings.Contains(t, "provenance"), strings.Contains(t, "slsa"):
+		return ArtifactKindProvenance
+	case strings.Contains(t, "vuln"), strings.Contains(t, "sarif"), strings.Contains(t, "vex"), strings.Contains(t, "trivy"), strings.Contains(t, "grype"):
+		return ArtifactKindVulnerability
+	}
+	return ArtifactKindOther
+}
+
+// referrersTag is the tag registries without the referrers API use to list the referrers of d.
+// ref: https://github.com/opencontainers/distribution-spec/blob/main/spec.md#referrers-tag-schema
+func referrersTag(d digest.Digest) string {
+	return d.Algorithm().String() + "-" + d.Hex()
+}
+
+// artifactClient returns a registry client for the artifacts of a pulled image. It records into its
+// own trace, so the digests of artifact manifests do not replace the image digest.
+func (r *PullResult) artifactClient() (*reg.Registry, error) {
+	if r.auth == nil {
+		return nil, fmt.Errorf("image %q was not pulled", r.Image)
+	}
+	return NewRegistry(r.auth, &Trace{}, RepositoryScope(r.Repository, "pull"))
+}
+
+// ListReferrers lists the artifacts attached to a pulled image, filtered by artifactType if set.
+func ListReferrers(result *PullResult, artifactType string) ([]Referrer, error) {
+	d, err := digest.Parse(result.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("image digest %q is unknown, the registry did not report it", result.Digest)
+	}
+	hub, err := result.artifactClient()
+	if err != nil {
+		return nil, err
+	}
+	return FindReferrers(hub, result.Repository, d, artifactType)
+}
+
+// FindReferrers lists the manifests referring to digest d with the OCI referrers API, falling back
+// to the referrers tag when the registry does not implement the API.
+func FindReferrers(hub *reg.Registry, repo string, d digest.Digest, artifactType string) ([]Referrer, error) {
+	endpoint := fmt.Sprintf("%s/v2/%s/referrers/%s", strings.TrimSuffix(hub.URL, "/"), repo, d)
+	if artifactType != "" {
+		endpoint += "?artifactType=" + url.QueryEscape(artifactType)
+	}
+	source := ReferrerSourceAPI
+	data, err := fetchJSON(hub, endpoint, ocispec.MediaTypeImageIndex)
+	if err != nil {
+		if ClassifyError(err, "").Category != CategoryNotFound {
+			return nil, err
+		}
+		glog.V(3).Infof("Referrers API not available for %s, trying tag %s", repo, referrersTag(d))
+		source = ReferrerSourceTag
+		data, err = fetchJSON(hub, manifestURL(hub, repo, referrersTag(d)), ocispec.MediaTypeImageIndex)
+		if err != nil {
+			if ClassifyError(err, "").Category == CategoryNotFound {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+
+	var index struct {
+		Manifests []Referrer `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid referrers of %s: %v", d, err)
+	}
+	// registries may ignore the artifactType filter, so it is applied here too
+	var refs []Referrer
+	for _, ref := range index.Manifests {
+		if artifactType != "" && ref.ArtifactType != artifactType {
+			continue
+		}
+		ref.Kind = ArtifactKind(ref.ArtifactType)
+		ref.Source = source
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// FetchArtifact downloads the manifest and blobs of a referrer into dir/<algorithm>-<hex>, verifying their digests.
+func FetchArtifact(result *PullResult, ref Referrer, dir string) (string, error) {
+	hub, err := result.artifactClient()
+	if err != nil {
+		return "", err
+	}
+	data, err := fetchJSON(hub, manifestURL(hub, result.Repository, ref.Digest.String()),
+		ocispec.MediaTypeImageManifest, mediaTypeArtifactManifest, manifestV2.MediaTypeManifest)
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest.Validate() != nil || ref.Digest != digest.FromBytes(data) {
+		return "", fmt.Errorf("manifest %s does not match its digest", ref.Digest)
+	}
+	// artifact manifests name their blobs "blobs" instead of "layers"
+	var m struct {
+		Config *ocispec.Descriptor  `json:"config,omitempty"`
+		Layers []ocispec.Descriptor `json:"layers,omitempty"`
+		Blobs  []ocispec.Descriptor `json:"blobs,omitempty"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", fmt.Errorf("invalid manifest %s: %v", ref.Digest, err)
+	}
+
+	out, err := artifactPath(dir, ref.Digest)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(out, "manifest.json"), data, 0644); err != nil {
+		return "", err
+	}
+	blobs := append(m.Layers, m.Blobs...)
+	if m.Config != nil && m.Config.Size > 0 {
+		blobs = append(blobs, *m.Config)
+	}
+	for _, b := range blobs {
+		name, err := artifactPath(out, b.Digest)
+		if err != nil {
+			return "", err
+		}
+		if err := downloadBlob(hub, result.Repository, b.Digest, name); err != nil {
+			return "", err
+		}
+	}
+	return out, nil
+}
+
+// artifactPath returns the file of blob d in dir. Digests come from artifact manifests, so they are
+// validated before they become part of a path.
+func artifactPath(dir string, d digest.Digest) (string, error) {
+	if err := d.Validate(); err != nil {
+		return "", fmt.Errorf("invalid blob digest %q: %v", d, err)
+	}
+	name := filepath.Join(dir, referrersTag(d))
+	if filepath.Dir(name) != filepath.Clean(dir) {
+		return "", fmt.Errorf("blob %s would be written outside %s", d, dir)
+	}
+	return name, nil
+}
+
+func downloadBlob(hub *reg.Registry, repo string, d digest.Digest, name string) error {
+	return writeFile(name, func(f *os.File) error {
+		_, err := verifyBlob(hub, repo, d, f)
+		return err
+	})
+}
+
+// writeFile creates name and fills it with fn, removing it if fn fails.
+func writeFile(name string, fn func(f *os.File) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = fn(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+func runReferrers(img string, pullSecrets []core.Secret, artifactType, fetchDir, output string) {
+	result, err := PullImage(img, pullSecrets)
+	if err != nil {
+		regErr := ClassifyError(err, result.MediaType)
+		fmt.Fprintln(os.Stderr, regErr.Error())
+		os.Exit(regErr.ExitCode())
+	}
+	refs, err := ListReferrers(result, artifactType)
+	if err != nil {
+		regErr := ClassifyError(err, "")
+		fmt.Fprintln(os.Stderr, regErr.Error())
+		os.Exit(regErr.ExitCode())
+	}
+	if fetchDir != "" {
+		for _, ref := range refs {
+			out, err := FetchArtifact(result, ref, fetchDir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", ref.Digest, err)
+				os.Exit(1)
+			}
+			glog.Infof("Fetched %s %s to %s", ref.Kind, ref.Digest, out)
+		}
+	}
+
+	if output == "json" {
+		data, _ := json.MarshalIndent(refs, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tARTIFACT TYPE\tDIGEST\tSIZE\tCREATED\tSOURCE")
+	for _, ref := range refs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", ref.Kind, orDash(ref.ArtifactType), ref.Digest,
+			units.HumanSize(float64(ref.Size)), orDash(ref.Annotations[ocispec.AnnotationCreated]), ref.Source)
+	}
+	w.Flush()
+}
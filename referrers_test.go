@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestArtifactPath(t *testing.T) {
+	dir := filepath.Join("fetch", "sha256-abc")
+	good := digest.FromString("blob")
+	name, err := artifactPath(dir, good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "sha256-"+good.Hex()); name != want {
+		t.Errorf("artifactPath(%s) = %s, want %s", good, name, want)
+	}
+
+	for _, d := range []digest.Digest{
+		"../../x:y",
+		"sha256:../../etc/passwd",
+		"sha256:" + digest.Digest(good.Hex()[:10]),
+		"",
+	} {
+		if name, err := artifactPath(dir, d); err == nil {
+			t.Errorf("artifactPath(%q) = %s, want an error", d, name)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// RetryOptions controls how failed registry requests are retried.
+type RetryOptions struct {
+	// MaxRetries is the number of retries allowed for a single request.
+	MaxRetries int
+	// Budget is the number of retries allowed across all requests of a run, or of a check cycle
+	// of the watch and controller commands.
+	Budget         int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// MaxRetryAfter is the longest Retry-After the tool is willing to wait for.
+	MaxRetryAfter time.Duration
+
+	mu   sync.Mutex
+	used int
+}
+
+func NewRetryOptions() *RetryOptions {
+	return &RetryOptions{
+		MaxRetries:     3,
+		Budget:         20,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		MaxRetryAfter:  time.Minute,
+	}
+}
+
+func (o *RetryOptions) AddFlags(fs *flag.FlagSet) {
+	fs.IntVar(&o.MaxRetries, "max-retries", o.MaxRetries, "Maximum retries for a single registry request (0 disables retries)")
+	fs.IntVar(&o.Budget, "retry-budget", o.Budget, "Maximum retries across all registry requests of a run, or of every check cycle of the watch and controller commands")
+	fs.DurationVar(&o.InitialBackoff, "retry-initial-backoff", o.InitialBackoff, "Backoff before the first retry; doubled on every further retry")
+	fs.DurationVar(&o.MaxBackoff, "retry-max-backoff", o.MaxBackoff, "Upper bound for the backoff between retries")
+	fs.DurationVar(&o.MaxRetryAfter, "retry-max-retry-after", o.MaxRetryAfter, "Give up instead of retrying when a registry asks to wait longer than this")
+}
+
+// takeBudget reserves one retry from the global budget.
+func (o *RetryOptions) takeBudget() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.used >= o.Budget {
+		return false
+	}
+	o.used++
+	return true
+}
+
+// ResetBudget makes the whole retry budget available again.
+func (o *RetryOptions) ResetBudget() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.used = 0
+}
+
+// backoff returns the exponential backoff with jitter for the given retry attempt (starting at 1).
+func (o *RetryOptions) backoff(attempt int) time.Duration {
+	d := o.InitialBackoff
+	for i := 1; i < attempt && d < o.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > o.MaxBackoff {
+		d = o.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	// equal jitter: half fixed, half random
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+const (
+	RetryDecisionRetry  = "retry"
+	RetryDecisionGiveUp = "give-up"
+)
+
+// RetryEvent records a retry decision taken for a failed registry request.
+type RetryEvent struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Decision   string    `json:"decision"`
+	Reason     string    `json:"reason"`
+	Delay      string    `json:"delay,omitempty"`
+}
+
+// Trace collects what happened on the wire while talking to a registry.
+type Trace struct {
+	MediaType string       `json:"mediaType,omitempty"`
+	Digest    string       `json:"digest,omitempty"`
+	Retries   []RetryEvent `json:"retries,omitempty"`
+	RateLimit *RateLimit   `json:"rateLimit,omitempty"`
+	// IndexDigest, IndexMediaType and Index are the manifest list or OCI image index the reference
+	// resolved to, if any. MediaType and Digest are then those of the manifest of -platform.
+	IndexDigest    string         `json:"indexDigest,omitempty"`
+	IndexMediaType string         `json:"indexMediaType,omitempty"`
+	Index          *ocispec.Index `json:"index,omitempty"`
+
+	// contentDigest is the Docker-Content-Digest of the last manifest response, checked against its content.
+	contentDigest string
+}
+
+func (t *Trace) recordRetry(e RetryEvent) {
+	if t == nil {
+		return
+	}
+	t.Retries = append(t.Retries, e)
+}
+
+// retryTransport retries idempotent requests that failed with 429, 5xx or a network error.
+type retryTransport struct {
+	Transport http.RoundTripper
+	Options   *RetryOptions
+	Trace     *Trace
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.Transport.RoundTrip(req)
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := t.Transport.RoundTrip(req)
+		retry, reason := shouldRetry(resp, err)
+		if !retry {
+			return resp, err
+		}
+
+		e := RetryEvent{
+			Time:    time.Now(),
+			Method:  req.Method,
+			URL:     req.URL.String(),
+			Attempt: attempt,
+			Reason:  reason,
+		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		var delay time.Duration
+		if resp != nil {
+			e.StatusCode = resp.StatusCode
+			delay, _ = retryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		if delay > 0 {
+			e.Reason += ", honouring Retry-After"
+		} else {
+			delay = t.Options.backoff(attempt)
+		}
+
+		switch {
+		case attempt > t.Options.MaxRetries:
+			e.Decision, e.Reason = RetryDecisionGiveUp, e.Reason+", per-request retries exhausted"
+		case delay > t.Options.MaxRetryAfter:
+			e.Decision, e.Reason = RetryDecisionGiveUp, e.Reason+", Retry-After exceeds "+t.Options.MaxRetryAfter.String()
+		case !t.Options.takeBudget():
+			e.Decision, e.Reason = RetryDecisionGiveUp, e.Reason+", retry budget exhausted"
+		default:
+			e.Decision, e.Delay = RetryDecisionRetry, delay.String()
+		}
+		t.Trace.recordRetry(e)
+		retriesTotal.WithLabelValues(req.URL.Host, e.Decision).Inc()
+		glog.V(2).Infof("%s %s attempt=%d status=%d decision=%s reason=%q delay=%s", e.Method, e.URL, e.Attempt, e.StatusCode, e.Decision, e.Reason, e.Delay)
+		if e.Decision == RetryDecisionGiveUp {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func shouldRetry(resp *http.Response, err error) (bool, string) {
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && (ne.Timeout() || ne.Temporary()) {
+			return true, "network error"
+		}
+		if _, ok := err.(*net.OpError); ok {
+			return true, "network error"
+		}
+		return false, ""
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true, "rate limited"
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true, "server error " + strconv.Itoa(resp.StatusCode)
+	}
+	return false, ""
+}
+
+// retryAfter parses a Retry-After header given either in seconds or as an HTTP date.
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	core "k8s.io/api/core/v1"
+)
+
+// SBOM formats of the sbom command.
+const (
+	SBOMFormatSPDX      = "spdx"
+	SBOMFormatCycloneDX = "cyclonedx"
+	SBOMFormatTable     = "table"
+
+	sbomTool          = "docker-image-puller"
+	spdxNoAssertion   = "NOASSERTION"
+	spdxNamespaceBase = "https://docker-image-puller.appscode.com/spdx/"
+)
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID                string            `json:"SPDXID"`
+	Name                  string            `json:"name"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	LicenseConcluded      string            `json:"licenseConcluded"`
+	LicenseDeclared       string            `json:"licenseDeclared"`
+	LicenseComments       string            `json:"licenseComments,omitempty"`
+	SourceInfo            string            `json:"sourceInfo,omitempty"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// SPDX returns the inventory as an SPDX 2.3 JSON document.
+// ref: https://spdx.github.io/spdx-spec/v2.3/
+func (inv *Inventory) SPDX() interface{} {
+	now := time.Now().UTC()
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              inv.Image,
+		DocumentNamespace: spdxNamespaceBase + inv.Image + "-" + newUUID(),
+		CreationInfo: spdxCreationInfo{
+			Created:  now.Format(time.RFC3339),
+			Creators: []string{"Tool: " + sbomTool},
+		},
+		Packages: []spdxPackage{{
+			SPDXID:                "SPDXRef-Image",
+			Name:                  inv.Image,
+			VersionInfo:           inv.Digest,
+			DownloadLocation:      spdxNoAssertion,
+			LicenseConcluded:      spdxNoAssertion,
+			LicenseDeclared:       spdxNoAssertion,
+			PrimaryPackagePurpose: "CONTAINER",
+		}},
+		Relationships: []spdxRelationship{{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Image"}},
+	}
+	for i, pkg := range inv.Packages {
+		id := fmt.Sprintf("SPDXRef-Package-%d", i)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			SPDXID:           id,
+			Name:             pkg.Name,
+			VersionInfo:      pkg.Version,
+			DownloadLocation: spdxNoAssertion,
+			LicenseConcluded: spdxNoAssertion,
+			// package databases do not always hold SPDX license expressions
+			LicenseDeclared: spdxNoAssertion,
+			LicenseComments: pkg.License,
+			SourceInfo:      "acquired package info from " + pkg.Path,
+			ExternalRefs:    []spdxExternalRef{{"PACKAGE-MANAGER", "purl", pkg.PURL}},
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{"SPDXRef-Image", "CONTAINS", id})
+	}
+	return doc
+}
+
+type cdxBOM struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     []cdxTool    `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTool struct {
+	Name string `json:"name"`
+}
+
+type cdxComponent struct {
+	BOMRef     string       `json:"bom-ref,omitempty"`
+	Type       string       `json:"type"`
+	Name       string       `json:"name"`
+	Version    string       `json:"version,omitempty"`
+	PURL       string       `json:"purl,omitempty"`
+	Licenses   []cdxLicense `json:"licenses,omitempty"`
+	Properties []cdxProp    `json:"properties,omitempty"`
+}
+
+type cdxLicense struct {
+	License struct {
+		Name string `json:"name"`
+	} `json:"license"`
+}
+
+type cdxProp struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// CycloneDX returns the inventory as a CycloneDX 1.5 JSON document.
+// ref: https://cyclonedx.org/docs/1.5/json/
+func (inv *Inventory) CycloneDX() interface{} {
+	bom := cdxBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Tools:     []cdxTool{{Name: sbomTool}},
+			Component: cdxComponent{BOMRef: inv.Image, Type: "container", Name: inv.Image, Version: inv.Digest},
+		},
+		Components: []cdxComponent{},
+	}
+	if rel := inv.OS; rel != nil {
+		bom.Components = append(bom.Components, cdxComponent{BOMRef: "os:" + rel.ID, Type: "operating-system", Name: rel.ID, Version: rel.VersionID})
+	}
+	for _, pkg := range inv.Packages {
+		c := cdxComponent{
+			BOMRef:     pkg.PURL,
+			Type:       "library",
+			Name:       pkg.Name,
+			Version:    pkg.Version,
+			PURL:       pkg.PURL,
+			Properties: []cdxProp{{Name: sbomTool + ":path", Value: pkg.Path}},
+		}
+		if pkg.License != "" {
+			var l cdxLicense
+			l.License.Name = pkg.License
+			c.Licenses = []cdxLicense{l}
+		}
+		bom.Components = append(bom.Components, c)
+	}
+	return bom
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func runSBOM(img string, pullSecrets []core.Secret, format string) {
+	result, err := PullImage(img, pullSecrets)
+	if err != nil {
+		regErr := ClassifyError(err, result.MediaType)
+		fmt.Fprintln(os.Stderr, regErr.Error())
+		os.Exit(regErr.ExitCode())
+	}
+	inv, err := ImageInventory(result)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, w := range inv.Warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", w)
+	}
+
+	var doc interface{}
+	switch format {
+	case SBOMFormatSPDX:
+		doc = inv.SPDX()
+	case SBOMFormatCycloneDX:
+		doc = inv.CycloneDX()
+	case SBOMFormatTable:
+		if inv.OS != nil {
+			fmt.Println("OS:", orDash(inv.OS.PrettyName))
+		}
+		for _, p := range inv.EmbeddedSBOMs {
+			fmt.Println("Embedded SBOM:", p)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tVERSION\tTYPE\tPATH")
+		for _, p := range inv.Packages {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Name, p.Version, p.Type, p.Path)
+		}
+		w.Flush()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown SBOM format %q\n", format)
+		os.Exit(1)
+	}
+	data, _ := json.MarshalIndent(doc, "", "  ")
+	fmt.Println(string(data))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/golang/glog"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ImageScan lists the known vulnerabilities of the packages of an image.
+type ImageScan struct {
+	Image           string          `json:"image"`
+	Digest          string          `json:"digest,omitempty"`
+	OS              *OSRelease      `json:"os,omitempty"`
+	Packages        int             `json:"packages"`
+	Vulnerabilities []Vulnerability `json:"vulnerabilities,omitempty"`
+	// Counts are the number of vulnerabilities by severity.
+	Counts   map[string]int `json:"counts"`
+	Warnings []string       `json:"warnings,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// PodScan sums up the vulnerabilities of the images of a Pod.
+type PodScan struct {
+	Namespace string         `json:"namespace"`
+	Pod       string         `json:"pod"`
+	Images    []string       `json:"images"`
+	Counts    map[string]int `json:"counts"`
+	Errors    []string       `json:"errors,omitempty"`
+}
+
+// ScanReport is the outcome of the scan command.
+type ScanReport struct {
+	Images []*ImageScan `json:"images"`
+	Pods   []PodScan    `json:"pods,omitempty"`
+}
+
+// ScanImage matches the package inventory of a pulled image against an advisory database.
+func ScanImage(db *AdvisoryDB, result *PullResult) (*ImageScan, error) {
+	inv, err := ImageInventory(result)
+	if err != nil {
+		return nil, err
+	}
+	s := &ImageScan{
+		Image:           result.Image,
+		Digest:          result.Digest,
+		OS:              inv.OS,
+		Packages:        len(inv.Packages),
+		Vulnerabilities: db.Match(inv),
+		Counts:          map[string]int{},
+		Warnings:        inv.Warnings,
+	}
+	if inv.OS != nil && inv.OS.ID != "debian" && inv.OS.ID != "alpine" && len(inv.Packages) > 0 {
+		s.Warnings = append(s.Warnings, fmt.Sprintf("OS packages of %s are not matched, only Debian and Alpine advisories are supported", inv.OS.ID))
+	}
+	sort.SliceStable(s.Vulnerabilities, func(i, j int) bool {
+		return severityRank(s.Vulnerabilities[i].Severity) < severityRank(s.Vulnerabilities[j].Severity)
+	})
+	for _, v := range s.Vulnerabilities {
+		s.Counts[v.Severity]++
+	}
+	return s, nil
+}
+
+func severityRank(severity string) int {
+	for i, s := range severityOrder {
+		if s == severity {
+			return i
+		}
+	}
+	return len(severityOrder)
+}
+
+// runScan scans img, or the images given with -images or -images-file, or else the images used by Pods.
+func runScan(img, dbPath string, opts *WatchOptions, kubeClient func() kubernetes.Interface, pullSecrets func() []core.Secret, namespace, output string) {
+	if dbPath == "" {
+		glog.Fatalln("The scan command needs an -advisory-db")
+	}
+	db, err := LoadAdvisoryDB(dbPath)
+	if err != nil {
+		glog.Fatalln(err)
+	}
+
+	report := &ScanReport{}
+	scans := map[string]*ImageScan{}
+	scan := func(img string, secrets []core.Secret, names []string) *ImageScan {
+		key := imageCheckKey(img, names)
+		if s, ok := scans[key]; ok {
+			return s
+		}
+		result, err := PullImage(img, secrets)
+		var s *ImageScan
+		if err == nil {
+			s, err = ScanImage(db, result)
+		}
+		if err != nil {
+			s = &ImageScan{Image: img, Counts: map[string]int{}, Error: ClassifyError(err, result.MediaType).Error()}
+		}
+		scans[key] = s
+		report.Images = append(report.Images, s)
+		return s
+	}
+
+	switch {
+	case img != "":
+		scan(img, pullSecrets(), nil)
+	case len(opts.Images) > 0 || opts.ImagesFile != "":
+		images, err := opts.images()
+		if err != nil {
+			glog.Fatalln(err)
+		}
+		secrets := pullSecrets()
+		for _, img := range images {
+			scan(img, secrets, nil)
+		}
+	default:
+		kc := kubeClient()
+		pods, err := kc.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+		if err != nil {
+			glog.Fatalln(err)
+		}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			secrets, names := podPullSecrets(kc, pod)
+			ps := PodScan{Namespace: pod.Namespace, Pod: pod.Name, Counts: map[string]int{}}
+			for _, img := range podImages(&pod.Spec) {
+				s := scan(img, secrets, names)
+				ps.Images = append(ps.Images, img)
+				for severity, n := range s.Counts {
+					ps.Counts[severity] += n
+				}
+				if s.Error != "" {
+					ps.Errors = append(ps.Errors, img+": "+s.Error)
+				}
+			}
+			report.Pods = append(report.Pods, ps)
+		}
+	}
+
+	if output == "json" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	counts := func(c map[string]int) string {
+		var cols []string
+		for _, s := range severityOrder {
+			cols = append(cols, strconv.Itoa(c[s]))
+		}
+		return strings.Join(cols, "\t")
+	}
+	header := strings.Join(severityOrder, "\t")
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "IMAGE\tOS\tPACKAGES\t%s\tERROR\n", header)
+	for _, s := range report.Images {
+		osName := "-"
+		if s.OS != nil {
+			osName = s.OS.ID + " " + s.OS.VersionID
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", s.Image, osName, s.Packages, counts(s.Counts), s.Error)
+	}
+	w.Flush()
+
+	if len(report.Pods) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "NAMESPACE\tPOD\tIMAGES\t%s\n", header)
+		for _, p := range report.Pods {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", p.Namespace, p.Pod, len(p.Images), counts(p.Counts))
+		}
+		w.Flush()
+	}
+
+	if img != "" {
+		s := report.Images[0]
+		for _, warning := range s.Warnings {
+			fmt.Fprintln(os.Stderr, "Warning:", warning)
+		}
+		if len(s.Vulnerabilities) > 0 {
+			fmt.Println()
+			w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "SEVERITY\tID\tPACKAGE\tVERSION\tFIXED\tSUMMARY")
+			for _, v := range s.Vulnerabilities {
+				id := v.ID
+				for _, a := range v.Aliases {
+					if strings.HasPrefix(a, "CVE-") {
+						id = a
+						break
+					}
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", v.Severity, id, v.Package, v.Version, orDash(v.FixedVersion), v.Summary)
+			}
+			w.Flush()
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"strings"
+
+	manifestV1 "github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/libtrust"
+	"github.com/golang/glog"
+)
+
+// Schema1Options configures the verification of the JWS signatures of schema1 manifests.
+type Schema1Options struct {
+	// TrustedKeys are the libtrust key IDs or SHA-256 fingerprints of the keys trusted to sign
+	// schema1 manifests. If set, schema1 images not signed by one of them fail the check.
+	TrustedKeys []string
+}
+
+func NewSchema1Options() *Schema1Options {
+	return &Schema1Options{}
+}
+
+func (o *Schema1Options) AddFlags(fs *flag.FlagSet) {
+	fs.Var((*stringList)(&o.TrustedKeys), "schema1-trusted-keys", "Comma separated key IDs (ABCD:EFGH:...) or SHA-256 fingerprints of the keys trusted to sign schema1 manifests; schema1 images not signed by one of them fail the check")
+}
+
+func (o *Schema1Options) trusted(key Schema1Key) bool {
+	for _, k := range o.TrustedKeys {
+		if strings.EqualFold(k, key.KeyID) || strings.EqualFold(k, key.Fingerprint) {
+			return true
+		}
+	}
+	return false
+}
+
+// Schema1Key is a key that signed a schema1 manifest.
+type Schema1Key struct {
+	KeyID string `json:"keyID"`
+	// Fingerprint is the hex encoded SHA-256 of the DER encoded key, like signature keys.
+	Fingerprint string `json:"fingerprint"`
+	Trusted     bool   `json:"trusted"`
+}
+
+// Schema1Verification is the outcome of verifying the signatures of a schema1 manifest.
+// Schema1 is deprecated, and registries sign with ephemeral keys, so a valid signature only
+// means something if the key is trusted. Otherwise the manifest is as good as unsigned.
+type Schema1Verification struct {
+	Deprecated bool         `json:"deprecated"`
+	Verified   bool         `json:"verified"`
+	Keys       []Schema1Key `json:"keys,omitempty"`
+	Trusted    bool         `json:"trusted"`
+	// UnsignedEquivalent is set unless a trusted key signed the manifest.
+	UnsignedEquivalent bool   `json:"unsignedEquivalent"`
+	Error              string `json:"error,omitempty"`
+}
+
+// VerifySchema1 checks the JWS signatures of a schema1 manifest and which keys signed it.
+func VerifySchema1(sm *manifestV1.SignedManifest, opts *Schema1Options) *Schema1Verification {
+	v := &Schema1Verification{Deprecated: true, UnsignedEquivalent: true}
+	keys, err := manifestV1.Verify(sm)
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+	v.Verified = true
+	for _, k := range keys {
+		key := Schema1Key{KeyID: k.KeyID(), Fingerprint: keyFingerprint(k)}
+		key.Trusted = opts.trusted(key)
+		if key.Trusted {
+			v.Trusted, v.UnsignedEquivalent = true, false
+		}
+		v.Keys = append(v.Keys, key)
+	}
+	if !v.Trusted && len(opts.TrustedKeys) > 0 {
+		v.Error = "not signed by a trusted key"
+	}
+	return v
+}
+
+func keyFingerprint(k libtrust.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(k.CryptoPublicKey())
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkSchema1 verifies a pulled schema1 manifest into result.Schema1. With -schema1-trusted-keys,
+// a manifest not signed by a trusted key fails the check.
+func checkSchema1(result *PullResult) error {
+	sm, ok := result.Manifest.(*manifestV1.SignedManifest)
+	if !ok {
+		return nil
+	}
+	v := VerifySchema1(sm, schema1Options)
+	result.Schema1 = v
+	glog.Warningf("Image %s uses the deprecated schema1 manifest format", result.Image)
+	if v.Trusted || len(schema1Options.TrustedKeys) == 0 {
+		return nil
+	}
+	return newRegistryError(CategorySignatureInvalid, fmt.Errorf("schema1 image %s: %s", result.Image, v.Error))
+}
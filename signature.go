@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	reg "github.com/appscode/docker-registry-client/registry"
+	manifestV2 "github.com/docker/distribution/manifest/schema2"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// cosign stores signatures as layers of an OCI manifest, tagged after the signed digest
+	// ref: https://github.com/sigstore/cosign/blob/main/specs/SIGNATURE_SPEC.md
+	cosignSignatureMediaType    = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignSignatureArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	cosignSignatureTagSuffix    = ".sig"
+
+	// maxSignatureBlobSize bounds the simple signing payloads read into memory.
+	maxSignatureBlobSize = 1 << 20
+
+	SignatureSourceTag       = "tag"
+	SignatureSourceReferrers = "referrers"
+)
+
+// SignatureOptions configures the verification of cosign signatures.
+type SignatureOptions struct {
+	Verify   bool
+	Require  bool
+	KeyFiles []string
+
+	keys []*PublicKey
+}
+
+func NewSignatureOptions() *SignatureOptions {
+	return &SignatureOptions{}
+}
+
+func (o *SignatureOptions) AddFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.Verify, "verify-signature", o.Verify, "Verify the cosign signatures of the pulled image against -signature-keys")
+	fs.BoolVar(&o.Require, "require-signature", o.Require, "Fail the check unless the image has a valid signature, implies -verify-signature")
+	fs.Var((*stringList)(&o.KeyFiles), "signature-keys", "Comma separated PEM files with the ECDSA, RSA or ed25519 public keys trusted to sign images")
+}
+
+// Enabled reports whether signatures are verified.
+func (o *SignatureOptions) Enabled() bool {
+	return o.Verify || o.Require
+}
+
+// Keys loads the trusted public keys.
+func (o *SignatureOptions) Keys() ([]*PublicKey, error) {
+	if o.keys != nil {
+		return o.keys, nil
+	}
+	for _, file := range o.KeyFiles {
+		key, err := LoadPublicKey(file)
+		if err != nil {
+			return nil, err
+		}
+		o.keys = append(o.keys, key)
+	}
+	return o.keys, nil
+}
+
+// PublicKey is a trusted signing key.
+type PublicKey struct {
+	Name string
+	// Fingerprint is the hex encoded SHA-256 of the DER encoded key.
+	Fingerprint string
+	Key         crypto.PublicKey
+}
+
+// LoadPublicKey reads a PEM encoded PKIX public key.
+func LoadPublicKey(file string) (*PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T", file, key)
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return &PublicKey{
+		Name:        strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+		Fingerprint: hex.EncodeToString(sum[:]),
+		Key:         key,
+	}, nil
+}
+
+// verify checks sig over payload, which cosign signs with SHA-256 for ECDSA and RSA keys.
+func (k *PublicKey) verify(payload, sig []byte) bool {
+	hash := sha256.Sum256(payload)
+	switch key := k.Key.(type) {
+	case *ecdsa.PublicKey:
+		var esig struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(sig, &esig); err != nil || len(rest) > 0 {
+			return false
+		}
+		return ecdsa.Verify(key, hash[:], esig.R, esig.S)
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil {
+			return true
+		}
+		return rsa.VerifyPSS(key, crypto.SHA256, hash[:], sig, nil) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, payload, sig)
+	}
+	return false
+}
+
+// SignatureVerification is the outcome of verifying the signatures of an image.
+type SignatureVerification struct {
+	Verified bool `json:"verified"`
+	// Source is where the signatures were found, the signature tag or the referrers API.
+	Source       string `json:"source,omitempty"`
+	SignatureRef string `json:"signatureRef,omitempty"`
+	// SignedDigest is the digest the valid signature signs, the image index or the platform manifest.
+	SignedDigest string `json:"signedDigest,omitempty"`
+	Signatures   int    `json:"signatures"`
+	// Signer is the name of the key file that verified a signature.
+	Signer         string                 `json:"signer,omitempty"`
+	KeyFingerprint string                 `json:"keyFingerprint,omitempty"`
+	Identity       string                 `json:"identity,omitempty"`
+	Annotations    map[string]interface{} `json:"annotations,omitempty"`
+	Error          string                 `json:"error,omitempty"`
+}
+
+// simpleSigning is the payload cosign signs.
+// ref: https://github.com/containers/image/blob/main/docs/containers-signature.5.md
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional,omitempty"`
+}
+
+// VerifySignature looks up the cosign signatures of a pulled image, first with the sha256-<hex>.sig
+// tag, then with the OCI referrers API, and verifies them against keys. Multi-platform images are
+// usually signed by the digest of their image index, so it is tried before the platform manifest.
+// The signed payload must name the digest the signature was found for.
+func VerifySignature(result *PullResult, keys []*PublicKey) *SignatureVerification {
+	v := &SignatureVerification{}
+	d, err := digest.Parse(result.Digest)
+	if err != nil {
+		v.Error = fmt.Sprintf("image digest %q is unknown, the registry did not report it", result.Digest)
+		return v
+	}
+	if len(keys) == 0 {
+		v.Error = "no signature keys configured"
+		return v
+	}
+	hub, err := result.artifactClient()
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+
+	digests := []digest.Digest{d}
+	if idx, err := digest.Parse(result.IndexDigest); err == nil {
+		digests = []digest.Digest{idx, d}
+	}
+	var problems []string
+	for _, signed := range digests {
+		manifests, err := signatureManifests(hub, result.Repository, signed, v)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		for _, m := range manifests {
+			for _, layer := range m.Layers {
+				if layer.MediaType != cosignSignatureMediaType {
+					continue
+				}
+				v.Signatures++
+				if err := verifyLayer(hub, result, signed, layer, keys, v); err != nil {
+					problems = append(problems, err.Error())
+					continue
+				}
+				v.SignedDigest = signed.String()
+				return v
+			}
+		}
+	}
+	if len(problems) == 0 {
+		v.Error = "no signatures found"
+	} else {
+		v.Error = strings.Join(problems, "; ")
+	}
+	return v
+}
+
+func verifyLayer(hub *reg.Registry, result *PullResult, d digest.Digest, layer ocispec.Descriptor, keys []*PublicKey, v *SignatureVerification) error {
+	sig, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+	if err != nil || len(sig) == 0 {
+		return fmt.Errorf("signature %s: missing or invalid %s annotation", layer.Digest, cosignSignatureAnnotation)
+	}
+	payload, err := fetchBlob(hub, result.Repository, layer.Digest, maxSignatureBlobSize)
+	if err != nil {
+		return fmt.Errorf("signature %s: %v", layer.Digest, err)
+	}
+
+	var signer *PublicKey
+	for _, k := range keys {
+		if k.verify(payload, sig) {
+			signer = k
+			break
+		}
+	}
+	if signer == nil {
+		return fmt.Errorf("signature %s: not signed by a trusted key", layer.Digest)
+	}
+
+	var ss simpleSigning
+	if err := json.Unmarshal(payload, &ss); err != nil {
+		return fmt.Errorf("signature %s: invalid payload: %v", layer.Digest, err)
+	}
+	if ss.Critical.Image.DockerManifestDigest != d.String() {
+		return fmt.Errorf("signature %s: signs digest %s, not %s", layer.Digest, ss.Critical.Image.DockerManifestDigest, d)
+	}
+
+	v.Verified = true
+	v.Signer = signer.Name
+	v.KeyFingerprint = signer.Fingerprint
+	v.Identity = ss.Critical.Identity.DockerReference
+	v.Annotations = ss.Optional
+	return nil
+}
+
+// signatureManifests returns the cosign signature manifests of digest d, recording where they were found in v.
+func signatureManifests(hub *reg.Registry, repo string, d digest.Digest, v *SignatureVerification) ([]*ocispec.Manifest, error) {
+	tag := referrersTag(d) + cosignSignatureTagSuffix
+	m, err := fetchOCIManifest(hub, repo, tag)
+	if err == nil {
+		v.Source, v.SignatureRef = SignatureSourceTag, tag
+		return []*ocispec.Manifest{m}, nil
+	}
+	if ClassifyError(err, "").Category != CategoryNotFound {
+		return nil, err
+	}
+	glog.V(3).Infof("Signature tag %s not found, trying referrers", tag)
+
+	refs, err := FindReferrers(hub, repo, d, cosignSignatureArtifactType)
+	if err != nil {
+		return nil, err
+	}
+	var manifests []*ocispec.Manifest
+	for _, ref := range refs {
+		m, err := fetchOCIManifest(hub, repo, ref.Digest.String())
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, m)
+	}
+	if len(manifests) > 0 {
+		v.Source, v.SignatureRef = SignatureSourceReferrers, refs[0].Digest.String()
+	}
+	return manifests, nil
+}
+
+// manifestURL returns the URL of a manifest, like the registry client builds it.
+func manifestURL(hub *reg.Registry, repo, ref string) string {
+	return fmt.Sprintf("%s/v2/%s/manifests/%s", strings.TrimSuffix(hub.URL, "/"), repo, ref)
+}
+
+// fetchOCIManifest fetches an OCI image manifest, which the registry client does not accept.
+// If ref is a digest, the content is verified against it.
+func fetchOCIManifest(hub *reg.Registry, repo, ref string) (*ocispec.Manifest, error) {
+	data, err := fetchJSON(hub, manifestURL(hub, repo, ref), ocispec.MediaTypeImageManifest, manifestV2.MediaTypeManifest)
+	if err != nil {
+		return nil, err
+	}
+	if d, err := digest.Parse(ref); err == nil {
+		verifier := d.Verifier()
+		verifier.Write(data)
+		if !verifier.Verified() {
+			return nil, fmt.Errorf("manifest %s does not match its digest", d)
+		}
+	}
+	var m ocispec.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", ref, err)
+	}
+	return &m, nil
+}
+
+// fetchJSON GETs a registry API document of at most maxConfigSize bytes.
+func fetchJSON(hub *reg.Registry, url string, accept ...string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(accept, ","))
+	resp, err := hub.Client.Do(req)
+	if err != nil {
+		return nil, ClassifyError(err, "")
+	}
+	defer resp.Body.Close()
+	w := &limitedBuffer{limit: maxConfigSize}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return nil, err
+	}
+	return w.data, nil
+}
+
+// checkSignature verifies the signatures of a pulled image into result.Signature. With -require-signature,
+// an image without a valid signature fails the check.
+func checkSignature(result *PullResult) error {
+	keys, err := signatureOptions.Keys()
+	if err != nil {
+		return err
+	}
+	v := VerifySignature(result, keys)
+	result.Signature = v
+	if v.Verified || !signatureOptions.Require {
+		return nil
+	}
+	category := CategorySignatureInvalid
+	if v.Signatures == 0 {
+		category = CategorySignatureMissing
+	}
+	return newRegistryError(category, fmt.Errorf("image %s: %s", result.Image, v.Error))
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	units "github.com/docker/go-units"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ImageSize is the compressed size of an image and its layers.
+type ImageSize struct {
+	Image     string  `json:"image"`
+	Digest    string  `json:"digest,omitempty"`
+	MediaType string  `json:"mediaType,omitempty"`
+	Size      int64   `json:"size"`
+	Layers    []Layer `json:"layers,omitempty"`
+	// UniqueSize is the size of the layers no other image of the report uses, the cost of pulling
+	// this image onto a node that already has all the others.
+	UniqueSize int64  `json:"uniqueSize"`
+	Error      string `json:"error,omitempty"`
+}
+
+// SharedLayer is a layer used by more than one image.
+type SharedLayer struct {
+	Digest string   `json:"digest"`
+	Size   int64    `json:"size"`
+	Images []string `json:"images"`
+}
+
+// SizeReport compares the sizes of a set of images, as a node pulling all of them would store them.
+type SizeReport struct {
+	// Images are sorted largest first.
+	Images       []ImageSize   `json:"images"`
+	SharedLayers []SharedLayer `json:"sharedLayers,omitempty"`
+	// TotalSize is the sum of the image sizes, DedupedSize counts every layer once.
+	TotalSize   int64 `json:"totalSize"`
+	DedupedSize int64 `json:"dedupedSize"`
+	// SharingRatio is the fraction of TotalSize saved by sharing layers.
+	SharingRatio float64 `json:"sharingRatio"`
+	// BaseLayerSharingRatio is the fraction of images whose base layer is used by another image.
+	BaseLayerSharingRatio float64 `json:"baseLayerSharingRatio"`
+}
+
+// MeasureImage returns the size and layers of a pulled image. Schema1 manifests do not record
+// layer sizes, so they are looked up with HEAD requests.
+func MeasureImage(result *PullResult) (ImageSize, error) {
+	s := ImageSize{
+		Image:     result.Image,
+		Digest:    result.Digest,
+		MediaType: result.MediaType,
+		Size:      ManifestSize(result.Manifest),
+		Layers:    Layers(result.Manifest),
+	}
+	if s.Size > 0 || len(s.Layers) == 0 {
+		return s, nil
+	}
+	hub, err := result.client()
+	if err != nil {
+		return s, err
+	}
+	for i := range s.Layers {
+		desc, err := hub.LayerMetadata(result.Repository, digest.Digest(s.Layers[i].Digest))
+		if err != nil {
+			return s, ClassifyError(err, "")
+		}
+		s.Layers[i].Size = desc.Size
+		s.Size += desc.Size
+	}
+	return s, nil
+}
+
+// NewSizeReport computes layer sharing across images. Images that could not be measured are kept but not counted.
+func NewSizeReport(images []ImageSize) *SizeReport {
+	r := &SizeReport{Images: images}
+
+	users := map[string][]string{}
+	sizes := map[string]int64{}
+	for _, img := range images {
+		if img.Error != "" {
+			continue
+		}
+		r.TotalSize += img.Size
+		layerSize := int64(0)
+		for _, l := range img.Layers {
+			layerSize += l.Size
+			if _, ok := sizes[l.Digest]; !ok {
+				sizes[l.Digest] = l.Size
+				r.DedupedSize += l.Size
+			}
+			users[l.Digest] = appendUnique(users[l.Digest], img.Image)
+		}
+		// the config blob is never shared
+		r.DedupedSize += img.Size - layerSize
+	}
+
+	var measured, sharedBase int
+	for i := range r.Images {
+		img := &r.Images[i]
+		if img.Error != "" {
+			continue
+		}
+		measured++
+		img.UniqueSize = img.Size
+		for _, l := range img.Layers {
+			if len(users[l.Digest]) > 1 {
+				img.UniqueSize -= l.Size
+			}
+		}
+		if len(img.Layers) > 0 && len(users[img.Layers[0].Digest]) > 1 {
+			sharedBase++
+		}
+	}
+	for d, imgs := range users {
+		if len(imgs) > 1 {
+			r.SharedLayers = append(r.SharedLayers, SharedLayer{Digest: d, Size: sizes[d], Images: imgs})
+		}
+	}
+
+	sort.SliceStable(r.Images, func(i, j int) bool { return r.Images[i].Size > r.Images[j].Size })
+	// layers saving the most space first
+	sort.Slice(r.SharedLayers, func(i, j int) bool {
+		si := r.SharedLayers[i].Size * int64(len(r.SharedLayers[i].Images)-1)
+		sj := r.SharedLayers[j].Size * int64(len(r.SharedLayers[j].Images)-1)
+		if si != sj {
+			return si > sj
+		}
+		return r.SharedLayers[i].Digest < r.SharedLayers[j].Digest
+	})
+	if r.TotalSize > 0 {
+		r.SharingRatio = 1 - float64(r.DedupedSize)/float64(r.TotalSize)
+	}
+	if measured > 0 {
+		r.BaseLayerSharingRatio = float64(sharedBase) / float64(measured)
+	}
+	return r
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// sizeTarget is an image to measure along with the pull secrets to use for it.
+type sizeTarget struct {
+	image       string
+	pullSecrets []core.Secret
+}
+
+// podImageTargets returns the images used by the Pods of namespace, each with the pull secrets of the first Pod using it.
+func podImageTargets(kc kubernetes.Interface, namespace string) ([]sizeTarget, error) {
+	pods, err := kc.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var targets []sizeTarget
+	seen := map[string]bool{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		var pullSecrets []core.Secret
+		for _, img := range podImages(&pod.Spec) {
+			if seen[img] {
+				continue
+			}
+			seen[img] = true
+			if pullSecrets == nil {
+				pullSecrets, _ = podPullSecrets(kc, pod)
+			}
+			targets = append(targets, sizeTarget{image: img, pullSecrets: pullSecrets})
+		}
+	}
+	return targets, nil
+}
+
+// runSize reports the sizes of the images given with -images or -images-file, or else of the images used by Pods.
+func runSize(opts *WatchOptions, kubeClient func() kubernetes.Interface, pullSecrets func() []core.Secret, namespace, output string) {
+	var targets []sizeTarget
+	if len(opts.Images) > 0 || opts.ImagesFile != "" {
+		images, err := opts.images()
+		if err != nil {
+			glog.Fatalln(err)
+		}
+		secrets := pullSecrets()
+		for _, img := range images {
+			targets = append(targets, sizeTarget{image: img, pullSecrets: secrets})
+		}
+	} else {
+		var err error
+		if targets, err = podImageTargets(kubeClient(), namespace); err != nil {
+			glog.Fatalln(err)
+		}
+	}
+
+	var sizes []ImageSize
+	for _, t := range targets {
+		result, err := PullImage(t.image, t.pullSecrets)
+		var s ImageSize
+		if err == nil {
+			s, err = MeasureImage(result)
+		}
+		if err != nil {
+			s = ImageSize{Image: t.image, Error: ClassifyError(err, result.MediaType).Error()}
+		}
+		sizes = append(sizes, s)
+	}
+	report := NewSizeReport(sizes)
+
+	if output == "json" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tSIZE\tUNIQUE\tLAYERS\tDIGEST\tERROR")
+	for _, s := range report.Images {
+		if s.Error != "" {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t%s\n", s.Image, s.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t\n", s.Image, units.HumanSize(float64(s.Size)), units.HumanSize(float64(s.UniqueSize)), len(s.Layers), orDash(shortDigest(s.Digest)))
+	}
+	w.Flush()
+
+	if len(report.SharedLayers) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SHARED LAYER\tSIZE\tIMAGES")
+		for _, l := range report.SharedLayers {
+			fmt.Fprintf(w, "%s\t%s\t%d\n", shortDigest(l.Digest), units.HumanSize(float64(l.Size)), len(l.Images))
+		}
+		w.Flush()
+	}
+
+	fmt.Println()
+	fmt.Printf("Total size: %s, deduplicated: %s, saved by sharing: %.1f%%\n",
+		units.HumanSize(float64(report.TotalSize)), units.HumanSize(float64(report.DedupedSize)), report.SharingRatio*100)
+	fmt.Printf("Images sharing their base layer: %.1f%%\n", report.BaseLayerSharingRatio*100)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"k8s.io/api/core/v1"
+	"k8s.io/kubernetes/pkg/credentialprovider"
+)
+
+const (
+	credentialSourceAnonymous = "anonymous"
+	credentialSourceUnknown   = "unknown"
+)
+
+// CredentialSources maps the credentials found for an image to the pull secret or node provider
+// that supplied them, e.g. "secret:default/regcred" or "provider:ecr".
+type CredentialSources map[string]string
+
+// secretSource is the credential source name of a pull secret.
+func secretSource(sec *v1.Secret) string {
+	return "secret:" + sec.Namespace + "/" + sec.Name
+}
+
+func credentialSources(image string, pullSecrets []v1.Secret, providers CredentialProviders) CredentialSources {
+	sources := CredentialSources{}
+	// pull secrets are added last, so they win when a provider returns the same credentials,
+	// matching the kubelet which tries pull secrets first
+	for _, p := range providers {
+		if p.Enabled() {
+			sources.add(CredentialProviders{p}.Keyring(), image, "provider:"+p.Name)
+		}
+	}
+	for i := range pullSecrets {
+		keyring, err := credentialprovider.MakeDockerKeyring(pullSecrets[i:i+1], &credentialprovider.BasicDockerKeyring{})
+		if err != nil {
+			continue
+		}
+		sources.add(keyring, image, secretSource(&pullSecrets[i]))
+	}
+	return sources
+}
+
+func (s CredentialSources) add(keyring credentialprovider.DockerKeyring, image, source string) {
+	creds, _ := keyring.Lookup(image)
+	for _, c := range creds {
+		s[credentialKey(c.Username, c.Password)] = source
+	}
+}
+
+// Lookup returns the source of the given credentials.
+func (s CredentialSources) Lookup(username, password string) string {
+	if source, ok := s[credentialKey(username, password)]; ok {
+		return source
+	}
+	return credentialSourceUnknown
+}
+
+func credentialKey(username, password string) string {
+	return username + "\x00" + password
+}
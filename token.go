@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	reg "github.com/appscode/docker-registry-client/registry"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// CatalogScope grants access to the registry catalog (/v2/_catalog).
+	CatalogScope = "registry:catalog:*"
+
+	defaultTokenClientID = "docker-image-puller"
+	// minimum token lifetime if the token server does not say
+	// ref: https://docs.docker.com/registry/spec/auth/token/#token-response-fields
+	defaultTokenExpiry = 60 * time.Second
+)
+
+// RepositoryScope returns the token scope for actions on a repository, e.g. "repository:library/nginx:pull,push".
+func RepositoryScope(repo string, actions ...string) string {
+	if len(actions) == 0 {
+		actions = []string{"pull"}
+	}
+	return fmt.Sprintf("repository:%s:%s", repo, strings.Join(actions, ","))
+}
+
+// tokenTransport implements the registry token authentication flow. It requests tokens for the
+// scope of the registry challenge plus all Scopes declared up front, using either the GET flow
+// with basic auth or the OAuth2 POST flow with a password or refresh token.
+// ref: https://docs.docker.com/registry/spec/auth/token/
+// ref: https://docs.docker.com/registry/spec/auth/oauth/
+type tokenTransport struct {
+	Transport http.RoundTripper
+	// Host is the registry host. Tokens are only sent to it and to hosts that issued a challenge,
+	// not to the storage backends registries redirect blob downloads to.
+	Host     string
+	Username string
+	Password string
+	// IdentityToken is an OAuth2 refresh token, as stored in the identitytoken field of a docker config.
+	IdentityToken string
+	// RegistryToken is a bearer token sent to the registry as is.
+	RegistryToken string
+	Scopes        []string
+	// ForceOAuth uses the OAuth2 password grant instead of basic auth when no identity token is available.
+	ForceOAuth bool
+
+	mu        sync.Mutex
+	challenge *tokenChallenge
+	tokens    map[string]*bearerToken
+}
+
+type tokenChallenge struct {
+	Realm   string
+	Service string
+	Scope   string
+	// Host is the host whose response carried the challenge.
+	Host string
+}
+
+type bearerToken struct {
+	Token     string
+	ExpiresAt time.Time
+}
+
+type tokenResponse struct {
+	Token        string    `json:"token"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresIn    int       `json:"expires_in"`
+	IssuedAt     time.Time `json:"issued_at"`
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+	if t.RegistryToken != "" {
+		if t.Host != "" && host != t.Host {
+			return t.Transport.RoundTrip(req)
+		}
+		return t.Transport.RoundTrip(withBearer(req, t.RegistryToken))
+	}
+
+	// reuse a token from an earlier challenge to save a round trip
+	if challenge := t.lastChallenge(); challenge != nil && (t.Host == "" || host == t.Host || host == challenge.Host) {
+		if token := t.cachedToken(challenge); token != "" {
+			req = withBearer(req, token)
+		}
+	}
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	challenge := parseBearerChallenge(resp)
+	if challenge == nil {
+		return resp, nil
+	}
+	challenge.Host = host
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	token, authResp, err := t.fetchToken(challenge)
+	if err != nil || authResp != nil {
+		return authResp, err
+	}
+	retry, err := rewindBody(withBearer(req, token))
+	if err != nil {
+		return nil, err
+	}
+	return t.Transport.RoundTrip(retry)
+}
+
+func (t *tokenTransport) lastChallenge() *tokenChallenge {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.challenge
+}
+
+// scopes returns the sorted, de-duplicated scopes to request for a challenge.
+func (t *tokenTransport) scopes(challenge *tokenChallenge) []string {
+	seen := map[string]bool{}
+	var scopes []string
+	for _, s := range append(strings.Fields(challenge.Scope), t.Scopes...) {
+		if s != "" && !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+func (t *tokenTransport) cacheKey(challenge *tokenChallenge, scopes []string) string {
+	return challenge.Realm + "|" + challenge.Service + "|" + strings.Join(scopes, " ")
+}
+
+func (t *tokenTransport) cachedToken(challenge *tokenChallenge) string {
+	if challenge == nil {
+		return ""
+	}
+	key := t.cacheKey(challenge, t.scopes(challenge))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tok, ok := t.tokens[key]; ok && time.Now().Before(tok.ExpiresAt) {
+		return tok.Token
+	}
+	return ""
+}
+
+// fetchToken returns a bearer token for the challenge. If the token server refuses, its response
+// is returned instead, so the caller can report the status and body.
+func (t *tokenTransport) fetchToken(challenge *tokenChallenge) (string, *http.Response, error) {
+	scopes := t.scopes(challenge)
+	defer observeDuration(tokenFetchDuration, challenge.Realm, time.Now())
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	t.mu.Lock()
+	refreshToken := t.IdentityToken
+	t.mu.Unlock()
+	switch {
+	case refreshToken != "":
+		resp, err = t.postToken(challenge, scopes, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refreshToken},
+		})
+	case t.ForceOAuth && t.Password != "":
+		resp, err = t.postToken(challenge, scopes, url.Values{
+			"grant_type":  {"password"},
+			"username":    {t.Username},
+			"password":    {t.Password},
+			"access_type": {"offline"},
+		})
+		// token servers without OAuth2 support answer 404 or 405, fall back to basic auth
+		if err == nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed) {
+			resp.Body.Close()
+			resp, err = t.getToken(challenge, scopes)
+		}
+	default:
+		resp, err = t.getToken(challenge, scopes)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", resp, nil
+	}
+	defer resp.Body.Close()
+
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", nil, fmt.Errorf("failed to decode token response from %s: %v", challenge.Realm, err)
+	}
+	token := tr.AccessToken
+	if token == "" {
+		token = tr.Token
+	}
+	if token == "" {
+		return "", nil, fmt.Errorf("token server %s returned no token", challenge.Realm)
+	}
+
+	issuedAt := tr.IssuedAt
+	if issuedAt.IsZero() {
+		issuedAt = time.Now()
+	}
+	expiresIn := time.Duration(tr.ExpiresIn) * time.Second
+	if expiresIn < defaultTokenExpiry {
+		expiresIn = defaultTokenExpiry
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tokens == nil {
+		t.tokens = map[string]*bearerToken{}
+	}
+	t.tokens[t.cacheKey(challenge, scopes)] = &bearerToken{Token: token, ExpiresAt: issuedAt.Add(expiresIn)}
+	t.challenge = challenge
+	if tr.RefreshToken != "" {
+		t.IdentityToken = tr.RefreshToken
+	}
+	return token, nil, nil
+}
+
+// getToken requests a token with GET, passing each scope as a separate parameter.
+func (t *tokenTransport) getToken(challenge *tokenChallenge, scopes []string) (*http.Response, error) {
+	u, err := url.Parse(challenge.Realm)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	if challenge.Service != "" {
+		q.Set("service", challenge.Service)
+	}
+	for _, s := range scopes {
+		q.Add("scope", s)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if t.Username != "" || t.Password != "" {
+		req.SetBasicAuth(t.Username, t.Password)
+	}
+	return t.Transport.RoundTrip(req)
+}
+
+// postToken requests a token with the OAuth2 POST flow. Scopes are space separated.
+func (t *tokenTransport) postToken(challenge *tokenChallenge, scopes []string, form url.Values) (*http.Response, error) {
+	form.Set("client_id", defaultTokenClientID)
+	if challenge.Service != "" {
+		form.Set("service", challenge.Service)
+	}
+	if len(scopes) > 0 {
+		form.Set("scope", strings.Join(scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, challenge.Realm, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return t.Transport.RoundTrip(req)
+}
+
+func parseBearerChallenge(resp *http.Response) *tokenChallenge {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+	for _, h := range resp.Header[http.CanonicalHeaderKey("WWW-Authenticate")] {
+		scheme, params := parseChallenge(h)
+		if strings.EqualFold(scheme, "bearer") && params["realm"] != "" {
+			return &tokenChallenge{
+				Realm:   params["realm"],
+				Service: params["service"],
+				Scope:   params["scope"],
+			}
+		}
+	}
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull"
+func parseChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	header = strings.TrimSpace(header)
+	i := strings.IndexAny(header, " \t")
+	if i < 0 {
+		return header, params
+	}
+	scheme, rest := header[:i], header[i+1:]
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end > len(rest) {
+				end = len(rest)
+			}
+			value = strings.Replace(rest[1:end], `\"`, `"`, -1)
+			if end < len(rest) {
+				end++
+			}
+			rest = rest[end:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
+
+// withBearer returns a copy of req with a bearer Authorization header.
+func withBearer(req *http.Request, token string) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// rewindBody resets the body of a request that is about to be sent again.
+func rewindBody(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, fmt.Errorf("can not retry %s %s with an authorization token: request body can not be rewound", req.Method, req.URL)
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = body
+	return req, nil
+}
+
+// wrapTransport builds the registry transport stack, like reg.WrapTransport, but with a token
+// transport that requests the given scopes and supports OAuth2 identity tokens.
+func wrapTransport(transport http.RoundTripper, auth *AuthConfig, scopes []string) http.RoundTripper {
+	// without a host, tokens are sent with every request as before
+	host, _ := registryHost(auth.ServerAddress)
+	return &reg.ErrorTransport{
+		Transport: &reg.BasicTransport{
+			Transport: &tokenTransport{
+				Transport:     transport,
+				Host:          host,
+				Username:      auth.Username,
+				Password:      auth.Password,
+				IdentityToken: auth.IdentityToken,
+				RegistryToken: auth.RegistryToken,
+				Scopes:        scopes,
+				ForceOAuth:    forceOAuth,
+			},
+			URL:      auth.ServerAddress,
+			Username: auth.Username,
+			Password: auth.Password,
+		},
+	}
+}
+
+// IdentityTokens indexes the OAuth2 identity tokens stored in docker config pull secrets.
+// The kubelet keyring drops these, so they are read from the secrets directly.
+type IdentityTokens map[string]string
+
+func identityTokenKey(registry, username string) string {
+	return canonicalRegistryHost(registry) + "|" + username
+}
+
+// NewIdentityTokens collects identity tokens of the docker config entries in pullSecrets.
+func NewIdentityTokens(pullSecrets []v1.Secret) IdentityTokens {
+	tokens := IdentityTokens{}
+	for _, sec := range pullSecrets {
+		var auths map[string]dockerConfigAuth
+		if data, ok := sec.Data[v1.DockerConfigJsonKey]; ok && sec.Type == v1.SecretTypeDockerConfigJson {
+			var cfg struct {
+				Auths map[string]dockerConfigAuth `json:"auths"`
+			}
+			if json.Unmarshal(data, &cfg) != nil {
+				continue
+			}
+			auths = cfg.Auths
+		} else if data, ok := sec.Data[v1.DockerConfigKey]; ok && sec.Type == v1.SecretTypeDockercfg {
+			if json.Unmarshal(data, &auths) != nil {
+				continue
+			}
+		}
+		for registry, a := range auths {
+			if a.IdentityToken == "" {
+				continue
+			}
+			tokens[identityTokenKey(registry, a.username())] = a.IdentityToken
+		}
+	}
+	return tokens
+}
+
+// Lookup returns the identity token stored for username on registry.
+func (t IdentityTokens) Lookup(registry, username string) string {
+	return t[identityTokenKey(registry, username)]
+}
+
+type dockerConfigAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+func (a dockerConfigAuth) username() string {
+	if a.Username != "" {
+		return a.Username
+	}
+	decoded, err := decodeDockerConfigAuth(a.Auth)
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(decoded, ":", 2)[0]
+}
+
+// canonicalRegistryHost maps the different names of Docker Hub to docker.io and strips scheme and path.
+func canonicalRegistryHost(registry string) string {
+	host, err := registryHost(registry)
+	if err != nil {
+		return registry
+	}
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+	return host
+}
+
+func decodeDockerConfigAuth(auth string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeTokenRegistry serves a registry that demands a bearer token and redirects blob downloads to storage.
+func fakeTokenRegistry(storage string) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			fmt.Fprint(w, `{"token":"registry-token","expires_in":300}`)
+		case r.Header.Get("Authorization") != "Bearer registry-token":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			http.Redirect(w, r, storage+r.URL.Path, http.StatusTemporaryRedirect)
+		}
+	}))
+	return srv
+}
+
+func TestTokenTransportRedirect(t *testing.T) {
+	var storageAuth []string
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storageAuth = append(storageAuth, r.Header.Get("Authorization"))
+	}))
+	defer storage.Close()
+	registry := fakeTokenRegistry(storage.URL)
+	defer registry.Close()
+
+	for _, auth := range []*AuthConfig{
+		{ServerAddress: registry.URL},
+		{ServerAddress: registry.URL, RegistryToken: "registry-token"},
+	} {
+		storageAuth = nil
+		client := &http.Client{Transport: wrapTransport(http.DefaultTransport, auth, nil)}
+		// the second download reuses the cached token
+		for i := 0; i < 2; i++ {
+			resp, err := client.Get(registry.URL + "/v2/team/app/blobs/sha256:aaa")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("registry token %q: download %d: status %d", auth.RegistryToken, i, resp.StatusCode)
+			}
+		}
+		if len(storageAuth) != 2 || storageAuth[0] != "" || storageAuth[1] != "" {
+			t.Errorf("registry token %q: storage got Authorization headers %q, want none", auth.RegistryToken, storageAuth)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransportOptions configures the HTTP transports used to talk to registries.
+type TransportOptions struct {
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	RequestTimeout        time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConnsPerHost   int
+	DisableKeepAlives     bool
+
+	// RegistryProxies maps a registry host to the proxy used to reach it.
+	// Registries without an entry use HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+	RegistryProxies RegistryProxies
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+func NewTransportOptions() *TransportOptions {
+	return &TransportOptions{
+		DialTimeout:           30 * time.Second,
+		KeepAlive:             30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		RequestTimeout:        2 * time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   2,
+		RegistryProxies:       RegistryProxies{},
+	}
+}
+
+func (o *TransportOptions) AddFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&o.DialTimeout, "dial-timeout", o.DialTimeout, "Maximum time to wait for a TCP connection to a registry")
+	fs.DurationVar(&o.KeepAlive, "keep-alive", o.KeepAlive, "Keep-alive period for registry connections")
+	fs.DurationVar(&o.TLSHandshakeTimeout, "tls-handshake-timeout", o.TLSHandshakeTimeout, "Maximum time to wait for a TLS handshake with a registry")
+	fs.DurationVar(&o.ResponseHeaderTimeout, "response-header-timeout", o.ResponseHeaderTimeout, "Maximum time to wait for response headers from a registry")
+	fs.DurationVar(&o.RequestTimeout, "request-timeout", o.RequestTimeout, "Maximum time for a single registry request, including reading the body (0 means no limit)")
+	fs.DurationVar(&o.IdleConnTimeout, "idle-conn-timeout", o.IdleConnTimeout, "Maximum time an idle registry connection is kept open")
+	fs.IntVar(&o.MaxIdleConnsPerHost, "max-idle-conns-per-host", o.MaxIdleConnsPerHost, "Maximum idle connections kept per registry host")
+	fs.BoolVar(&o.DisableKeepAlives, "disable-keep-alives", o.DisableKeepAlives, "Open a new connection for every registry request")
+	fs.Var(o.RegistryProxies, "registry-proxy", "Proxy for a registry as host=proxyURL, or host=direct to bypass proxies (can be repeated)")
+}
+
+// TransportFor returns the transport used to reach the registry at serverAddress.
+// Transports are shared per registry host, so connections are reused across pulls.
+func (o *TransportOptions) TransportFor(serverAddress string) (*http.Transport, error) {
+	host, err := registryHost(serverAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if t, ok := o.transports[host]; ok {
+		return t, nil
+	}
+	t := &http.Transport{
+		Proxy: o.proxyFunc(host),
+		DialContext: (&net.Dialer{
+			Timeout:   o.DialTimeout,
+			KeepAlive: o.KeepAlive,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   o.MaxIdleConnsPerHost,
+		IdleConnTimeout:       o.IdleConnTimeout,
+		TLSHandshakeTimeout:   o.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: o.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableKeepAlives:     o.DisableKeepAlives,
+	}
+	if o.transports == nil {
+		o.transports = map[string]*http.Transport{}
+	}
+	o.transports[host] = t
+	return t, nil
+}
+
+func (o *TransportOptions) proxyFunc(host string) func(*http.Request) (*url.URL, error) {
+	proxy, ok := o.RegistryProxies[host]
+	if !ok {
+		return http.ProxyFromEnvironment
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		// token realms and blob redirects may live on other hosts
+		if h, _ := registryHost(req.URL.Host); h != host {
+			return http.ProxyFromEnvironment(req)
+		}
+		return proxy, nil
+	}
+}
+
+// RegistryProxies is a flag.Value of registry host to proxy URL. A nil URL means direct.
+type RegistryProxies map[string]*url.URL
+
+var _ flag.Value = RegistryProxies{}
+
+func (p RegistryProxies) String() string {
+	var entries []string
+	for host, proxy := range p {
+		if proxy == nil {
+			entries = append(entries, host+"=direct")
+		} else {
+			entries = append(entries, host+"="+proxy.String())
+		}
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func (p RegistryProxies) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("registry proxy %q must be of the form host=proxyURL", value)
+	}
+	host, err := registryHost(parts[0])
+	if err != nil {
+		return err
+	}
+	if parts[1] == "direct" {
+		p[host] = nil
+		return nil
+	}
+	proxy, err := url.Parse(parts[1])
+	if err != nil {
+		return err
+	}
+	if proxy.Scheme == "" || proxy.Host == "" {
+		return fmt.Errorf("proxy %q for registry %s must be an absolute URL", parts[1], host)
+	}
+	p[host] = proxy
+	return nil
+}
+
+// registryHost returns the lower-cased host[:port] of a registry address with or without scheme.
+func registryHost(address string) (string, error) {
+	if !strings.Contains(address, "://") {
+		address = "https://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("missing host in registry address %q", address)
+	}
+	return strings.ToLower(u.Host), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// WatchOptions configures the watch command, which re-checks a list of images on an interval
+// and exports the results as Prometheus metrics.
+type WatchOptions struct {
+	Images      []string
+	ImagesFile  string
+	Interval    time.Duration
+	MetricsAddr string
+}
+
+func NewWatchOptions() *WatchOptions {
+	return &WatchOptions{
+		Interval:    5 * time.Minute,
+		MetricsAddr: ":8080",
+	}
+}
+
+func (o *WatchOptions) AddFlags(fs *flag.FlagSet) {
+	fs.Var((*stringList)(&o.Images), "images", "Comma separated images checked by the watch and size commands")
+	fs.StringVar(&o.ImagesFile, "images-file", o.ImagesFile, "File with one image per line checked by the watch and size commands, re-read on every interval")
+	fs.DurationVar(&o.Interval, "interval", o.Interval, "Interval between image checks of the watch command")
+	fs.StringVar(&o.MetricsAddr, "metrics-addr", o.MetricsAddr, "Address the watch command serves Prometheus metrics on at /metrics")
+}
+
+// images returns the images to check, reading ImagesFile again so that it can be changed while watching.
+func (o *WatchOptions) images() ([]string, error) {
+	images := append([]string(nil), o.Images...)
+	if o.ImagesFile == "" {
+		return images, nil
+	}
+	f, err := os.Open(o.ImagesFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			images = append(images, line)
+		}
+	}
+	return images, scanner.Err()
+}
+
+func runWatch(opts *WatchOptions, kc kubernetes.Interface) {
+	if opts.Interval <= 0 {
+		glog.Fatalf("Invalid interval %s", opts.Interval)
+	}
+	if len(opts.Images) == 0 && opts.ImagesFile == "" {
+		glog.Fatalln("No images to watch, set -images or -images-file")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		glog.Fatalln(http.ListenAndServe(opts.MetricsAddr, mux))
+	}()
+	glog.Infof("Serving metrics on %s/metrics", opts.MetricsAddr)
+
+	var pullSecrets []v1.Secret
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		retryOptions.ResetBudget()
+		// keep the last known secrets if the API server is unavailable
+		if secrets, err := ListPullSecrets(kc); err != nil {
+			glog.Errorf("Failed to list pull secrets: %s", err)
+		} else {
+			pullSecrets = secrets
+		}
+
+		images, err := opts.images()
+		if err != nil {
+			glog.Errorf("Failed to read images: %s", err)
+		}
+		for _, img := range images {
+			result, err := PullImage(img, pullSecrets)
+			recordCheck(result, err)
+			if err != nil {
+				glog.Warningf("Image %s: %s", img, ClassifyError(err, result.MediaType))
+			} else {
+				glog.V(2).Infof("Image %s: pulled with %s", img, result.CredentialSource)
+			}
+		}
+		CheckRateLimits(pullSecrets)
+
+		<-ticker.C
+	}
+}
+
+// stringList is a flag.Value holding a comma separated list. The flag may be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	items := splitList(value)
+	if len(items) == 0 {
+		return fmt.Errorf("empty list")
+	}
+	*l = append(*l, items...)
+	return nil
+}